@@ -2,24 +2,30 @@ package main
 
 import (
 	crand "crypto/rand"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	mrand "math/rand"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
+	"github.com/jaylees14/Manhattan-Server/maintenance"
 )
 
 type App struct {
-	Router *mux.Router
-	DB     *sql.DB
+	Router      *mux.Router
+	DB          *sql.DB
+	Maintenance *maintenance.Job
+	OIDC        *OIDCProvider
 }
 
 type Count struct {
@@ -35,6 +41,10 @@ type TokenRequest struct {
 	Refresh string `json:"refresh"`
 }
 
+type OIDCLoginResponse struct {
+	AuthorizationURL string `json:"authorization_url"`
+}
+
 type AccountResponse struct {
 	Access      string `json:"access"`
 	Refresh     string `json:"refresh"`
@@ -42,12 +52,35 @@ type AccountResponse struct {
 }
 
 const TOKEN_SIZE int = 64
+const BEARER_PREFIX string = "Bearer "
+const MAX_USERNAME int = 16
+
+// Time allowed to complete an OpenID Connect login at the provider
+const OIDC_LOGIN_EXPIRE time.Duration = 10 * time.Minute
+
+// Cookie binding an OpenID Connect login to the client that started it
+const OIDC_BINDING_COOKIE string = "oidc_binding"
+const OIDC_COOKIE_PATH string = "/api/v1/authenticate/oidc"
 
 // Expiration in years, months, days
 var accessExpire = [3]int{0, 1, 0}
 var refreshExpire = [3]int{1, 0, 0}
 
-/* Initialise database connection, mux router and routes */
+/* Stale rows purged by the maintenance job, a token pair is useless once its
+** refresh token has expired */
+var maintenanceTasks = []maintenance.PurgeTask{
+	{
+		Name: "token",
+		Stmt: "DELETE FROM token WHERE refresh_expire < ? LIMIT ?",
+	},
+	{
+		Name: "oidc_login",
+		Stmt: "DELETE FROM oidc_login WHERE login_expire < ? LIMIT ?",
+	},
+}
+
+/* Initialise database connection, maintenance job, mux router and routes.
+** OpenID Connect login is disabled until a provider is set */
 func (a *App) Initialise(dbUser, dbPassword, dbHost, dbName string) error {
 	connectionString := fmt.Sprintf("%s:%s@tcp(%s)/%s", dbUser, dbPassword,
 		dbHost, dbName)
@@ -56,6 +89,13 @@ func (a *App) Initialise(dbUser, dbPassword, dbHost, dbName string) error {
 	if err != nil {
 		return err
 	}
+	a.Maintenance = &maintenance.Job{
+		DB:        a.DB,
+		LockName:  fmt.Sprintf("%s_authenticate_maintenance", dbName),
+		BatchSize: maintenance.BATCH_SIZE,
+		Tasks:     maintenanceTasks,
+	}
+	a.OIDC = NewOIDCProvider(OIDCConfiguration{})
 	a.Router = mux.NewRouter()
 	a.initialiseRoutes()
 	return nil
@@ -75,6 +115,12 @@ func (a *App) initialiseRoutes() {
 		a.validateLogin).Methods(http.MethodPost)
 	a.Router.HandleFunc(fmt.Sprintf("%s/authenticate/refresh", prefix),
 		a.refreshTokens).Methods(http.MethodPost)
+	a.Router.HandleFunc(fmt.Sprintf("%s/authenticate/oidc/login", prefix),
+		a.startOIDCLogin).Methods(http.MethodGet)
+	a.Router.HandleFunc(fmt.Sprintf("%s/authenticate/oidc/callback", prefix),
+		a.finishOIDCLogin).Methods(http.MethodGet)
+	a.Router.HandleFunc(fmt.Sprintf("%s/authenticate/maintenance", prefix),
+		a.getMaintenance).Methods(http.MethodGet)
 }
 
 /* Respond with a error JSON */
@@ -90,6 +136,50 @@ func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.Write(response)
 }
 
+/* Validate auth token and get user ID */
+func getIDFromToken(db *sql.DB, r *http.Request) (uint32, error) {
+	var tok Token
+
+	// Get raw Authorization header
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		return tok.UserID, errors.New("Authorization header required")
+	}
+
+	// Check request is sending a bearer token
+	if !strings.HasPrefix(authHeader, BEARER_PREFIX) {
+		return tok.UserID, errors.New("Bearer token required")
+	}
+
+	// Check token and get user_id
+	tok.Access = authHeader[len(BEARER_PREFIX):]
+	err := tok.GetIDFromAccess(db)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			return tok.UserID,
+				errors.New("The access token provided does not match any user")
+		default:
+			return tok.UserID, err
+		}
+	}
+	return tok.UserID, nil
+}
+
+/* Validate user_id is a developer */
+func checkDeveloper(db *sql.DB, id uint32) error {
+	acc := Account{UserID: id}
+	err := acc.GetType(db)
+	if err != nil {
+		return errors.New("User not found")
+	}
+
+	if acc.AccountType != "developer" {
+		return errors.New("User must be a developer")
+	}
+	return nil
+}
+
 /* Generate a unique given target id in a given table */
 func generateID(db *sql.DB, table, targetID string) (uint32, error) {
 	seed := mrand.NewSource(time.Now().UnixNano())
@@ -358,3 +448,231 @@ func (a *App) refreshTokens(w http.ResponseWriter, r *http.Request) {
 
 	respondWithTokensAndType(a.DB, w, acc.UserID, acc.AccountType)
 }
+
+/* Return maintenance job metrics, from a developer account */
+func (a *App) getMaintenance(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromToken(a.DB, r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	err = checkDeveloper(a.DB, id)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, a.Maintenance.Metrics())
+}
+
+/* Start an OpenID Connect login and return the provider URL to send the user
+** to. If a valid access token is sent, the provider identity is linked to the
+** existing account instead of a new one */
+func (a *App) startOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if !a.OIDC.Enabled() {
+		respondWithError(w, http.StatusNotFound,
+			"OpenID Connect login is not configured")
+		return
+	}
+
+	login := OIDCLogin{
+		LoginExpire: time.Now().Add(OIDC_LOGIN_EXPIRE).UnixNano(),
+	}
+	if r.Header.Get("Authorization") != "" {
+		id, err := getIDFromToken(a.DB, r)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		login.LinkUserID = sql.NullInt64{Int64: int64(id), Valid: true}
+	}
+
+	// Create the state, PKCE verifier, nonce and client binding
+	var err error
+	login.State, err = generateToken(TOKEN_SIZE)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	login.Verifier, err = generateToken(TOKEN_SIZE)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	login.Nonce, err = generateToken(TOKEN_SIZE)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	login.Binding, err = generateToken(TOKEN_SIZE)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	authURL, err := a.OIDC.AuthorizationURL(login.State, login.Verifier,
+		login.Nonce)
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	// Create the login entry
+	err = login.CreateLogin(a.DB)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Only the client holding the cookie can complete the login, so a callback
+	// for another client's login cannot link or sign in to the wrong account
+	http.SetCookie(w, &http.Cookie{
+		Name:     OIDC_BINDING_COOKIE,
+		Value:    login.Binding,
+		Path:     OIDC_COOKIE_PATH,
+		MaxAge:   int(OIDC_LOGIN_EXPIRE / time.Second),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	respondWithJSON(w, http.StatusOK, OIDCLoginResponse{AuthorizationURL: authURL})
+}
+
+/* Complete an OpenID Connect login with the code returned by the provider,
+** linking the provider identity to an account, and return auth tokens and
+** account type */
+func (a *App) finishOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if !a.OIDC.Enabled() {
+		respondWithError(w, http.StatusNotFound,
+			"OpenID Connect login is not configured")
+		return
+	}
+
+	if r.URL.Query().Get("error") != "" {
+		respondWithError(w, http.StatusUnauthorized,
+			"The identity provider rejected the login")
+		return
+	}
+	code := r.URL.Query().Get("code")
+	login := OIDCLogin{State: r.URL.Query().Get("state")}
+	if len(code) == 0 || len(login.State) != TOKEN_SIZE {
+		respondWithError(w, http.StatusBadRequest,
+			"Code and state parameters are required")
+		return
+	}
+
+	// Check the login exists and has not expired
+	err := login.TakeLogin(a.DB, time.Now().UnixNano())
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusUnauthorized,
+				"The state provided does not match any login")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	// Check the login was started by this client, and clear its cookie
+	http.SetCookie(w, &http.Cookie{
+		Name:     OIDC_BINDING_COOKIE,
+		Path:     OIDC_COOKIE_PATH,
+		MaxAge:   -1,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	cookie, err := r.Cookie(OIDC_BINDING_COOKIE)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value),
+		[]byte(login.Binding)) != 1 {
+		respondWithError(w, http.StatusUnauthorized,
+			"The login was started by another client")
+		return
+	}
+
+	// Redeem the code, proving this server started the login
+	claims, err := a.OIDC.Exchange(code, login.Verifier, login.Nonce)
+	if err != nil {
+		switch err {
+		case errOIDCProvider:
+			respondWithError(w, http.StatusBadGateway, err.Error())
+		default:
+			respondWithError(w, http.StatusUnauthorized, err.Error())
+		}
+		return
+	}
+
+	// Find or create the account linked to the identity
+	ident := OIDCIdentity{Issuer: claims.Issuer, Subject: claims.Subject}
+	err = ident.GetID(a.DB)
+	switch err {
+	case nil:
+		if login.LinkUserID.Valid &&
+			uint32(login.LinkUserID.Int64) != ident.UserID {
+			respondWithError(w, http.StatusConflict,
+				"The identity is already linked to another account")
+			return
+		}
+	case sql.ErrNoRows:
+		if login.LinkUserID.Valid {
+			ident.UserID = uint32(login.LinkUserID.Int64)
+		} else {
+			ident.UserID, err = createOIDCAccount(a.DB, claims)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+		err = ident.CreateIdentity(a.DB)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	default:
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Get account type
+	acc := Account{UserID: ident.UserID}
+	err = acc.GetType(a.DB)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusInternalServerError,
+				"User not found after successful validation")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithTokensAndType(a.DB, w, acc.UserID, acc.AccountType)
+}
+
+/* Create a player account for a new OpenID Connect identity. The password is
+** random, so the account can only be used through the provider */
+func createOIDCAccount(db *sql.DB, claims OIDCClaims) (uint32, error) {
+	acc := Account{AccountType: "player"}
+	var err error
+	acc.Username, err = usernameFromClaims(db, claims)
+	if err != nil {
+		return acc.UserID, err
+	}
+	acc.UserID, err = generateID(db, "account", "user_id")
+	if err != nil {
+		return acc.UserID, err
+	}
+	password, err := generateToken(TOKEN_SIZE)
+	if err != nil {
+		return acc.UserID, err
+	}
+	acc.Password, err = bcrypt.GenerateFromPassword([]byte(password),
+		bcrypt.DefaultCost)
+	if err != nil {
+		return acc.UserID, err
+	}
+	return acc.UserID, acc.CreateAccount(db)
+}
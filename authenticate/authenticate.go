@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"log"
+	"time"
 )
 
 var config Configuration
@@ -23,5 +24,14 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	a.OIDC = NewOIDCProvider(config.OIDC)
+
+	// Start purging stale rows in the background
+	if config.MaintenanceBatchSize > 0 {
+		a.Maintenance.BatchSize = config.MaintenanceBatchSize
+	}
+	a.Maintenance.Start(time.Duration(config.MaintenanceInterval) * time.Second)
+
 	log.Fatal(a.Run(config.Port))
 }
@@ -2,14 +2,23 @@ package main
 
 import (
 	"bytes"
+	"crypto"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"sync"
 	"testing"
+	"time"
 )
 
 var testA App
@@ -69,12 +78,28 @@ func checkTablesExistEmpty() error {
 }
 
 func clearAccountTable(t *testing.T) {
-	_, err := testA.DB.Exec("DELETE FROM account")
+	// Clear tables referencing accounts first
+	_, err := testA.DB.Exec("DELETE FROM oidc_identity")
+	if err != nil {
+		t.Errorf("Failed to clear OIDC identity table")
+	}
+	_, err = testA.DB.Exec("DELETE FROM oidc_login")
+	if err != nil {
+		t.Errorf("Failed to clear OIDC login table")
+	}
+	_, err = testA.DB.Exec("DELETE FROM account")
 	if err != nil {
 		t.Errorf("Failed to clear account table")
 	}
 }
 
+func clearIdempotencyTable(t *testing.T) {
+	_, err := testA.DB.Exec("DELETE FROM idempotency")
+	if err != nil {
+		t.Errorf("Failed to clear idempotency table")
+	}
+}
+
 func clearTokenTable(t *testing.T) {
 	_, err := testA.DB.Exec("DELETE FROM token")
 	if err != nil {
@@ -186,6 +211,39 @@ func TestRegisterExistingUsername(t *testing.T) {
 	checkResponseCode(t, http.StatusBadRequest, res.Code)
 }
 
+/* Check idempotency keys are ignored on registration, so responses holding
+** tokens are never stored. A retry is rejected as an existing username */
+func TestRegisterIdempotencyKeyIgnored(t *testing.T) {
+	clearIdempotencyTable(t)
+	clearTokenTable(t)
+	clearAccountTable(t)
+
+	payload := []byte(`{"username":"John","password":"Smith"}`)
+
+	codes := []int{http.StatusOK, http.StatusBadRequest}
+	for i := 0; i < len(codes); i++ {
+		req, err := http.NewRequest(http.MethodPost,
+			"/api/v1/authenticate/register", bytes.NewBuffer(payload))
+		req.Header.Set("Idempotency-Key", "register-john")
+		if err != nil {
+			t.Errorf("Failed to create request")
+		}
+
+		res := executeRequest(req)
+		checkResponseCode(t, codes[i], res.Code)
+		if res.Header().Get("Idempotent-Replayed") != "" {
+			t.Errorf("Expected the response not to be replayed")
+		}
+	}
+
+	var keyCount Count
+	err := testA.DB.QueryRow("SELECT COUNT(*) FROM idempotency").Scan(
+		&keyCount.Value)
+	if err != nil || keyCount.Value != 0 {
+		t.Errorf("Expected no idempotency keys to be stored")
+	}
+}
+
 /* Check invalid JSON is not accepted for login */
 func TestLoginInvalidJSON(t *testing.T) {
 	clearTokenTable(t)
@@ -518,3 +576,408 @@ func TestRefreshRemoveToken(t *testing.T) {
 	res = executeRequest(req)
 	checkResponseCode(t, http.StatusUnauthorized, res.Code)
 }
+
+/* Check the maintenance job purges expired token pairs and keeps valid ones */
+func TestMaintenancePurgeTokens(t *testing.T) {
+	clearTokenTable(t)
+	clearAccountTable(t)
+
+	// First register a user
+	payload := []byte(`{"username":"John","password":"Smith"}`)
+
+	req, err := http.NewRequest(http.MethodPost,
+		"/api/v1/authenticate/register", bytes.NewBuffer(payload))
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	decoder := json.NewDecoder(res.Body)
+	var tok Token
+	err = decoder.Decode(&tok)
+
+	// Add an expired token pair for the same user
+	err = tok.GetID(testA.DB)
+	if err != nil {
+		t.Errorf("Failed to get user ID")
+	}
+	expired := Token{
+		PairID:        1,
+		UserID:        tok.UserID,
+		Access:        "abcdefghijklmnopqrstuvwxyz1234567890abcdefghijklmnopqrstuvwxyz12",
+		Refresh:       "abcdefghijklmnopqrstuvwxyz1234567890abcdefghijklmnopqrstuvwxyz13",
+		AccessExpire:  1,
+		RefreshExpire: 1,
+	}
+	err = expired.CreateToken(testA.DB)
+	if err != nil {
+		t.Errorf("Failed to create expired token")
+	}
+
+	err = testA.Maintenance.Run()
+	if err != nil {
+		t.Errorf("Maintenance run failed: %s", err)
+	}
+
+	// Check only the valid token pair remains
+	var tokenCount Count
+	err = testA.DB.QueryRow("SELECT COUNT(*) FROM token").Scan(&tokenCount.Value)
+	if err != nil {
+		t.Errorf("Failed to count tokens")
+	}
+	if tokenCount.Value != 1 {
+		t.Errorf("Expected 1 token pair. Actual number was %d", tokenCount.Value)
+	}
+	err = tok.GetID(testA.DB)
+	if err != nil {
+		t.Errorf("Expected valid token pair to remain")
+	}
+	if testA.Maintenance.Metrics().Purged["token"] < 1 {
+		t.Errorf("Expected purged token metric to be at least 1")
+	}
+}
+
+/* Local stub OpenID Connect provider, approving every login for a single
+** subject and issuing RS256 signed ID tokens */
+type stubIssuer struct {
+	Server *httptest.Server
+	Key    *rsa.PrivateKey
+	mutex  sync.Mutex
+	codes  map[string]stubAuthorization
+}
+
+type stubAuthorization struct {
+	Challenge string
+	Nonce     string
+}
+
+const STUB_CLIENT_ID string = "blueprint"
+const STUB_KEY_ID string = "stub-key"
+
+func newStubIssuer(t *testing.T) *stubIssuer {
+	key, err := rsa.GenerateKey(crand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate stub issuer key")
+	}
+	issuer := &stubIssuer{Key: key, codes: make(map[string]stubAuthorization)}
+
+	router := http.NewServeMux()
+	router.HandleFunc("/.well-known/openid-configuration",
+		func(w http.ResponseWriter, r *http.Request) {
+			respondWithJSON(w, http.StatusOK, OIDCDiscovery{
+				Issuer:                issuer.Server.URL,
+				AuthorizationEndpoint: issuer.Server.URL + "/authorize",
+				TokenEndpoint:         issuer.Server.URL + "/token",
+				JWKSURI:               issuer.Server.URL + "/jwks",
+			})
+		})
+	router.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		respondWithJSON(w, http.StatusOK, OIDCKeySet{Keys: []OIDCKey{{
+			KeyID:     STUB_KEY_ID,
+			KeyType:   "RSA",
+			Algorithm: "RS256",
+			Use:       "sig",
+			Modulus:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			Exponent: base64.RawURLEncoding.EncodeToString(
+				big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	router.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		issuer.mutex.Lock()
+		auth, ok := issuer.codes[r.PostFormValue("code")]
+		delete(issuer.codes, r.PostFormValue("code"))
+		issuer.mutex.Unlock()
+
+		// Check the PKCE verifier matches the challenge
+		hashed := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if !ok || r.PostFormValue("client_id") != STUB_CLIENT_ID ||
+			base64.RawURLEncoding.EncodeToString(hashed[:]) != auth.Challenge {
+			respondWithJSON(w, http.StatusBadRequest,
+				map[string]string{"error": "invalid_grant"})
+			return
+		}
+		respondWithJSON(w, http.StatusOK, OIDCTokenResponse{
+			IDToken: issuer.signIDToken(t, auth.Nonce),
+		})
+	})
+	issuer.Server = httptest.NewServer(router)
+	return issuer
+}
+
+/* Simulate the user approving the login at the provider, returning the code
+** and state the provider would redirect back with */
+func (issuer *stubIssuer) authorize(t *testing.T, authURL string) (string,
+	string) {
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("Failed to parse authorization URL")
+	}
+	params := parsed.Query()
+	if params.Get("code_challenge_method") != "S256" {
+		t.Errorf("Expected S256 code challenge method")
+	}
+	code, err := generateToken(32)
+	if err != nil {
+		t.Fatalf("Failed to generate code")
+	}
+	issuer.mutex.Lock()
+	issuer.codes[code] = stubAuthorization{
+		Challenge: params.Get("code_challenge"),
+		Nonce:     params.Get("nonce"),
+	}
+	issuer.mutex.Unlock()
+	return code, params.Get("state")
+}
+
+func (issuer *stubIssuer) signIDToken(t *testing.T, nonce string) string {
+	header, _ := json.Marshal(OIDCHeader{Algorithm: "RS256", KeyID: STUB_KEY_ID})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":                issuer.Server.URL,
+		"sub":                "student-1",
+		"aud":                STUB_CLIENT_ID,
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"nonce":              nonce,
+		"preferred_username": "jsmith",
+	})
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(claims)
+	hashed := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(crand.Reader, issuer.Key, crypto.SHA256,
+		hashed[:])
+	if err != nil {
+		t.Fatalf("Failed to sign ID token")
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+/* Point the app at the stub issuer, returning a function to disable it again */
+func useStubIssuer(issuer *stubIssuer) func() {
+	testA.OIDC = NewOIDCProvider(OIDCConfiguration{
+		Issuer:      issuer.Server.URL,
+		ClientID:    STUB_CLIENT_ID,
+		RedirectURL: "blueprint://oidc",
+	})
+	return func() {
+		testA.OIDC = NewOIDCProvider(OIDCConfiguration{})
+	}
+}
+
+/* Start a login and return the decoded authorization URL */
+/* Start a provider login, linking to the account of the access token if one
+** is given, and return the authorization URL and binding cookie */
+func startOIDCLogin(t *testing.T, access string) (string, *http.Cookie) {
+	req, err := http.NewRequest(http.MethodGet,
+		"/api/v1/authenticate/oidc/login", nil)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+	if access != "" {
+		req.Header.Set("Authorization", "Bearer "+access)
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var loginRes OIDCLoginResponse
+	err = json.NewDecoder(res.Body).Decode(&loginRes)
+	if err != nil {
+		t.Errorf("Failed to decode login response")
+	}
+	var binding *http.Cookie
+	for _, cookie := range res.Result().Cookies() {
+		if cookie.Name == OIDC_BINDING_COOKIE {
+			binding = cookie
+		}
+	}
+	if binding == nil || !binding.HttpOnly {
+		t.Errorf("Expected an HttpOnly binding cookie")
+	}
+	return loginRes.AuthorizationURL, binding
+}
+
+/* Complete a provider login, sending the binding cookie if one is given */
+func finishOIDCLogin(code, state string,
+	binding *http.Cookie) *httptest.ResponseRecorder {
+	params := url.Values{}
+	params.Set("code", code)
+	params.Set("state", state)
+	req, _ := http.NewRequest(http.MethodGet,
+		"/api/v1/authenticate/oidc/callback?"+params.Encode(), nil)
+	if binding != nil {
+		req.AddCookie(&http.Cookie{Name: binding.Name, Value: binding.Value})
+	}
+	return executeRequest(req)
+}
+
+/* Check provider login is unavailable when not configured */
+func TestOIDCNotConfigured(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet,
+		"/api/v1/authenticate/oidc/login", nil)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, res.Code)
+}
+
+/* Check a provider login creates and then reuses a linked player account */
+func TestOIDCLogin(t *testing.T) {
+	clearTokenTable(t)
+	clearAccountTable(t)
+
+	issuer := newStubIssuer(t)
+	defer issuer.Server.Close()
+	defer useStubIssuer(issuer)()
+
+	for i := 0; i < 2; i++ {
+		authURL, binding := startOIDCLogin(t, "")
+		code, state := issuer.authorize(t, authURL)
+		res := finishOIDCLogin(code, state, binding)
+		checkResponseCode(t, http.StatusOK, res.Code)
+
+		// Check tokens returned are of length 64 and account type is player
+		var m map[string]string
+		json.Unmarshal(res.Body.Bytes(), &m)
+		if len(m["access"]) != 64 {
+			t.Errorf("Expected access token of length 64. Actual length was %d",
+				len(m["access"]))
+		}
+		if len(m["refresh"]) != 64 {
+			t.Errorf("Expected refresh token of length 64. Actual length was %d",
+				len(m["refresh"]))
+		}
+		if m["account_type"] != "player" {
+			t.Errorf("Expected account type player. Actual was %s",
+				m["account_type"])
+		}
+	}
+
+	// Check both logins used the same account
+	var accountCount Count
+	err := testA.DB.QueryRow("SELECT COUNT(*) FROM account WHERE username='jsmith'").Scan(&accountCount.Value)
+	if err != nil {
+		t.Errorf("Failed to count accounts")
+	}
+	if accountCount.Value != 1 {
+		t.Errorf("Expected 1 account. Actual number was %d", accountCount.Value)
+	}
+}
+
+/* Check a callback with an unknown state is rejected */
+func TestOIDCIncorrectState(t *testing.T) {
+	clearTokenTable(t)
+	clearAccountTable(t)
+
+	issuer := newStubIssuer(t)
+	defer issuer.Server.Close()
+	defer useStubIssuer(issuer)()
+
+	authURL, binding := startOIDCLogin(t, "")
+	code, _ := issuer.authorize(t, authURL)
+	res := finishOIDCLogin(code,
+		"abcdefghijklmnopqrstuvwxyz1234567890abcdefghijklmnopqrstuvwxyz12",
+		binding)
+	checkResponseCode(t, http.StatusUnauthorized, res.Code)
+}
+
+/* Check the provider rejects a code redeemed without the matching PKCE
+** verifier */
+func TestOIDCIncorrectVerifier(t *testing.T) {
+	clearTokenTable(t)
+	clearAccountTable(t)
+
+	issuer := newStubIssuer(t)
+	defer issuer.Server.Close()
+	defer useStubIssuer(issuer)()
+
+	authURL, binding := startOIDCLogin(t, "")
+	code, state := issuer.authorize(t, authURL)
+	_, err := testA.DB.Exec("UPDATE oidc_login SET verifier=? WHERE state=?",
+		"abcdefghijklmnopqrstuvwxyz1234567890abcdefghijklmnopqrstuvwxyz12", state)
+	if err != nil {
+		t.Errorf("Failed to change verifier")
+	}
+
+	res := finishOIDCLogin(code, state, binding)
+	checkResponseCode(t, http.StatusUnauthorized, res.Code)
+}
+
+/* Register a player account and return its access token */
+func registerOIDCLinkAccount(t *testing.T) string {
+	payload := []byte(`{"username":"John","password":"Smith"}`)
+	req, err := http.NewRequest(http.MethodPost,
+		"/api/v1/authenticate/register", bytes.NewBuffer(payload))
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var m map[string]string
+	json.Unmarshal(res.Body.Bytes(), &m)
+	return m["access"]
+}
+
+/* Count the provider identities linked to an account */
+func countOIDCIdentities(t *testing.T, username string) int {
+	var identityCount Count
+	err := testA.DB.QueryRow("SELECT COUNT(*) FROM oidc_identity JOIN account ON oidc_identity.user_id=account.user_id WHERE username=?",
+		username).Scan(&identityCount.Value)
+	if err != nil {
+		t.Errorf("Failed to count identities")
+	}
+	return identityCount.Value
+}
+
+/* Check a login started with an access token links the identity to that
+** account when completed by the same client */
+func TestOIDCLinkAccount(t *testing.T) {
+	clearTokenTable(t)
+	clearAccountTable(t)
+
+	issuer := newStubIssuer(t)
+	defer issuer.Server.Close()
+	defer useStubIssuer(issuer)()
+
+	authURL, binding := startOIDCLogin(t, registerOIDCLinkAccount(t))
+	code, state := issuer.authorize(t, authURL)
+	res := finishOIDCLogin(code, state, binding)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	if count := countOIDCIdentities(t, "John"); count != 1 {
+		t.Errorf("Expected 1 linked identity. Actual number was %d", count)
+	}
+}
+
+/* Check a callback from a client other than the one which started the login
+** is rejected, so another user's login cannot be linked to an account */
+func TestOIDCLinkOtherClient(t *testing.T) {
+	clearTokenTable(t)
+	clearAccountTable(t)
+
+	issuer := newStubIssuer(t)
+	defer issuer.Server.Close()
+	defer useStubIssuer(issuer)()
+
+	access := registerOIDCLinkAccount(t)
+	authURL, _ := startOIDCLogin(t, access)
+	code, state := issuer.authorize(t, authURL)
+	otherURL, otherBinding := startOIDCLogin(t, access)
+	otherCode, otherState := issuer.authorize(t, otherURL)
+
+	// With the binding cookie of another login
+	res := finishOIDCLogin(code, state, otherBinding)
+	checkResponseCode(t, http.StatusUnauthorized, res.Code)
+
+	// Without a binding cookie
+	res = finishOIDCLogin(otherCode, otherState, nil)
+	checkResponseCode(t, http.StatusUnauthorized, res.Code)
+
+	if count := countOIDCIdentities(t, "John"); count != 0 {
+		t.Errorf("Expected 0 linked identities. Actual number was %d", count)
+	}
+}
@@ -11,6 +11,11 @@ type Configuration struct {
 	DBPassword string `json:"dbPassword"`
 	DBHost     string `json:"dbHost"`
 	DBName     string `json:"dbName"`
+	// Maintenance interval in seconds, zero disables the job
+	MaintenanceInterval  int `json:"maintenanceInterval"`
+	MaintenanceBatchSize int `json:"maintenanceBatchSize"`
+	// OpenID Connect provider, a blank issuer disables provider login
+	OIDC OIDCConfiguration `json:"oidc"`
 }
 
 func GetConfiguration(fileName string) (Configuration, error) {
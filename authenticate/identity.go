@@ -0,0 +1,61 @@
+package main
+
+import (
+	"database/sql"
+)
+
+type OIDCLogin struct {
+	State       string        `json:"state"`
+	Verifier    string        `json:"verifier"`
+	Nonce       string        `json:"nonce"`
+	Binding     string        `json:"binding"`
+	LinkUserID  sql.NullInt64 `json:"link_user_id"`
+	LoginExpire int64         `json:"login_expire"`
+}
+
+type OIDCIdentity struct {
+	Issuer  string `json:"issuer"`
+	Subject string `json:"subject"`
+	UserID  uint32 `json:"user_id"`
+}
+
+func (login *OIDCLogin) CreateLogin(db *sql.DB) error {
+	stmt := "INSERT INTO oidc_login VALUES (?, ?, ?, ?, ?, ?)"
+	_, err := db.Exec(stmt, login.State, login.Verifier, login.Nonce,
+		login.Binding, login.LinkUserID, login.LoginExpire)
+	return err
+}
+
+/* Get and remove an unexpired login, so each state can only be used once */
+func (login *OIDCLogin) TakeLogin(db *sql.DB, now int64) error {
+	stmt := "SELECT verifier, nonce, binding, link_user_id FROM oidc_login WHERE state=? AND login_expire>=?"
+	err := db.QueryRow(stmt, login.State, now).Scan(&login.Verifier,
+		&login.Nonce, &login.Binding, &login.LinkUserID)
+	if err != nil {
+		return err
+	}
+	// Another request may have taken the login in the meantime
+	res, err := db.Exec("DELETE FROM oidc_login WHERE state=?", login.State)
+	if err != nil {
+		return err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count != 1 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (ident *OIDCIdentity) CreateIdentity(db *sql.DB) error {
+	stmt := "INSERT INTO oidc_identity VALUES (?, ?, ?)"
+	_, err := db.Exec(stmt, ident.Issuer, ident.Subject, ident.UserID)
+	return err
+}
+
+func (ident *OIDCIdentity) GetID(db *sql.DB) error {
+	stmt := "SELECT user_id FROM oidc_identity WHERE issuer=? AND subject=?"
+	return db.QueryRow(stmt, ident.Issuer, ident.Subject).Scan(&ident.UserID)
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type OIDCConfiguration struct {
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"clientID"`
+	ClientSecret string   `json:"clientSecret"`
+	RedirectURL  string   `json:"redirectURL"`
+	Scopes       []string `json:"scopes"`
+}
+
+type OIDCDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type OIDCKeySet struct {
+	Keys []OIDCKey `json:"keys"`
+}
+
+type OIDCKey struct {
+	KeyID     string `json:"kid"`
+	KeyType   string `json:"kty"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	Modulus   string `json:"n"`
+	Exponent  string `json:"e"`
+}
+
+type OIDCTokenResponse struct {
+	IDToken string `json:"id_token"`
+}
+
+type OIDCHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+type OIDCClaims struct {
+	Issuer            string          `json:"iss"`
+	Subject           string          `json:"sub"`
+	Audience          json.RawMessage `json:"aud"`
+	Expiry            int64           `json:"exp"`
+	Nonce             string          `json:"nonce"`
+	PreferredUsername string          `json:"preferred_username"`
+	Email             string          `json:"email"`
+}
+
+/* Client for a single OpenID Connect provider, caching the discovery
+** document and signing keys */
+type OIDCProvider struct {
+	Config    OIDCConfiguration
+	Client    *http.Client
+	mutex     sync.Mutex
+	discovery *OIDCDiscovery
+	keys      map[string]*rsa.PublicKey
+}
+
+// Allowed clock difference between the server and the provider
+const OIDC_CLOCK_SKEW time.Duration = time.Minute
+
+var errOIDCProvider = errors.New("Could not reach the identity provider")
+
+func NewOIDCProvider(config OIDCConfiguration) *OIDCProvider {
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "profile", "email"}
+	}
+	return &OIDCProvider{
+		Config: config,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+/* The provider is disabled unless an issuer and client are configured */
+func (p *OIDCProvider) Enabled() bool {
+	return p != nil && p.Config.Issuer != "" && p.Config.ClientID != ""
+}
+
+/* Fetch a JSON document from the provider */
+func (p *OIDCProvider) getJSON(target string, v interface{}) error {
+	res, err := p.Client.Get(target)
+	if err != nil {
+		return errOIDCProvider
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errOIDCProvider
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+/* Get the provider discovery document, fetching it on first use */
+func (p *OIDCProvider) getDiscovery() (OIDCDiscovery, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.discovery != nil {
+		return *p.discovery, nil
+	}
+
+	var discovery OIDCDiscovery
+	err := p.getJSON(strings.TrimSuffix(p.Config.Issuer, "/")+
+		"/.well-known/openid-configuration", &discovery)
+	if err != nil {
+		return discovery, err
+	}
+	if discovery.Issuer != p.Config.Issuer {
+		return discovery, errors.New("Identity provider issuer mismatch")
+	}
+	p.discovery = &discovery
+	return discovery, nil
+}
+
+/* Get the signing key with the given ID, refetching the key set if the key
+** is unknown in case the provider has rotated its keys */
+func (p *OIDCProvider) getKey(keyID string) (*rsa.PublicKey, error) {
+	discovery, err := p.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if key, ok := p.keys[keyID]; ok {
+		return key, nil
+	}
+
+	var keySet OIDCKeySet
+	err = p.getJSON(discovery.JWKSURI, &keySet)
+	if err != nil {
+		return nil, err
+	}
+	p.keys = make(map[string]*rsa.PublicKey)
+	for i := 0; i < len(keySet.Keys); i++ {
+		if keySet.Keys[i].KeyType != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(keySet.Keys[i].Modulus)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(keySet.Keys[i].Exponent)
+		if err != nil {
+			continue
+		}
+		p.keys[keySet.Keys[i].KeyID] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	key, ok := p.keys[keyID]
+	if !ok {
+		return nil, errors.New("Unknown ID token signing key")
+	}
+	return key, nil
+}
+
+/* Build the URL to send the user to, with a S256 PKCE challenge derived from
+** the verifier */
+func (p *OIDCProvider) AuthorizationURL(state, verifier, nonce string) (string,
+	error) {
+	discovery, err := p.getDiscovery()
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.Config.ClientID)
+	params.Set("redirect_uri", p.Config.RedirectURL)
+	params.Set("scope", strings.Join(p.Config.Scopes, " "))
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge",
+		base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + params.Encode(), nil
+}
+
+/* Exchange an authorization code and PKCE verifier for a verified set of ID
+** token claims */
+func (p *OIDCProvider) Exchange(code, verifier, nonce string) (OIDCClaims,
+	error) {
+	var claims OIDCClaims
+	discovery, err := p.getDiscovery()
+	if err != nil {
+		return claims, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.Config.RedirectURL)
+	form.Set("client_id", p.Config.ClientID)
+	form.Set("code_verifier", verifier)
+	if p.Config.ClientSecret != "" {
+		form.Set("client_secret", p.Config.ClientSecret)
+	}
+
+	res, err := p.Client.PostForm(discovery.TokenEndpoint, form)
+	if err != nil {
+		return claims, errOIDCProvider
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return claims, errors.New("The identity provider rejected the login")
+	}
+
+	var tokRes OIDCTokenResponse
+	err = json.NewDecoder(res.Body).Decode(&tokRes)
+	if err != nil || tokRes.IDToken == "" {
+		return claims, errors.New("The identity provider returned no ID token")
+	}
+
+	return p.VerifyIDToken(tokRes.IDToken, nonce)
+}
+
+/* Check an RS256 signed ID token was issued by the provider, for this client
+** and login, and has not expired */
+func (p *OIDCProvider) VerifyIDToken(rawToken, nonce string) (OIDCClaims,
+	error) {
+	var claims OIDCClaims
+	invalid := errors.New("Invalid ID token")
+
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return claims, invalid
+	}
+
+	// Check the header and signature
+	var header OIDCHeader
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(headerJSON, &header) != nil {
+		return claims, invalid
+	}
+	if header.Algorithm != "RS256" {
+		return claims, errors.New("Unsupported ID token algorithm")
+	}
+	key, err := p.getKey(header.KeyID)
+	if err != nil {
+		return claims, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, invalid
+	}
+	hashed := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], signature)
+	if err != nil {
+		return claims, invalid
+	}
+
+	// Check the claims
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(payload, &claims) != nil {
+		return claims, invalid
+	}
+	if claims.Issuer != p.Config.Issuer {
+		return claims, errors.New("ID token issuer mismatch")
+	}
+	if !audienceContains(claims.Audience, p.Config.ClientID) {
+		return claims, errors.New("ID token audience mismatch")
+	}
+	if time.Unix(claims.Expiry, 0).Add(OIDC_CLOCK_SKEW).Before(time.Now()) {
+		return claims, errors.New("ID token has expired")
+	}
+	if claims.Nonce != nonce {
+		return claims, errors.New("ID token nonce mismatch")
+	}
+	if claims.Subject == "" {
+		return claims, errors.New("ID token has no subject")
+	}
+	return claims, nil
+}
+
+/* The audience claim may be a single string or a list of strings */
+func audienceContains(raw json.RawMessage, clientID string) bool {
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		return single == clientID
+	}
+	var list []string
+	if json.Unmarshal(raw, &list) == nil {
+		for i := 0; i < len(list); i++ {
+			if list[i] == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/* Derive a valid, unused username from the ID token claims */
+func usernameFromClaims(db *sql.DB, claims OIDCClaims) (string, error) {
+	base := claims.PreferredUsername
+	if base == "" {
+		base = strings.Split(claims.Email, "@")[0]
+	}
+	// Keep letters, digits, dots, dashes and underscores only
+	base = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') ||
+			(r >= '0' && r <= '9') || r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return -1
+	}, base)
+	if base == "" {
+		base = "player"
+	}
+	if len(base) > MAX_USERNAME {
+		base = base[:MAX_USERNAME]
+	}
+
+	stmt := "SELECT COUNT(*) FROM account WHERE username=?"
+	username := base
+	for suffix := 1; ; suffix++ {
+		var usernameCount Count
+		err := db.QueryRow(stmt, username).Scan(&usernameCount.Value)
+		if err != nil {
+			return username, err
+		}
+		if usernameCount.Value == 0 {
+			return username, nil
+		}
+		// Make room for the numeric suffix
+		end := fmt.Sprintf("%d", suffix)
+		trimmed := base
+		if len(trimmed)+len(end) > MAX_USERNAME {
+			trimmed = trimmed[:MAX_USERNAME-len(end)]
+		}
+		username = trimmed + end
+	}
+}
@@ -36,3 +36,8 @@ func (tok *Token) GetID(db *sql.DB) error {
 	stmt := "SELECT user_id FROM token WHERE refresh=?"
 	return db.QueryRow(stmt, tok.Refresh).Scan(&tok.UserID)
 }
+
+func (tok *Token) GetIDFromAccess(db *sql.DB) error {
+	stmt := "SELECT user_id FROM token WHERE access=?"
+	return db.QueryRow(stmt, tok.Access).Scan(&tok.UserID)
+}
@@ -0,0 +1,150 @@
+package catalog
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+)
+
+type ItemSchema struct {
+	Items []SchemaItem `json:"items"`
+}
+
+type SchemaItem struct {
+	ItemID    uint32                  `json:"item_id"`
+	Name      string                  `json:"name"`
+	Type      uint32                  `json:"type"`
+	Blueprint []SchemaBlueprintRecipe `json:"blueprint"`
+	MachineID uint32                  `json:"machine_id"`
+	Recipe    []SchemaBlueprintRecipe `json:"recipe"`
+	Fuel      []SchemaFuel            `json:"fuel"`
+	Duration  uint32                  `json:"duration"`
+}
+
+type SchemaBlueprintRecipe struct {
+	ItemID   uint32 `json:"item_id"`
+	Quantity uint32 `json:"quantity"`
+}
+
+type SchemaFuel struct {
+	ItemID uint32 `json:"item_id"`
+}
+
+/* The item catalog, loaded once from the item schema and shared by every
+** service that validates item IDs */
+type Catalog struct {
+	Schema    ItemSchema
+	Limits    ItemLimits
+	items     map[uint32]SchemaItem
+	maxStacks map[uint32]uint32
+	maxGains  map[uint32]uint32
+}
+
+// Path of the item schema relative to each service
+const ITEM_SCHEMA string = "serve/item-schema-v2.json"
+
+const (
+	TYPE_PRIMARY_RESOURCE      = 1
+	TYPE_BLUEPRINT_PLACEABLE   = 2
+	TYPE_MACHINERY_UNPLACEABLE = 3
+	TYPE_BLUEPRINT_UNPLACEABLE = 4
+	TYPE_INTANGIBLE            = 5
+)
+
+/* Load the catalog from an item schema file */
+func Load(filename string) (*Catalog, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var c Catalog
+	decoder := json.NewDecoder(file)
+	err = decoder.Decode(&c.Schema)
+	if err != nil {
+		return nil, err
+	}
+
+	// Build item map
+	c.items = make(map[uint32]SchemaItem)
+	for i := 0; i < len(c.Schema.Items); i++ {
+		item := c.Schema.Items[i]
+		if item.ItemID == 0 {
+			return nil, errors.New("Item schema contains an invalid item ID")
+		}
+		if _, ok := c.items[item.ItemID]; ok {
+			return nil, errors.New("Item schema contains a duplicate item ID")
+		}
+		if item.Type < TYPE_PRIMARY_RESOURCE || item.Type > TYPE_INTANGIBLE {
+			return nil, errors.New("Item schema contains an invalid item type")
+		}
+		c.items[item.ItemID] = item
+	}
+
+	return &c, nil
+}
+
+/* Get an item by ID, returning false if the item does not exist */
+func (c *Catalog) Item(itemID uint32) (SchemaItem, bool) {
+	item, ok := c.items[itemID]
+	return item, ok
+}
+
+func (c *Catalog) IsValid(itemID uint32) bool {
+	_, ok := c.items[itemID]
+	return ok
+}
+
+/* Intangible items, such as electricity, cannot be held in an inventory */
+func (c *Catalog) IsStorable(itemID uint32) bool {
+	item, ok := c.items[itemID]
+	return ok && item.Type != TYPE_INTANGIBLE
+}
+
+/* Only primary resources may be spawned on the map or reported as collected
+** by clients */
+func (c *Catalog) IsSpawnable(itemID uint32) bool {
+	item, ok := c.items[itemID]
+	return ok && item.Type == TYPE_PRIMARY_RESOURCE
+}
+
+/* Blueprints are built from components and recorded as progress */
+func (c *Catalog) IsBlueprint(itemID uint32) bool {
+	item, ok := c.items[itemID]
+	return ok && (item.Type == TYPE_BLUEPRINT_PLACEABLE ||
+		item.Type == TYPE_BLUEPRINT_UNPLACEABLE)
+}
+
+/* Placeable blueprints can be placed in the world once built */
+func (c *Catalog) IsPlaceable(itemID uint32) bool {
+	item, ok := c.items[itemID]
+	return ok && item.Type == TYPE_BLUEPRINT_PLACEABLE
+}
+
+/* Craftable items are made from a recipe on a machine */
+func (c *Catalog) IsCraftable(itemID uint32) bool {
+	item, ok := c.items[itemID]
+	return ok && len(item.Recipe) > 0 && item.MachineID != 0
+}
+
+/* Get the time a machine takes to craft one of an item, from its recipe
+** duration in seconds */
+func (c *Catalog) CraftDuration(itemID uint32) time.Duration {
+	return time.Duration(c.items[itemID].Duration) * time.Second
+}
+
+/* Check an item is in the fuel list of a machine */
+func (c *Catalog) IsFuel(machineID, fuelID uint32) bool {
+	machine, ok := c.items[machineID]
+	if !ok {
+		return false
+	}
+	for i := 0; i < len(machine.Fuel); i++ {
+		if machine.Fuel[i].ItemID == fuelID {
+			return true
+		}
+	}
+	return false
+}
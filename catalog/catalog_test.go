@@ -0,0 +1,171 @@
+package catalog
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+)
+
+const TEST_SCHEMA string = "../progress/serve/item-schema-v2.json"
+const TEST_LIMITS string = "../progress/serve/item-limits.json"
+
+func TestLoadSchema(t *testing.T) {
+	c, err := Load(TEST_SCHEMA)
+	if err != nil {
+		t.Fatalf("Failed to load item schema: %s", err)
+	}
+	if len(c.Schema.Items) == 0 {
+		t.Errorf("Expected items in the item schema")
+	}
+
+	item, ok := c.Item(11)
+	if !ok || item.Name != "Furnace" {
+		t.Errorf("Expected item 11 to be the Furnace")
+	}
+	if c.IsValid(0) || c.IsValid(1000) {
+		t.Errorf("Expected out of range IDs to be invalid")
+	}
+}
+
+func TestLoadMissingSchema(t *testing.T) {
+	_, err := Load("missing-schema.json")
+	if err == nil {
+		t.Errorf("Expected an error loading a missing schema")
+	}
+}
+
+func TestLoadDuplicateItem(t *testing.T) {
+	file, err := ioutil.TempFile("", "item-schema")
+	if err != nil {
+		t.Fatalf("Failed to create schema file")
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`{"items":[{"item_id":1,"name":"Wood","type":1},` +
+		`{"item_id":1,"name":"Stone","type":1}]}`)
+	file.Close()
+
+	_, err = Load(file.Name())
+	if err == nil {
+		t.Errorf("Expected an error loading a schema with duplicate IDs")
+	}
+}
+
+/* Check item type rules: wood (1) is a primary resource, the furnace (11) a
+** placeable blueprint, steel (13) is crafted and electricity (32) is
+** intangible */
+func TestItemTypes(t *testing.T) {
+	c, err := Load(TEST_SCHEMA)
+	if err != nil {
+		t.Fatalf("Failed to load item schema: %s", err)
+	}
+
+	if !c.IsSpawnable(1) || c.IsSpawnable(13) || c.IsSpawnable(32) {
+		t.Errorf("Expected only primary resources to be spawnable")
+	}
+	if !c.IsStorable(1) || !c.IsStorable(13) || c.IsStorable(32) {
+		t.Errorf("Expected intangible items not to be storable")
+	}
+	if !c.IsBlueprint(11) || c.IsBlueprint(1) || c.IsBlueprint(13) {
+		t.Errorf("Expected only blueprint items to be blueprints")
+	}
+	if !c.IsCraftable(13) || c.IsCraftable(1) || c.IsCraftable(11) {
+		t.Errorf("Expected only machine recipes to be craftable")
+	}
+	if !c.IsPlaceable(11) || c.IsPlaceable(18) || c.IsPlaceable(1) {
+		t.Errorf("Expected only placeable blueprints to be placeable")
+	}
+}
+
+/* Check machine fuel lists and recipe durations: the furnace (11) burns wood
+** (1) or charcoal (12) and the welder (26) runs on electricity (32) */
+func TestMachines(t *testing.T) {
+	c, err := Load(TEST_SCHEMA)
+	if err != nil {
+		t.Fatalf("Failed to load item schema: %s", err)
+	}
+
+	if !c.IsFuel(11, 1) || !c.IsFuel(11, 12) || c.IsFuel(11, 32) {
+		t.Errorf("Expected the furnace to burn wood or charcoal")
+	}
+	if !c.IsFuel(26, 32) || c.IsFuel(26, 1) || c.IsFuel(1000, 1) {
+		t.Errorf("Expected the welder to run on electricity only")
+	}
+	if c.CraftDuration(12) <= 0 || c.CraftDuration(1) != 0 {
+		t.Errorf("Expected only machine recipes to have a duration")
+	}
+}
+
+func TestLoadLimits(t *testing.T) {
+	c, err := Load(TEST_SCHEMA)
+	if err != nil {
+		t.Fatalf("Failed to load item schema: %s", err)
+	}
+	err = c.LoadLimits(TEST_LIMITS)
+	if err != nil {
+		t.Fatalf("Failed to load item limits: %s", err)
+	}
+	if c.SlotCapacity() == 0 {
+		t.Errorf("Expected a slot capacity")
+	}
+	if c.MaxStack(1) == 0 || c.MaxStack(1) == math.MaxUint32 {
+		t.Errorf("Expected wood (1) to have a max stack")
+	}
+	if c.MaxGain(1) == 0 || c.GainPeriod() == 0 {
+		t.Errorf("Expected wood (1) to have a max gain")
+	}
+}
+
+/* Check a max gain is not accepted without a gain period */
+func TestLoadGainWithoutPeriod(t *testing.T) {
+	c, err := Load(TEST_SCHEMA)
+	if err != nil {
+		t.Fatalf("Failed to load item schema: %s", err)
+	}
+
+	file, err := ioutil.TempFile("", "item-limits")
+	if err != nil {
+		t.Fatalf("Failed to create limits file")
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`{"items":[{"item_id":1,"max_stack":10,"max_gain":5}]}`)
+	file.Close()
+
+	err = c.LoadLimits(file.Name())
+	if err == nil {
+		t.Errorf("Expected a max gain without a gain period to be rejected")
+	}
+}
+
+/* Check items are fitted up to their max stack and only while there are
+** free slots */
+func TestFit(t *testing.T) {
+	c, err := Load(TEST_SCHEMA)
+	if err != nil {
+		t.Fatalf("Failed to load item schema: %s", err)
+	}
+	c.Limits = ItemLimits{SlotCapacity: 2}
+	c.maxStacks = map[uint32]uint32{1: 10}
+
+	held := map[uint32]uint32{1: 4}
+	accepted, reason := c.Fit(held, 1, 8)
+	if accepted != 6 || reason != REASON_STACK_LIMIT || held[1] != 10 {
+		t.Errorf("Expected 6 wood to be accepted. Got %d", accepted)
+	}
+
+	// Stone (2) has no max stack, but takes the last slot
+	accepted, reason = c.Fit(held, 2, 100)
+	if accepted != 100 || reason != "" {
+		t.Errorf("Expected 100 stone to be accepted. Got %d", accepted)
+	}
+	accepted, reason = c.Fit(held, 3, 1)
+	if accepted != 0 || reason != REASON_NO_SLOT {
+		t.Errorf("Expected no clay to be accepted. Got %d", accepted)
+	}
+
+	// Unlimited items are still bound by the quantity column
+	accepted, _ = c.Fit(held, 2, math.MaxUint32)
+	if held[2] != math.MaxUint32 || accepted != math.MaxUint32-100 {
+		t.Errorf("Expected stone to be capped. Got %d", held[2])
+	}
+}
@@ -0,0 +1,135 @@
+package catalog
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"time"
+)
+
+/* Inventory limits, kept alongside the item schema. A slot capacity of zero
+** and items without a max stack are unlimited. Items with a max gain can only
+** be reported as gained by clients that many times in each gain period, in
+** seconds, and items without one are uncapped */
+type ItemLimits struct {
+	SlotCapacity uint32      `json:"slot_capacity"`
+	GainPeriod   uint32      `json:"gain_period"`
+	Items        []ItemLimit `json:"items"`
+}
+
+type ItemLimit struct {
+	ItemID   uint32 `json:"item_id"`
+	MaxStack uint32 `json:"max_stack"`
+	MaxGain  uint32 `json:"max_gain"`
+}
+
+/* An item which could not be fully added to an inventory */
+type Rejection struct {
+	ItemID    uint32 `json:"item_id"`
+	Requested uint64 `json:"requested"`
+	Accepted  uint32 `json:"accepted"`
+	Reason    string `json:"reason"`
+}
+
+// Path of the inventory limits relative to each service
+const ITEM_LIMITS string = "serve/item-limits.json"
+
+const REASON_STACK_LIMIT string = "Stack limit reached"
+const REASON_NO_SLOT string = "No free inventory slot"
+const REASON_GAIN_LIMIT string = "Gain limit reached"
+const REASON_UNTRUSTED string = "Item must be crafted, built or traded"
+
+/* Load inventory limits into the catalog, every limited item must exist in
+** the item schema */
+func (c *Catalog) LoadLimits(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var limits ItemLimits
+	decoder := json.NewDecoder(file)
+	err = decoder.Decode(&limits)
+	if err != nil {
+		return err
+	}
+
+	// Build max stack and max gain maps
+	maxStacks := make(map[uint32]uint32)
+	maxGains := make(map[uint32]uint32)
+	for i := 0; i < len(limits.Items); i++ {
+		if !c.IsStorable(limits.Items[i].ItemID) {
+			return errors.New("Item limits contain an invalid item ID")
+		}
+		if limits.Items[i].MaxStack == 0 {
+			return errors.New("Item limits contain an invalid max stack")
+		}
+		maxStacks[limits.Items[i].ItemID] = limits.Items[i].MaxStack
+		if limits.Items[i].MaxGain > 0 {
+			if limits.GainPeriod == 0 {
+				return errors.New("Item limits contain a max gain without a gain period")
+			}
+			maxGains[limits.Items[i].ItemID] = limits.Items[i].MaxGain
+		}
+	}
+
+	c.Limits = limits
+	c.maxStacks = maxStacks
+	c.maxGains = maxGains
+	return nil
+}
+
+/* Get the most of an item one inventory can hold, unlimited items are still
+** bound by the size of the quantity column */
+func (c *Catalog) MaxStack(itemID uint32) uint32 {
+	if maxStack, ok := c.maxStacks[itemID]; ok {
+		return maxStack
+	}
+	return math.MaxUint32
+}
+
+/* Get the most of an item a client can report as gained in each gain
+** period, zero is uncapped */
+func (c *Catalog) MaxGain(itemID uint32) uint32 {
+	return c.maxGains[itemID]
+}
+
+func (c *Catalog) GainPeriod() time.Duration {
+	return time.Duration(c.Limits.GainPeriod) * time.Second
+}
+
+/* Get the number of distinct items one inventory can hold, zero is
+** unlimited */
+func (c *Catalog) SlotCapacity() uint32 {
+	return c.Limits.SlotCapacity
+}
+
+/* Work out how much of an item fits into an inventory holding the given
+** quantities, returning the amount accepted and the reason for accepting less
+** than requested. The held quantities are updated with the accepted amount so
+** a list of items can be fitted in turn */
+func (c *Catalog) Fit(held map[uint32]uint32, itemID uint32,
+	quantity uint64) (uint32, string) {
+	current, ok := held[itemID]
+	if !ok && c.SlotCapacity() > 0 && uint32(len(held)) >= c.SlotCapacity() {
+		return 0, REASON_NO_SLOT
+	}
+
+	space := uint64(0)
+	if current < c.MaxStack(itemID) {
+		space = uint64(c.MaxStack(itemID) - current)
+	}
+	accepted := quantity
+	reason := ""
+	if accepted > space {
+		accepted = space
+		reason = REASON_STACK_LIMIT
+	}
+
+	if accepted > 0 {
+		held[itemID] = current + uint32(accepted)
+	}
+	return uint32(accepted), reason
+}
@@ -18,6 +18,7 @@ CREATE TABLE token (
     access_expire  BIGINT NOT NULL,
     refresh_expire BIGINT NOT NULL,
     FOREIGN KEY (user_id) REFERENCES account(user_id),
+    INDEX (refresh_expire),
     PRIMARY KEY (pair_id)
 );
 
@@ -34,9 +35,13 @@ CREATE TABLE resources (
     item_id  INT UNSIGNED NOT NULL,
     gcs_lat  DECIMAL(10,8) NOT NULL,
     gcs_long DECIMAL(11,8) NOT NULL,
+    grid_cell INT UNSIGNED NOT NULL,
     quantity INT UNSIGNED NOT NULL,
     resource_expire BIGINT NOT NULL,
-    PRIMARY KEY (spawn_id)
+    PRIMARY KEY (spawn_id),
+    INDEX (grid_cell),
+    INDEX (gcs_lat, gcs_long),
+    INDEX (resource_expire)
 );
 
 CREATE TABLE progress (
@@ -51,4 +56,205 @@ CREATE TABLE desktop (
     state TEXT NOT NULL,
     FOREIGN KEY (user_id) REFERENCES account(user_id),
     PRIMARY KEY (user_id)
-);
\ No newline at end of file
+);
+
+CREATE TABLE class (
+    class_id    INT UNSIGNED,
+    lecturer_id INT UNSIGNED NOT NULL,
+    name        VARCHAR(64) NOT NULL,
+    join_code   CHAR(8) NOT NULL,
+    FOREIGN KEY (lecturer_id) REFERENCES account(user_id),
+    UNIQUE (join_code),
+    PRIMARY KEY (class_id)
+);
+
+CREATE TABLE enrolment (
+    class_id INT UNSIGNED,
+    user_id  INT UNSIGNED,
+    FOREIGN KEY (class_id) REFERENCES class(class_id),
+    FOREIGN KEY (user_id) REFERENCES account(user_id),
+    PRIMARY KEY (class_id, user_id)
+);
+
+CREATE TABLE oidc_login (
+    state    CHAR(64),
+    verifier CHAR(64) NOT NULL,
+    nonce    CHAR(64) NOT NULL,
+    binding  CHAR(64) NOT NULL,
+    link_user_id INT UNSIGNED,
+    login_expire BIGINT NOT NULL,
+    FOREIGN KEY (link_user_id) REFERENCES account(user_id),
+    PRIMARY KEY (state)
+);
+
+CREATE TABLE oidc_identity (
+    issuer  VARCHAR(255) CHARACTER SET ascii,
+    subject VARCHAR(255) CHARACTER SET ascii,
+    user_id INT UNSIGNED NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES account(user_id),
+    PRIMARY KEY (issuer, subject)
+);
+
+CREATE TABLE trade (
+    trade_id     INT UNSIGNED,
+    sender_id    INT UNSIGNED NOT NULL,
+    recipient_id INT UNSIGNED NOT NULL,
+    status       VARCHAR(16) NOT NULL,
+    trade_expire BIGINT NOT NULL,
+    FOREIGN KEY (sender_id) REFERENCES account(user_id),
+    FOREIGN KEY (recipient_id) REFERENCES account(user_id),
+    INDEX (status, trade_expire),
+    PRIMARY KEY (trade_id)
+);
+
+CREATE TABLE trade_item (
+    trade_id INT UNSIGNED,
+    offered  BOOLEAN,
+    item_id  INT UNSIGNED,
+    quantity INT UNSIGNED NOT NULL,
+    FOREIGN KEY (trade_id) REFERENCES trade(trade_id),
+    PRIMARY KEY (trade_id, offered, item_id)
+);
+
+CREATE TABLE ledger (
+    entry_id   BIGINT UNSIGNED AUTO_INCREMENT,
+    user_id    INT UNSIGNED NOT NULL,
+    item_id    INT UNSIGNED NOT NULL,
+    delta      BIGINT NOT NULL,
+    reason     VARCHAR(16) NOT NULL,
+    source     VARCHAR(64) NOT NULL,
+    entry_time BIGINT NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES account(user_id),
+    INDEX (user_id, entry_id),
+    INDEX (user_id, item_id, entry_time),
+    PRIMARY KEY (entry_id)
+);
+
+CREATE TABLE idempotency (
+    service     VARCHAR(16),
+    user_id     INT UNSIGNED,
+    idem_key    VARCHAR(64) CHARACTER SET ascii COLLATE ascii_bin,
+    fingerprint CHAR(64) NOT NULL,
+    response_code SMALLINT NOT NULL,
+    committed   BOOLEAN NOT NULL,
+    response_headers TEXT,
+    response    MEDIUMBLOB,
+    idempotency_expire BIGINT NOT NULL,
+    INDEX (service, idempotency_expire),
+    PRIMARY KEY (service, user_id, idem_key)
+);
+
+CREATE TABLE inventory_version (
+    user_id INT UNSIGNED,
+    version BIGINT UNSIGNED NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES account(user_id),
+    PRIMARY KEY (user_id)
+);
+
+CREATE TABLE flag (
+    flag_id   BIGINT UNSIGNED AUTO_INCREMENT,
+    user_id   INT UNSIGNED NOT NULL,
+    item_id   INT UNSIGNED NOT NULL,
+    requested BIGINT UNSIGNED NOT NULL,
+    accepted  INT UNSIGNED NOT NULL,
+    reason    VARCHAR(64) NOT NULL,
+    source    VARCHAR(16) NOT NULL,
+    flag_time BIGINT NOT NULL,
+    reviewed  BOOLEAN NOT NULL DEFAULT FALSE,
+    FOREIGN KEY (user_id) REFERENCES account(user_id),
+    INDEX (reviewed, flag_id),
+    PRIMARY KEY (flag_id)
+);
+
+CREATE TABLE admin_action (
+    action_id   BIGINT UNSIGNED AUTO_INCREMENT,
+    admin_id    INT UNSIGNED NOT NULL,
+    user_id     INT UNSIGNED NOT NULL,
+    action      VARCHAR(8) NOT NULL,
+    reason      VARCHAR(255) NOT NULL,
+    action_time BIGINT NOT NULL,
+    FOREIGN KEY (admin_id) REFERENCES account(user_id),
+    FOREIGN KEY (user_id) REFERENCES account(user_id),
+    INDEX (user_id, action_id),
+    PRIMARY KEY (action_id)
+);
+
+CREATE TABLE job (
+    job_id      INT UNSIGNED,
+    user_id     INT UNSIGNED NOT NULL,
+    machine_id  INT UNSIGNED NOT NULL,
+    item_id     INT UNSIGNED NOT NULL,
+    count       INT UNSIGNED NOT NULL,
+    fuel_id     INT UNSIGNED NOT NULL,
+    status      VARCHAR(16) NOT NULL,
+    start_time  BIGINT NOT NULL,
+    finish_time BIGINT NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES account(user_id),
+    INDEX (user_id, machine_id, status),
+    PRIMARY KEY (job_id)
+);
+
+CREATE TABLE job_item (
+    job_id   INT UNSIGNED,
+    fuel     BOOLEAN,
+    item_id  INT UNSIGNED,
+    quantity INT UNSIGNED NOT NULL,
+    FOREIGN KEY (job_id) REFERENCES job(job_id),
+    PRIMARY KEY (job_id, fuel, item_id)
+);
+
+CREATE TABLE event (
+    event_id     BIGINT UNSIGNED AUTO_INCREMENT,
+    user_id      INT UNSIGNED NOT NULL,
+    event_type   VARCHAR(16) NOT NULL,
+    payload      TEXT NOT NULL,
+    version      BIGINT UNSIGNED NOT NULL,
+    event_time   BIGINT NOT NULL,
+    event_expire BIGINT NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES account(user_id),
+    INDEX (user_id, event_id),
+    INDEX (event_expire),
+    PRIMARY KEY (event_id)
+);
+
+CREATE TABLE exchange_rate (
+    from_item_id  INT UNSIGNED,
+    to_item_id    INT UNSIGNED,
+    from_quantity INT UNSIGNED NOT NULL,
+    to_quantity   INT UNSIGNED NOT NULL,
+    daily_limit   INT UNSIGNED NOT NULL,
+    PRIMARY KEY (from_item_id, to_item_id)
+);
+
+CREATE TABLE exchange (
+    exchange_id   BIGINT UNSIGNED AUTO_INCREMENT,
+    user_id       INT UNSIGNED NOT NULL,
+    from_item_id  INT UNSIGNED NOT NULL,
+    to_item_id    INT UNSIGNED NOT NULL,
+    count         INT UNSIGNED NOT NULL,
+    exchange_time BIGINT NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES account(user_id),
+    INDEX (user_id, exchange_time),
+    PRIMARY KEY (exchange_id)
+);
+
+CREATE TABLE gift (
+    gift_id      INT UNSIGNED,
+    sender_id    INT UNSIGNED NOT NULL,
+    recipient_id INT UNSIGNED NOT NULL,
+    message      VARCHAR(255) NOT NULL,
+    status       VARCHAR(16) NOT NULL,
+    gift_expire  BIGINT NOT NULL,
+    FOREIGN KEY (sender_id) REFERENCES account(user_id),
+    FOREIGN KEY (recipient_id) REFERENCES account(user_id),
+    INDEX (status, gift_expire),
+    PRIMARY KEY (gift_id)
+);
+
+CREATE TABLE gift_item (
+    gift_id  INT UNSIGNED,
+    item_id  INT UNSIGNED,
+    quantity INT UNSIGNED NOT NULL,
+    FOREIGN KEY (gift_id) REFERENCES gift(gift_id),
+    PRIMARY KEY (gift_id, item_id)
+);
\ No newline at end of file
@@ -0,0 +1,257 @@
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+/* Middleware making POST and DELETE requests with an Idempotency-Key header
+** safe to retry. The first response for each user and key is stored until it
+** expires, and later requests with the same key are given that response
+** without being applied again. Keys are kept apart for each service, and
+** requests without an access token are not tied to a user, so their keys are
+** ignored. Handlers commit their transactions with Commit, so a key is only
+** released for a retry if the request failed without changing anything */
+type Middleware struct {
+	DB      *sql.DB
+	Service string
+	TTL     time.Duration
+	// Get the ID of the user making the request from its access token
+	UserID func(r *http.Request) (uint32, error)
+}
+
+/* A key claimed by a user for a request */
+type claim struct {
+	Service string
+	UserID  uint32
+	Key     string
+	TTL     time.Duration
+}
+
+type contextKey int
+
+/* Captures the response to a request so it can be stored and replayed */
+type recorder struct {
+	http.ResponseWriter
+	code int
+	body bytes.Buffer
+}
+
+const HEADER string = "Idempotency-Key"
+const REPLAYED_HEADER string = "Idempotent-Replayed"
+const MAX_KEY int = 64
+const TTL time.Duration = 24 * time.Hour
+
+// Time a key is held for a request which has not responded or committed,
+// after which the request is taken to have failed and the key can be reused
+const CLAIM_TTL time.Duration = 5 * time.Minute
+
+const claimContextKey contextKey = 0
+
+// Response headers stored with the response and restored on replay
+var STORED_HEADERS = []string{"Content-Type", "ETag"}
+
+func (rec *recorder) WriteHeader(code int) {
+	rec.code = code
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	if rec.code == 0 {
+		rec.code = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+/* Check a key is printable ASCII and fits the key column */
+func checkValidKey(key string) bool {
+	if len(key) > MAX_KEY {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < ' ' || key[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+/* Get the stored headers of a response */
+func storedHeaders(header http.Header) map[string]string {
+	headers := make(map[string]string)
+	for i := 0; i < len(STORED_HEADERS); i++ {
+		if value := header.Get(STORED_HEADERS[i]); value != "" {
+			headers[STORED_HEADERS[i]] = value
+		}
+	}
+	return headers
+}
+
+/* Wrap a handler, to be registered with Router.Use */
+func (m *Middleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(HEADER)
+		if key == "" || r.Header.Get("Authorization") == "" ||
+			(r.Method != http.MethodPost && r.Method != http.MethodDelete) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !checkValidKey(key) {
+			respondWithError(w, http.StatusBadRequest, "Invalid idempotency key")
+			return
+		}
+
+		userID, err := m.UserID(r)
+		if err != nil {
+			// The handler rejects the request
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Fingerprint the request so a key cannot be reused for another one
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		hash := sha256.New()
+		hash.Write([]byte(r.Method + " " + r.URL.RequestURI() + "\n"))
+		hash.Write(body)
+		fingerprint := hex.EncodeToString(hash.Sum(nil))
+
+		// Claim the key, replacing any expired claim or response
+		now := time.Now()
+		_, err = m.DB.Exec("DELETE FROM idempotency WHERE service=? AND user_id=? AND idem_key=? AND idempotency_expire < ?",
+			m.Service, userID, key, now.UnixNano())
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		res, err := m.DB.Exec("INSERT IGNORE INTO idempotency (service, user_id, idem_key, fingerprint, response_code, committed, idempotency_expire) VALUES (?, ?, ?, ?, 0, FALSE, ?)",
+			m.Service, userID, key, fingerprint, now.Add(CLAIM_TTL).UnixNano())
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		claimed, err := res.RowsAffected()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if claimed == 0 {
+			m.replay(w, userID, key, fingerprint)
+			return
+		}
+
+		c := &claim{Service: m.Service, UserID: userID, Key: key, TTL: m.TTL}
+		rec := &recorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(
+			context.WithValue(r.Context(), claimContextKey, c)))
+		if rec.code == 0 {
+			rec.code = http.StatusOK
+		}
+
+		err = m.store(c, rec, w.Header())
+		if err != nil {
+			log.Printf("idempotency key %q not stored: %s", key, err)
+		}
+	})
+}
+
+/* Store the response for a claimed key. Server errors are not stored unless
+** the request committed a change, so the request can be retried */
+func (m *Middleware) store(c *claim, rec *recorder,
+	header http.Header) error {
+	if rec.code >= http.StatusInternalServerError {
+		res, err := m.DB.Exec("DELETE FROM idempotency WHERE service=? AND user_id=? AND idem_key=? AND committed=FALSE",
+			c.Service, c.UserID, c.Key)
+		if err != nil {
+			return err
+		}
+		released, err := res.RowsAffected()
+		if err != nil || released > 0 {
+			return err
+		}
+	}
+
+	headers, _ := json.Marshal(storedHeaders(header))
+	_, err := m.DB.Exec("UPDATE idempotency SET response_code=?, response_headers=?, response=?, idempotency_expire=? WHERE service=? AND user_id=? AND idem_key=?",
+		rec.code, headers, rec.body.Bytes(), time.Now().Add(c.TTL).UnixNano(),
+		c.Service, c.UserID, c.Key)
+	return err
+}
+
+/* Commit a handler's transaction, marking the key claimed for the request, if
+** any, as committed in the same transaction. A committed key is kept even if
+** the handler then fails, so a retry cannot apply the request twice */
+func Commit(tx *sql.Tx, r *http.Request) error {
+	c, ok := r.Context().Value(claimContextKey).(*claim)
+	if ok {
+		_, err := tx.Exec("UPDATE idempotency SET committed=TRUE, idempotency_expire=? WHERE service=? AND user_id=? AND idem_key=?",
+			time.Now().Add(c.TTL).UnixNano(), c.Service, c.UserID, c.Key)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+/* Respond with the stored response for a claimed key */
+func (m *Middleware) replay(w http.ResponseWriter, userID uint32, key,
+	fingerprint string) {
+	var stored struct {
+		Fingerprint string
+		Code        int
+		Headers     []byte
+		Response    []byte
+	}
+	stmt := "SELECT fingerprint, response_code, response_headers, response FROM idempotency WHERE service=? AND user_id=? AND idem_key=?"
+	err := m.DB.QueryRow(stmt, m.Service, userID, key).Scan(
+		&stored.Fingerprint, &stored.Code, &stored.Headers, &stored.Response)
+	if err != nil {
+		// The claim was released by a failed request in the meantime
+		respondWithError(w, http.StatusConflict,
+			"A request with this idempotency key is in progress")
+		return
+	}
+	if stored.Fingerprint != fingerprint {
+		respondWithError(w, http.StatusUnprocessableEntity,
+			"Idempotency key was used for a different request")
+		return
+	}
+	if stored.Code == 0 {
+		respondWithError(w, http.StatusConflict,
+			"A request with this idempotency key is in progress")
+		return
+	}
+
+	headers := make(map[string]string)
+	if len(stored.Headers) > 0 {
+		json.Unmarshal(stored.Headers, &headers)
+	}
+	for name, value := range headers {
+		w.Header().Set(name, value)
+	}
+	w.Header().Set(REPLAYED_HEADER, "true")
+	w.WriteHeader(stored.Code)
+	w.Write(stored.Response)
+}
+
+/* Respond with an error JSON, as the services do */
+func respondWithError(w http.ResponseWriter, code int, message string) {
+	response, _ := json.Marshal(map[string]string{"error": message})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+/* A change made to a user's inventory by a developer, recorded with the
+** reason given for it. Ledger entries for the change refer to the action */
+type AdminAction struct {
+	ActionID   uint64 `json:"action_id"`
+	AdminID    uint32 `json:"admin_id"`
+	UserID     uint32 `json:"user_id"`
+	Action     string `json:"action"`
+	Reason     string `json:"reason"`
+	ActionTime int64  `json:"action_time"`
+}
+
+const (
+	ADMIN_SET    = "set"
+	ADMIN_ADD    = "add"
+	ADMIN_REMOVE = "remove"
+)
+
+const MAX_ADMIN_REASON int = 255
+
+/* Insert the action, setting its ID */
+func (action *AdminAction) CreateAction(tx *sql.Tx) error {
+	action.ActionTime = time.Now().UnixNano()
+	stmt := "INSERT INTO admin_action (admin_id, user_id, action, reason, action_time) VALUES (?, ?, ?, ?, ?)"
+	res, err := tx.Exec(stmt, action.AdminID, action.UserID, action.Action,
+		action.Reason, action.ActionTime)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	action.ActionID = uint64(id)
+	return nil
+}
+
+/* The ledger source of inventory changes made by the action */
+func (action *AdminAction) Source() string {
+	return fmt.Sprintf("admin:%d", action.ActionID)
+}
@@ -5,36 +5,222 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"math/rand"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
+	"github.com/jaylees14/Manhattan-Server/catalog"
+	"github.com/jaylees14/Manhattan-Server/idempotency"
+	"github.com/jaylees14/Manhattan-Server/maintenance"
+	"github.com/jaylees14/Manhattan-Server/stock"
 )
 
 type App struct {
-	Router *mux.Router
-	DB     *sql.DB
+	Router      *mux.Router
+	DB          *sql.DB
+	Maintenance *maintenance.Job
+	Idempotency *idempotency.Middleware
 }
 
 type ID struct {
 	Value uint32
 }
 
+type Count struct {
+	Value int
+}
+
+type AccountType struct {
+	Value string
+}
+
+type Username struct {
+	Value string
+}
+
 type InventoryResponse struct {
 	Items []ItemResponse `json:"items"`
 }
 
 type ItemResponse struct {
-	ItemID   uint32 `json:"item_id"`
-	Quantity uint32 `json:"quantity"`
+	ItemID   uint32       `json:"item_id"`
+	Quantity uint32       `json:"quantity"`
+	Item     *ItemDetails `json:"item,omitempty"`
+}
+
+type AddRequest struct {
+	Items   []stock.Item `json:"items"`
+	Partial bool         `json:"partial"`
+}
+
+type AddResponse struct {
+	Accepted []ItemResponse      `json:"accepted"`
+	Rejected []catalog.Rejection `json:"rejected"`
+}
+
+type RejectionResponse struct {
+	Error    string              `json:"error"`
+	Rejected []catalog.Rejection `json:"rejected"`
+}
+
+type CraftRequest struct {
+	ItemID uint32 `json:"item_id"`
+	Count  uint32 `json:"count"`
+}
+
+type CraftResponse struct {
+	Crafted  ItemResponse   `json:"crafted"`
+	Consumed []ItemResponse `json:"consumed"`
+}
+
+type JobRequest struct {
+	ItemID uint32 `json:"item_id"`
+	Count  uint32 `json:"count"`
+	FuelID uint32 `json:"fuel_id"`
+}
+
+type JobsResponse struct {
+	Jobs []JobResponse `json:"jobs"`
+}
+
+type JobResponse struct {
+	JobID      uint32         `json:"job_id"`
+	MachineID  uint32         `json:"machine_id"`
+	ItemID     uint32         `json:"item_id"`
+	Count      uint32         `json:"count"`
+	FuelID     uint32         `json:"fuel_id"`
+	Status     string         `json:"status"`
+	StartTime  int64          `json:"start_time"`
+	FinishTime int64          `json:"finish_time"`
+	Inputs     []ItemResponse `json:"inputs"`
+	Fuel       []ItemResponse `json:"fuel"`
+}
+
+type ExchangeRequest struct {
+	FromItemID uint32 `json:"from_item_id"`
+	ToItemID   uint32 `json:"to_item_id"`
+	Count      uint32 `json:"count"`
+}
+
+type ExchangeResponse struct {
+	Given     ItemResponse `json:"given"`
+	Received  ItemResponse `json:"received"`
+	Remaining *uint64      `json:"remaining,omitempty"`
+}
+
+type ExchangeRatesResponse struct {
+	Rates []ExchangeRateResponse `json:"rates"`
+}
+
+type ExchangeRateResponse struct {
+	ExchangeRate
+	Remaining *uint64 `json:"remaining,omitempty"`
+}
+
+type ShortfallResponse struct {
+	Error      string            `json:"error"`
+	Shortfalls []stock.Shortfall `json:"shortfalls"`
+}
+
+type LedgerResponse struct {
+	Entries []LedgerEntry `json:"entries"`
+	Next    uint64        `json:"next"`
+}
+
+type AdminRequest struct {
+	Items  []stock.Item `json:"items"`
+	Reason string       `json:"reason"`
+}
+
+type AdminResponse struct {
+	ActionID uint64         `json:"action_id"`
+	Items    []ItemResponse `json:"items"`
+}
+
+type FlagsResponse struct {
+	Flags []Flag `json:"flags"`
+}
+
+type GiftRequest struct {
+	Username string       `json:"username"`
+	Items    []stock.Item `json:"items"`
+	Message  string       `json:"message"`
+}
+
+type GiftsResponse struct {
+	Gifts []GiftResponse `json:"gifts"`
+}
+
+type GiftResponse struct {
+	GiftID     uint32         `json:"gift_id"`
+	Sender     string         `json:"sender"`
+	Recipient  string         `json:"recipient"`
+	Message    string         `json:"message"`
+	Status     string         `json:"status"`
+	GiftExpire int64          `json:"gift_expire"`
+	Items      []ItemResponse `json:"items"`
+}
+
+type TradeRequest struct {
+	Username string       `json:"username"`
+	Offer    []stock.Item `json:"offer"`
+	Request  []stock.Item `json:"request"`
+}
+
+type TradesResponse struct {
+	Trades []TradeResponse `json:"trades"`
+}
+
+type TradeResponse struct {
+	TradeID     uint32         `json:"trade_id"`
+	Sender      string         `json:"sender"`
+	Recipient   string         `json:"recipient"`
+	Status      string         `json:"status"`
+	TradeExpire int64          `json:"trade_expire"`
+	Offer       []ItemResponse `json:"offer"`
+	Request     []ItemResponse `json:"request"`
 }
 
 const BEARER_PREFIX string = "Bearer "
-const MAX_ITEM_ID uint32 = 32
 
-/* Initialise database connection, mux router and routes */
+// Stored idempotency keys are kept apart from those of other services
+const IDEMPOTENCY_SERVICE string = "inventory"
+
+// Ledger page sizes
+const LEDGER_PAGE_SIZE int = 50
+const MAX_LEDGER_PAGE_SIZE int = 200
+const FLAG_PAGE_SIZE int = 50
+const MAX_FLAG_PAGE_SIZE int = 200
+
+// Trade and gift expiration in years, months, days
+var tradeExpire = [3]int{0, 0, 7}
+var giftExpire = [3]int{0, 0, 7}
+
+var itemCatalog *catalog.Catalog
+
+// Stale rows handled by the maintenance job
+var maintenanceTasks = []maintenance.PurgeTask{
+	{
+		Name: "idempotency",
+		Stmt: "DELETE FROM idempotency WHERE service='inventory' AND idempotency_expire < ? LIMIT ?",
+	},
+	{
+		Name: "trade",
+		Func: expireTrades,
+	},
+	{
+		Name: "gift",
+		Func: expireGifts,
+	},
+}
+
+/* Initialise database connection, maintenance job, mux router, routes, item
+** schema and inventory limits */
 func (a *App) Initialise(dbUser, dbPassword, dbHost, dbName string) error {
 	connectionString := fmt.Sprintf("%s:%s@tcp(%s)/%s", dbUser, dbPassword,
 		dbHost, dbName)
@@ -43,8 +229,33 @@ func (a *App) Initialise(dbUser, dbPassword, dbHost, dbName string) error {
 	if err != nil {
 		return err
 	}
+	a.Maintenance = &maintenance.Job{
+		DB:        a.DB,
+		LockName:  fmt.Sprintf("%s_inventory_maintenance", dbName),
+		BatchSize: maintenance.BATCH_SIZE,
+		Tasks:     maintenanceTasks,
+	}
+	a.Idempotency = &idempotency.Middleware{
+		DB:      a.DB,
+		Service: IDEMPOTENCY_SERVICE,
+		TTL:     idempotency.TTL,
+		UserID: func(r *http.Request) (uint32, error) {
+			return getIDFromToken(a.DB, r)
+		},
+	}
 	a.Router = mux.NewRouter()
+	a.Router.Use(a.Idempotency.Handler)
 	a.initialiseRoutes()
+
+	itemCatalog, err = catalog.Load(catalog.ITEM_SCHEMA)
+	if err != nil {
+		return err
+	}
+	err = itemCatalog.LoadLimits(catalog.ITEM_LIMITS)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -62,6 +273,60 @@ func (a *App) initialiseRoutes() {
 		a.addInventory).Methods(http.MethodPost)
 	a.Router.HandleFunc(fmt.Sprintf("%s/inventory", prefix),
 		a.removeInventory).Methods(http.MethodDelete)
+	a.Router.HandleFunc(fmt.Sprintf("%s/inventory/items", prefix),
+		a.removeItems).Methods(http.MethodDelete)
+	a.Router.HandleFunc(fmt.Sprintf("%s/inventory/craft", prefix),
+		a.craftItem).Methods(http.MethodPost)
+	a.Router.HandleFunc(fmt.Sprintf("%s/inventory/jobs", prefix),
+		a.getJobs).Methods(http.MethodGet)
+	a.Router.HandleFunc(fmt.Sprintf("%s/inventory/jobs", prefix),
+		a.startJob).Methods(http.MethodPost)
+	a.Router.HandleFunc(fmt.Sprintf("%s/inventory/jobs/{job_id:[0-9]+}/collect",
+		prefix), a.collectJob).Methods(http.MethodPost)
+	a.Router.HandleFunc(fmt.Sprintf("%s/inventory/jobs/{job_id:[0-9]+}/cancel",
+		prefix), a.cancelJob).Methods(http.MethodPost)
+	a.Router.HandleFunc(fmt.Sprintf("%s/inventory/exchange", prefix),
+		a.exchangeItems).Methods(http.MethodPost)
+	a.Router.HandleFunc(fmt.Sprintf("%s/inventory/exchange/rates", prefix),
+		a.getExchangeRates).Methods(http.MethodGet)
+	a.Router.HandleFunc(fmt.Sprintf("%s/inventory/exchange/rates", prefix),
+		a.setExchangeRate).Methods(http.MethodPut)
+	a.Router.HandleFunc(fmt.Sprintf("%s/inventory/exchange/rates/{from_item_id:[0-9]+}/{to_item_id:[0-9]+}",
+		prefix), a.deleteExchangeRate).Methods(http.MethodDelete)
+	a.Router.HandleFunc(fmt.Sprintf("%s/inventory/trades", prefix),
+		a.getTrades).Methods(http.MethodGet)
+	a.Router.HandleFunc(fmt.Sprintf("%s/inventory/trades", prefix),
+		a.createTrade).Methods(http.MethodPost)
+	a.Router.HandleFunc(fmt.Sprintf("%s/inventory/trades/{trade_id:[0-9]+}/accept",
+		prefix), a.acceptTrade).Methods(http.MethodPost)
+	a.Router.HandleFunc(fmt.Sprintf("%s/inventory/trades/{trade_id:[0-9]+}/reject",
+		prefix), a.rejectTrade).Methods(http.MethodPost)
+	a.Router.HandleFunc(fmt.Sprintf("%s/inventory/trades/{trade_id:[0-9]+}/cancel",
+		prefix), a.cancelTrade).Methods(http.MethodPost)
+	a.Router.HandleFunc(fmt.Sprintf("%s/inventory/gifts", prefix),
+		a.getGifts).Methods(http.MethodGet)
+	a.Router.HandleFunc(fmt.Sprintf("%s/inventory/gifts", prefix),
+		a.createGift).Methods(http.MethodPost)
+	a.Router.HandleFunc(fmt.Sprintf("%s/inventory/gifts/{gift_id:[0-9]+}/claim",
+		prefix), a.claimGift).Methods(http.MethodPost)
+	a.Router.HandleFunc(fmt.Sprintf("%s/inventory/ledger", prefix),
+		a.getLedger).Methods(http.MethodGet)
+	a.Router.HandleFunc(fmt.Sprintf("%s/inventory/ledger/{username}", prefix),
+		a.getUserLedger).Methods(http.MethodGet)
+	a.Router.HandleFunc(fmt.Sprintf("%s/inventory/admin/{username}", prefix),
+		a.getAdminInventory).Methods(http.MethodGet)
+	a.Router.HandleFunc(fmt.Sprintf("%s/inventory/admin/{username}", prefix),
+		a.setAdminInventory).Methods(http.MethodPut)
+	a.Router.HandleFunc(fmt.Sprintf("%s/inventory/admin/{username}", prefix),
+		a.addAdminInventory).Methods(http.MethodPost)
+	a.Router.HandleFunc(fmt.Sprintf("%s/inventory/admin/{username}/items",
+		prefix), a.removeAdminInventory).Methods(http.MethodDelete)
+	a.Router.HandleFunc(fmt.Sprintf("%s/inventory/flags", prefix),
+		a.getFlags).Methods(http.MethodGet)
+	a.Router.HandleFunc(fmt.Sprintf("%s/inventory/flags/{flag_id:[0-9]+}/review",
+		prefix), a.reviewFlag).Methods(http.MethodPost)
+	a.Router.HandleFunc(fmt.Sprintf("%s/inventory/maintenance", prefix),
+		a.getMaintenance).Methods(http.MethodGet)
 }
 
 /* Respond with a error JSON */
@@ -121,15 +386,59 @@ func getIDFromToken(db *sql.DB, r *http.Request) (uint32, error) {
 	return id.Value, nil
 }
 
+/* Get the user ID of a username, returning sql.ErrNoRows if there is no
+** such user */
+func getIDFromUsername(db *sql.DB, username string) (uint32, error) {
+	var id ID
+	stmt := "SELECT user_id FROM account WHERE username=?"
+	err := db.QueryRow(stmt, username).Scan(&id.Value)
+	return id.Value, err
+}
+
+/* Check user is a developer */
+func checkDeveloper(db *sql.DB, id uint32) error {
+	stmt := "SELECT account_type FROM account WHERE user_id=?"
+	var accType AccountType
+	err := db.QueryRow(stmt, id).Scan(&accType.Value)
+	if err != nil {
+		return errors.New("User not found")
+	}
+
+	if accType.Value != "developer" {
+		return errors.New("User must be a developer")
+	}
+	return nil
+}
+
+/* Generate a unique given target id in a given table */
+func generateID(db *sql.DB, table, targetID string) (uint32, error) {
+	seed := rand.NewSource(time.Now().UnixNano())
+	random := rand.New(seed)
+	stmt := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s=?", table, targetID)
+	var id uint32
+	idCount := Count{Value: 1}
+	for idCount.Value != 0 {
+		id = random.Uint32()
+		err := db.QueryRow(stmt, id).Scan(&idCount.Value)
+		if err != nil {
+			return id, err
+		}
+	}
+	return id, nil
+}
+
 /* Check sent item list is valid */
-func checkValidInventory(inv Inventory) error {
+func checkValidInventory(inv stock.Inventory) error {
 	if len(inv.Items) <= 0 {
 		return errors.New("Empty item list")
 	}
 	for i := 0; i < len(inv.Items); i++ {
-		if inv.Items[i].ItemID <= 0 || inv.Items[i].ItemID > MAX_ITEM_ID {
+		if !itemCatalog.IsValid(inv.Items[i].ItemID) {
 			return errors.New("Invalid item ID in list")
 		}
+		if !itemCatalog.IsStorable(inv.Items[i].ItemID) {
+			return errors.New("Item in list cannot be stored")
+		}
 		if inv.Items[i].Quantity <= 0 {
 			return errors.New("Invalid item quantity in list")
 		}
@@ -137,7 +446,17 @@ func checkValidInventory(inv Inventory) error {
 	return nil
 }
 
-/* Return user inventory */
+/* Check whether the user has built the blueprint for an item, within the
+** transaction consuming the items which need it */
+func checkBlueprintBuilt(tx *sql.Tx, id, itemID uint32) (bool, error) {
+	stmt := "SELECT COUNT(*) FROM progress WHERE user_id=? AND item_id=?"
+	var count Count
+	err := tx.QueryRow(stmt, id, itemID).Scan(&count.Value)
+	return count.Value > 0, err
+}
+
+/* Return user inventory, with its version as an ETag. The version and items
+** are read from the same snapshot so they always agree */
 func (a *App) getInventory(w http.ResponseWriter, r *http.Request) {
 	id, err := getIDFromToken(a.DB, r)
 	if err != nil {
@@ -145,39 +464,202 @@ func (a *App) getInventory(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	stmt := "SELECT item_id, quantity FROM inventory WHERE user_id=?"
-	rows, err := a.DB.Query(stmt, id)
+	a.respondWithInventory(w, r, id)
+}
+
+/* Respond with a user's inventory and its version as an ETag. The items can
+** be expanded, filtered and sorted with the URL parameters */
+func (a *App) respondWithInventory(w http.ResponseWriter, r *http.Request,
+	userID uint32) {
+	query, err := parseInventoryQuery(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tx, err := a.DB.Begin()
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	defer tx.Rollback()
 
-	// Convert result rows into inventory response structure
-	var invRes InventoryResponse
-	// Handle empty inventory case
-	invRes.Items = make([]ItemResponse, 0)
-	defer rows.Close()
-	for rows.Next() {
-		var itemRes ItemResponse
-		err = rows.Scan(&itemRes.ItemID, &itemRes.Quantity)
+	version, err := stock.GetVersion(tx, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	items, err := getInventoryItems(tx, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	invRes := InventoryResponse{Items: query.Apply(items)}
+
+	w.Header().Set("ETag", stock.FormatETag(version))
+	respondWithJSON(w, http.StatusOK, invRes)
+}
+
+/* Add collected item(s) to user inventory within the gain caps and inventory
+** limits. Unless a partial add is requested, nothing is added if any item is
+** not accepted. Gains breaking the caps are flagged for review */
+func (a *App) addInventory(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromToken(a.DB, r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	// Decode json body into add request struct
+	decoder := json.NewDecoder(r.Body)
+	var addReq AddRequest
+	err = decoder.Decode(&addReq)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid item list")
+		return
+	}
+	inv := stock.Inventory{Items: addReq.Items}
+
+	err = checkValidInventory(inv)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Add user ID to item(s)
+	for i := 0; i < len(inv.Items); i++ {
+		inv.Items[i].UserID = id
+	}
+
+	// Query database
+	tx, err := a.DB.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	if !stock.CheckIfMatch(w, r, tx, id) {
+		return
+	}
+
+	capped, flagged, err := inv.CapGains(tx, itemCatalog)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = stock.FlagRejections(a.DB, id, flagged, stock.FLAG_INVENTORY)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	accepted, rejections, err := capped.FitInventory(tx, itemCatalog)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	rejections = append(flagged, rejections...)
+	if len(rejections) > 0 && !addReq.Partial {
+		respondWithJSON(w, http.StatusConflict, RejectionResponse{
+			Error:    "Inventory limits exceeded",
+			Rejected: rejections,
+		})
+		return
+	}
+
+	if len(accepted.Items) > 0 {
+		err = accepted.AddInventory(tx)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		err = accepted.LogAdded(tx, stock.LEDGER_CLIENT_SYNC, "")
 		if err != nil {
 			respondWithError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		invRes.Items = append(invRes.Items, itemRes)
 	}
-	// Handle any errors encountered during iteration
-	err = rows.Err()
+
+	version, err := stock.GetVersion(tx, id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = idempotency.Commit(tx, r)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	w.Header().Set("ETag", stock.FormatETag(version))
 
-	respondWithJSON(w, http.StatusOK, invRes)
+	if !addReq.Partial {
+		respondWithEmptyJSON(w, http.StatusOK)
+		return
+	}
+	addRes := AddResponse{
+		Accepted: make([]ItemResponse, 0),
+		Rejected: rejections,
+	}
+	for i := 0; i < len(accepted.Items); i++ {
+		addRes.Accepted = append(addRes.Accepted, ItemResponse{
+			ItemID:   accepted.Items[i].ItemID,
+			Quantity: accepted.Items[i].Quantity,
+		})
+	}
+	respondWithJSON(w, http.StatusOK, addRes)
 }
 
-/* Add item(s) to user inventory */
-func (a *App) addInventory(w http.ResponseWriter, r *http.Request) {
+/* Remove all items from user inventory */
+func (a *App) removeInventory(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromToken(a.DB, r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	// Query database
+	tx, err := a.DB.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	if !stock.CheckIfMatch(w, r, tx, id) {
+		return
+	}
+
+	removed, err := clearInventory(tx, id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = removed.LogRemoved(tx, stock.LEDGER_CLIENT_SYNC, "")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	version, err := stock.GetVersion(tx, id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = idempotency.Commit(tx, r)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("ETag", stock.FormatETag(version))
+
+	respondWithEmptyJSON(w, http.StatusOK)
+}
+
+/* Remove quantities of item(s) from user inventory, removing nothing if the
+** user does not have enough of every item */
+func (a *App) removeItems(w http.ResponseWriter, r *http.Request) {
 	id, err := getIDFromToken(a.DB, r)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, err.Error())
@@ -186,7 +668,7 @@ func (a *App) addInventory(w http.ResponseWriter, r *http.Request) {
 
 	// Decode json body into inventory struct
 	decoder := json.NewDecoder(r.Body)
-	var inv Inventory
+	var inv stock.Inventory
 	err = decoder.Decode(&inv)
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, "Invalid item list")
@@ -205,29 +687,1900 @@ func (a *App) addInventory(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Query database
-	err = inv.AddInventory(a.DB)
+	tx, err := a.DB.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	if !stock.CheckIfMatch(w, r, tx, id) {
+		return
+	}
+
+	shortfalls, err := inv.RemoveInventory(tx)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(shortfalls) > 0 {
+		respondWithJSON(w, http.StatusConflict, ShortfallResponse{
+			Error:      "Insufficient items in inventory",
+			Shortfalls: shortfalls,
+		})
+		return
+	}
+	err = inv.LogRemoved(tx, stock.LEDGER_CLIENT_SYNC, "")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	version, err := stock.GetVersion(tx, id)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	err = idempotency.Commit(tx, r)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("ETag", stock.FormatETag(version))
 
 	respondWithEmptyJSON(w, http.StatusOK)
 }
 
-/* Remove all items from user inventory */
-func (a *App) removeInventory(w http.ResponseWriter, r *http.Request) {
+/* Craft an item on a machine, consuming the recipe inputs from user inventory
+** and adding the output in a single transaction */
+func (a *App) craftItem(w http.ResponseWriter, r *http.Request) {
 	id, err := getIDFromToken(a.DB, r)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, err.Error())
 		return
 	}
 
-	stmt := "DELETE FROM inventory WHERE user_id=?"
-	_, err = a.DB.Exec(stmt, id)
+	// Decode json body into craft request
+	decoder := json.NewDecoder(r.Body)
+	var craftReq CraftRequest
+	err = decoder.Decode(&craftReq)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid craft request")
+		return
+	}
+
+	// Check the item is crafted on a machine, scaling the recipe by the count
+	craft, err := stock.NewCraft(itemCatalog, id, craftReq.ItemID,
+		craftReq.Count)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	craftRes := CraftResponse{Consumed: make([]ItemResponse, 0)}
+	for i := 0; i < len(craft.Inputs.Items); i++ {
+		craftRes.Consumed = append(craftRes.Consumed, ItemResponse{
+			ItemID:   craft.Inputs.Items[i].ItemID,
+			Quantity: craft.Inputs.Items[i].Quantity,
+		})
+	}
+	craftRes.Crafted = ItemResponse{ItemID: craft.ItemID,
+		Quantity: craft.Count}
+
+	// Query database
+	tx, err := a.DB.Begin()
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	defer tx.Rollback()
 
-	respondWithEmptyJSON(w, http.StatusOK)
+	// Check the user has built the machine
+	built, err := checkBlueprintBuilt(tx, id, craft.MachineID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !built {
+		machine, _ := itemCatalog.Item(craft.MachineID)
+		respondWithError(w, http.StatusForbidden,
+			fmt.Sprintf("The %s blueprint has not been built", machine.Name))
+		return
+	}
+
+	if !stock.CheckIfMatch(w, r, tx, id) {
+		return
+	}
+
+	shortfalls, rejections, err := craft.Apply(tx, itemCatalog)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(shortfalls) > 0 {
+		respondWithJSON(w, http.StatusConflict, ShortfallResponse{
+			Error:      "Insufficient items in inventory",
+			Shortfalls: shortfalls,
+		})
+		return
+	}
+	if len(rejections) > 0 {
+		respondWithJSON(w, http.StatusConflict, RejectionResponse{
+			Error:    "Inventory limits exceeded",
+			Rejected: rejections,
+		})
+		return
+	}
+
+	version, err := stock.GetVersion(tx, id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = idempotency.Commit(tx, r)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("ETag", stock.FormatETag(version))
+
+	respondWithJSON(w, http.StatusOK, craftRes)
+}
+
+/* Build the response for a job */
+func jobResponse(job Job) JobResponse {
+	jobRes := JobResponse{
+		JobID:      job.JobID,
+		MachineID:  job.MachineID,
+		ItemID:     job.ItemID,
+		Count:      job.Count,
+		FuelID:     job.FuelID,
+		Status:     job.CurrentStatus(time.Now().UnixNano()),
+		StartTime:  job.StartTime,
+		FinishTime: job.FinishTime,
+		Inputs:     make([]ItemResponse, 0),
+		Fuel:       make([]ItemResponse, 0),
+	}
+	for i := 0; i < len(job.Inputs.Items); i++ {
+		jobRes.Inputs = append(jobRes.Inputs, ItemResponse{
+			ItemID:   job.Inputs.Items[i].ItemID,
+			Quantity: job.Inputs.Items[i].Quantity,
+		})
+	}
+	for i := 0; i < len(job.Fuel.Items); i++ {
+		jobRes.Fuel = append(jobRes.Fuel, ItemResponse{
+			ItemID:   job.Fuel.Items[i].ItemID,
+			Quantity: job.Fuel.Items[i].Quantity,
+		})
+	}
+	return jobRes
+}
+
+/* Start a job crafting an item on a built machine. The recipe inputs and one
+** fuel per item crafted are removed from user inventory, and the job
+** finishes after the recipe duration for each item. Electricity cannot be
+** held in an inventory, so machines running on it take no fuel */
+func (a *App) startJob(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromToken(a.DB, r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	// Decode json body into job request
+	decoder := json.NewDecoder(r.Body)
+	var jobReq JobRequest
+	err = decoder.Decode(&jobReq)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid job request")
+		return
+	}
+	if jobReq.Count <= 0 {
+		respondWithError(w, http.StatusBadRequest, "Invalid craft count")
+		return
+	}
+
+	// Check the item is crafted on a machine, burning the given fuel
+	item, ok := itemCatalog.Item(jobReq.ItemID)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Invalid item ID")
+		return
+	}
+	if !itemCatalog.IsCraftable(item.ItemID) {
+		respondWithError(w, http.StatusBadRequest,
+			"Item is not crafted on a machine")
+		return
+	}
+	machine, _ := itemCatalog.Item(item.MachineID)
+	if len(machine.Fuel) > 0 &&
+		!itemCatalog.IsFuel(machine.ItemID, jobReq.FuelID) {
+		respondWithError(w, http.StatusBadRequest,
+			fmt.Sprintf("Invalid fuel for the %s", machine.Name))
+		return
+	}
+	if len(machine.Fuel) == 0 && jobReq.FuelID != 0 {
+		respondWithError(w, http.StatusBadRequest,
+			fmt.Sprintf("The %s takes no fuel", machine.Name))
+		return
+	}
+	duration := uint64(item.Duration) * uint64(jobReq.Count)
+	if duration > uint64(MAX_JOB_DURATION/time.Second) {
+		respondWithError(w, http.StatusBadRequest, "Job would take too long")
+		return
+	}
+
+	// Scale the recipe by the count
+	job := Job{
+		UserID:    id,
+		MachineID: machine.ItemID,
+		ItemID:    item.ItemID,
+		Count:     jobReq.Count,
+		FuelID:    jobReq.FuelID,
+		StartTime: time.Now().UnixNano(),
+	}
+	job.FinishTime = job.StartTime + int64(duration)*int64(time.Second)
+	var recipe []stock.Item
+	for i := 0; i < len(item.Recipe); i++ {
+		quantity := uint64(item.Recipe[i].Quantity) * uint64(jobReq.Count)
+		if quantity > math.MaxUint32 {
+			respondWithError(w, http.StatusBadRequest, "Invalid craft count")
+			return
+		}
+		recipe = append(recipe, stock.Item{ItemID: item.Recipe[i].ItemID,
+			Quantity: uint32(quantity)})
+	}
+	job.Inputs, err = combineItems(recipe, id)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid craft count")
+		return
+	}
+	job.Fuel.Items = make([]stock.Item, 0)
+	if itemCatalog.IsStorable(job.FuelID) {
+		job.Fuel.Items = append(job.Fuel.Items, stock.Item{UserID: id,
+			ItemID: job.FuelID, Quantity: job.Count})
+	}
+
+	// Fuel may be one of the inputs, so both are removed together
+	consumed, err := combineItems(append(job.Inputs.Items,
+		job.Fuel.Items...), id)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid craft count")
+		return
+	}
+	job.JobID, err = generateID(a.DB, "job", "job_id")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Query database
+	tx, err := a.DB.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	// Check the user has built the machine
+	built, err := checkBlueprintBuilt(tx, id, machine.ItemID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !built {
+		respondWithError(w, http.StatusForbidden,
+			fmt.Sprintf("The %s blueprint has not been built", machine.Name))
+		return
+	}
+
+	if !stock.CheckIfMatch(w, r, tx, id) {
+		return
+	}
+
+	// Lock the inventory version so the machine is only started once
+	_, err = stock.LockVersion(tx, id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	busy, err := checkMachineBusy(tx, id, machine.ItemID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if busy {
+		respondWithError(w, http.StatusConflict,
+			fmt.Sprintf("The %s is already running a job", machine.Name))
+		return
+	}
+
+	shortfalls, err := consumed.RemoveInventory(tx)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(shortfalls) > 0 {
+		respondWithJSON(w, http.StatusConflict, ShortfallResponse{
+			Error:      "Insufficient items in inventory",
+			Shortfalls: shortfalls,
+		})
+		return
+	}
+	err = consumed.LogRemoved(tx, stock.LEDGER_CRAFTED, job.Source())
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	err = job.CreateJob(tx)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	version, err := stock.GetVersion(tx, id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = idempotency.Commit(tx, r)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("ETag", stock.FormatETag(version))
+
+	respondWithJSON(w, http.StatusOK, jobResponse(job))
+}
+
+/* Return the user's jobs, newest first, optionally filtered by status */
+func (a *App) getJobs(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromToken(a.DB, r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "", JOB_RUNNING, JOB_COMPLETE, JOB_COLLECTED, JOB_CANCELLED:
+	default:
+		respondWithError(w, http.StatusBadRequest, "Invalid job status")
+		return
+	}
+
+	stmt := "SELECT job_id, machine_id, item_id, count, fuel_id, status, start_time, finish_time FROM job WHERE user_id=? ORDER BY start_time DESC"
+	rows, err := a.DB.Query(stmt, id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+	var jobs []Job
+	for rows.Next() {
+		job := Job{UserID: id}
+		err = rows.Scan(&job.JobID, &job.MachineID, &job.ItemID, &job.Count,
+			&job.FuelID, &job.Status, &job.StartTime, &job.FinishTime)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		jobs = append(jobs, job)
+	}
+	// Handle any errors encountered during iteration
+	err = rows.Err()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	jobsRes := JobsResponse{Jobs: make([]JobResponse, 0)}
+	for i := 0; i < len(jobs); i++ {
+		err = jobs[i].GetJobItems(a.DB)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		jobRes := jobResponse(jobs[i])
+		if status == "" || jobRes.Status == status {
+			jobsRes.Jobs = append(jobsRes.Jobs, jobRes)
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, jobsRes)
+}
+
+/* Collect the output of a finished job into user inventory */
+func (a *App) collectJob(w http.ResponseWriter, r *http.Request) {
+	a.closeJob(w, r, JOB_COLLECTED)
+}
+
+/* Cancel an unfinished job, refunding its inputs and fuel */
+func (a *App) cancelJob(w http.ResponseWriter, r *http.Request) {
+	a.closeJob(w, r, JOB_CANCELLED)
+}
+
+/* Move a running job to its closing status, freeing the machine. Jobs can
+** only be collected once finished, and only cancelled before then */
+func (a *App) closeJob(w http.ResponseWriter, r *http.Request,
+	status string) {
+	id, err := getIDFromToken(a.DB, r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	jobID, err := strconv.ParseUint(mux.Vars(r)["job_id"], 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Job not found")
+		return
+	}
+
+	// Query database
+	tx, err := a.DB.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	if !stock.CheckIfMatch(w, r, tx, id) {
+		return
+	}
+
+	job := Job{JobID: uint32(jobID)}
+	err = job.LockJob(tx)
+	if err != nil && err != sql.ErrNoRows {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// Jobs of other players are not revealed
+	if err == sql.ErrNoRows || job.UserID != id {
+		respondWithError(w, http.StatusNotFound, "Job not found")
+		return
+	}
+	if job.Status != JOB_RUNNING {
+		respondWithError(w, http.StatusConflict, "Job is no longer running")
+		return
+	}
+	finished := job.CurrentStatus(time.Now().UnixNano()) == JOB_COMPLETE
+
+	if status == JOB_CANCELLED {
+		if finished {
+			respondWithError(w, http.StatusConflict,
+				"Job has finished and must be collected")
+			return
+		}
+		err = job.Refund(tx)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	} else {
+		if !finished {
+			respondWithError(w, http.StatusConflict, "Job has not finished")
+			return
+		}
+
+		// The output stays in the machine until there is room for it
+		output := job.Output()
+		_, rejections, err := output.FitInventory(tx, itemCatalog)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if len(rejections) > 0 {
+			respondWithJSON(w, http.StatusConflict, RejectionResponse{
+				Error:    "Inventory limits exceeded",
+				Rejected: rejections,
+			})
+			return
+		}
+		err = output.AddInventory(tx)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		err = output.LogAdded(tx, stock.LEDGER_CRAFTED, job.Source())
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		err = job.SetStatus(tx, JOB_COLLECTED)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	version, err := stock.GetVersion(tx, id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = idempotency.Commit(tx, r)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("ETag", stock.FormatETag(version))
+
+	respondWithJSON(w, http.StatusOK, jobResponse(job))
+}
+
+/* Return every exchange rate, with the exchanges the user has left today at
+** each limited rate */
+func (a *App) getExchangeRates(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromToken(a.DB, r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	rates, err := getRates(a.DB)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	since := exchangeDayStart(time.Now()).UnixNano()
+	exchanged, err := getExchanged(a.DB, id, since)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	ratesRes := ExchangeRatesResponse{
+		Rates: make([]ExchangeRateResponse, 0),
+	}
+	for i := 0; i < len(rates); i++ {
+		rateRes := ExchangeRateResponse{ExchangeRate: rates[i]}
+		if rates[i].DailyLimit > 0 {
+			key := fmt.Sprintf("%d:%d", rates[i].FromItemID, rates[i].ToItemID)
+			remaining := uint64(0)
+			if exchanged[key] < uint64(rates[i].DailyLimit) {
+				remaining = uint64(rates[i].DailyLimit) - exchanged[key]
+			}
+			rateRes.Remaining = &remaining
+		}
+		ratesRes.Rates = append(ratesRes.Rates, rateRes)
+	}
+
+	respondWithJSON(w, http.StatusOK, ratesRes)
+}
+
+/* Add or replace an exchange rate, from a developer account */
+func (a *App) setExchangeRate(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromToken(a.DB, r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	err = checkDeveloper(a.DB, id)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	// Decode json body into exchange rate struct
+	decoder := json.NewDecoder(r.Body)
+	var rate ExchangeRate
+	err = decoder.Decode(&rate)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid exchange rate")
+		return
+	}
+	err = checkValidRate(rate)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err = rate.SetRate(a.DB)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, rate)
+}
+
+/* Remove an exchange rate, from a developer account */
+func (a *App) deleteExchangeRate(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromToken(a.DB, r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	err = checkDeveloper(a.DB, id)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	vars := mux.Vars(r)
+	fromItemID, err := strconv.ParseUint(vars["from_item_id"], 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Exchange rate not found")
+		return
+	}
+	toItemID, err := strconv.ParseUint(vars["to_item_id"], 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Exchange rate not found")
+		return
+	}
+
+	stmt := "DELETE FROM exchange_rate WHERE from_item_id=? AND to_item_id=?"
+	res, err := a.DB.Exec(stmt, fromItemID, toItemID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if count == 0 {
+		respondWithError(w, http.StatusNotFound, "Exchange rate not found")
+		return
+	}
+
+	respondWithEmptyJSON(w, http.StatusOK)
+}
+
+/* Exchange items with the NPC market at a set rate, removing the given items
+** from user inventory and adding the received items in a single transaction */
+func (a *App) exchangeItems(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromToken(a.DB, r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	// Decode json body into exchange request
+	decoder := json.NewDecoder(r.Body)
+	var exchangeReq ExchangeRequest
+	err = decoder.Decode(&exchangeReq)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid exchange request")
+		return
+	}
+	if exchangeReq.Count <= 0 {
+		respondWithError(w, http.StatusBadRequest, "Invalid exchange count")
+		return
+	}
+
+	// Query database
+	tx, err := a.DB.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	if !stock.CheckIfMatch(w, r, tx, id) {
+		return
+	}
+
+	rate := ExchangeRate{FromItemID: exchangeReq.FromItemID,
+		ToItemID: exchangeReq.ToItemID}
+	err = rate.LockRate(tx)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Exchange rate not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	given := uint64(rate.FromQuantity) * uint64(exchangeReq.Count)
+	received := uint64(rate.ToQuantity) * uint64(exchangeReq.Count)
+	if given > math.MaxUint32 || received > math.MaxUint32 {
+		respondWithError(w, http.StatusBadRequest, "Invalid exchange count")
+		return
+	}
+
+	// Lock the inventory version so concurrent exchanges are counted in turn
+	_, err = stock.LockVersion(tx, id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var remaining *uint64
+	if rate.DailyLimit > 0 {
+		since := exchangeDayStart(time.Now()).UnixNano()
+		exchanged, err := rate.getExchangedSince(tx, id, since)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		left := uint64(0)
+		if exchanged < uint64(rate.DailyLimit) {
+			left = uint64(rate.DailyLimit) - exchanged
+		}
+		if uint64(exchangeReq.Count) > left {
+			respondWithError(w, http.StatusConflict, fmt.Sprintf(
+				"Daily exchange limit reached, %d exchanges left today", left))
+			return
+		}
+		left -= uint64(exchangeReq.Count)
+		remaining = &left
+	}
+
+	source, err := rate.LogExchange(tx, id, exchangeReq.Count)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	input := stock.Inventory{Items: []stock.Item{
+		{UserID: id, ItemID: rate.FromItemID, Quantity: uint32(given)},
+	}}
+	output := stock.Inventory{Items: []stock.Item{
+		{UserID: id, ItemID: rate.ToItemID, Quantity: uint32(received)},
+	}}
+
+	shortfalls, err := input.RemoveInventory(tx)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(shortfalls) > 0 {
+		respondWithJSON(w, http.StatusConflict, ShortfallResponse{
+			Error:      "Insufficient items in inventory",
+			Shortfalls: shortfalls,
+		})
+		return
+	}
+	err = input.LogRemoved(tx, stock.LEDGER_EXCHANGED, source)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// The received items must fit once the given items have been removed
+	_, rejections, err := output.FitInventory(tx, itemCatalog)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(rejections) > 0 {
+		respondWithJSON(w, http.StatusConflict, RejectionResponse{
+			Error:    "Inventory limits exceeded",
+			Rejected: rejections,
+		})
+		return
+	}
+	err = output.AddInventory(tx)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = output.LogAdded(tx, stock.LEDGER_EXCHANGED, source)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	version, err := stock.GetVersion(tx, id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = idempotency.Commit(tx, r)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("ETag", stock.FormatETag(version))
+
+	respondWithJSON(w, http.StatusOK, ExchangeResponse{
+		Given:     ItemResponse{ItemID: rate.FromItemID, Quantity: uint32(given)},
+		Received:  ItemResponse{ItemID: rate.ToItemID, Quantity: uint32(received)},
+		Remaining: remaining,
+	})
+}
+
+/* Build the response for a trade, looking up the usernames of both players */
+func tradeResponse(db *sql.DB, trade Trade) (TradeResponse, error) {
+	tradeRes := TradeResponse{
+		TradeID:     trade.TradeID,
+		Status:      trade.Status,
+		TradeExpire: trade.TradeExpire,
+		Offer:       make([]ItemResponse, 0),
+		Request:     make([]ItemResponse, 0),
+	}
+	// Pending trades are only marked expired once the maintenance job runs
+	if trade.Status == TRADE_PENDING &&
+		trade.TradeExpire < time.Now().UnixNano() {
+		tradeRes.Status = TRADE_EXPIRED
+	}
+	for i := 0; i < len(trade.Offer.Items); i++ {
+		tradeRes.Offer = append(tradeRes.Offer, ItemResponse{
+			ItemID:   trade.Offer.Items[i].ItemID,
+			Quantity: trade.Offer.Items[i].Quantity,
+		})
+	}
+	for i := 0; i < len(trade.Request.Items); i++ {
+		tradeRes.Request = append(tradeRes.Request, ItemResponse{
+			ItemID:   trade.Request.Items[i].ItemID,
+			Quantity: trade.Request.Items[i].Quantity,
+		})
+	}
+
+	stmt := "SELECT username FROM account WHERE user_id=?"
+	var username Username
+	err := db.QueryRow(stmt, trade.SenderID).Scan(&username.Value)
+	if err != nil {
+		return tradeRes, err
+	}
+	tradeRes.Sender = username.Value
+	err = db.QueryRow(stmt, trade.RecipientID).Scan(&username.Value)
+	if err != nil {
+		return tradeRes, err
+	}
+	tradeRes.Recipient = username.Value
+	return tradeRes, nil
+}
+
+/* Combine repeated item IDs in an item list for a trade, gift or job, so
+** each item is stored once */
+func combineItems(items []stock.Item,
+	userID uint32) (stock.Inventory, error) {
+	var inv stock.Inventory
+	index := make(map[uint32]int)
+	for i := 0; i < len(items); i++ {
+		j, ok := index[items[i].ItemID]
+		if !ok {
+			index[items[i].ItemID] = len(inv.Items)
+			inv.Items = append(inv.Items, stock.Item{
+				UserID:   userID,
+				ItemID:   items[i].ItemID,
+				Quantity: items[i].Quantity,
+			})
+			continue
+		}
+		quantity := uint64(inv.Items[j].Quantity) + uint64(items[i].Quantity)
+		if quantity > math.MaxUint32 {
+			return inv, errors.New("Invalid item quantity in list")
+		}
+		inv.Items[j].Quantity = uint32(quantity)
+	}
+	return inv, nil
+}
+
+/* Offer items to another player in exchange for items of theirs. The offered
+** items are removed from user inventory and held in escrow until the trade
+** is closed */
+func (a *App) createTrade(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromToken(a.DB, r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	// Decode json body into trade request struct
+	decoder := json.NewDecoder(r.Body)
+	var tradeReq TradeRequest
+	err = decoder.Decode(&tradeReq)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid trade request")
+		return
+	}
+
+	// Check both item lists
+	for _, items := range [][]stock.Item{tradeReq.Offer, tradeReq.Request} {
+		err = checkValidInventory(stock.Inventory{Items: items})
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	// Find the recipient
+	var trade Trade
+	stmt := "SELECT user_id FROM account WHERE username=?"
+	err = a.DB.QueryRow(stmt, tradeReq.Username).Scan(&trade.RecipientID)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Recipient not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if trade.RecipientID == id {
+		respondWithError(w, http.StatusBadRequest, "Cannot trade with yourself")
+		return
+	}
+
+	trade.SenderID = id
+	trade.TradeExpire = time.Now().AddDate(tradeExpire[0], tradeExpire[1],
+		tradeExpire[2]).UnixNano()
+	trade.Offer, err = combineItems(tradeReq.Offer, trade.SenderID)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	trade.Request, err = combineItems(tradeReq.Request, trade.RecipientID)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	trade.TradeID, err = generateID(a.DB, "trade", "trade_id")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Query database
+	tx, err := a.DB.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	if !stock.CheckIfMatch(w, r, tx, id) {
+		return
+	}
+
+	shortfalls, err := trade.Offer.RemoveInventory(tx)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(shortfalls) > 0 {
+		respondWithJSON(w, http.StatusConflict, ShortfallResponse{
+			Error:      "Insufficient items in inventory",
+			Shortfalls: shortfalls,
+		})
+		return
+	}
+	err = trade.Offer.LogRemoved(tx, stock.LEDGER_TRADED, trade.Source())
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	err = trade.CreateTrade(tx)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	version, err := stock.GetVersion(tx, id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = idempotency.Commit(tx, r)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("ETag", stock.FormatETag(version))
+
+	tradeRes, err := tradeResponse(a.DB, trade)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, tradeRes)
+}
+
+/* Return trades sent or received by the user, newest first, optionally
+** filtered by status */
+func (a *App) getTrades(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromToken(a.DB, r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "", TRADE_PENDING, TRADE_ACCEPTED, TRADE_REJECTED, TRADE_CANCELLED,
+		TRADE_EXPIRED:
+	default:
+		respondWithError(w, http.StatusBadRequest, "Invalid trade status")
+		return
+	}
+
+	stmt := "SELECT trade_id, sender_id, recipient_id, status, trade_expire FROM trade WHERE sender_id=? OR recipient_id=? ORDER BY trade_expire DESC"
+	rows, err := a.DB.Query(stmt, id, id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+	var trades []Trade
+	for rows.Next() {
+		var trade Trade
+		err = rows.Scan(&trade.TradeID, &trade.SenderID, &trade.RecipientID,
+			&trade.Status, &trade.TradeExpire)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		trades = append(trades, trade)
+	}
+	// Handle any errors encountered during iteration
+	err = rows.Err()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	tradesRes := TradesResponse{Trades: make([]TradeResponse, 0)}
+	for i := 0; i < len(trades); i++ {
+		err = trades[i].GetTradeItems(a.DB)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		tradeRes, err := tradeResponse(a.DB, trades[i])
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if status == "" || tradeRes.Status == status {
+			tradesRes.Trades = append(tradesRes.Trades, tradeRes)
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, tradesRes)
+}
+
+/* Accept a trade sent to the user, swapping the escrowed items for the
+** requested items in a single transaction */
+func (a *App) acceptTrade(w http.ResponseWriter, r *http.Request) {
+	a.closeTrade(w, r, TRADE_ACCEPTED)
+}
+
+/* Reject a trade sent to the user, returning the escrowed items */
+func (a *App) rejectTrade(w http.ResponseWriter, r *http.Request) {
+	a.closeTrade(w, r, TRADE_REJECTED)
+}
+
+/* Cancel a trade sent by the user, returning the escrowed items */
+func (a *App) cancelTrade(w http.ResponseWriter, r *http.Request) {
+	a.closeTrade(w, r, TRADE_CANCELLED)
+}
+
+/* Move a pending trade to its closing status. Only the recipient may accept
+** or reject a trade, and only the sender may cancel it */
+func (a *App) closeTrade(w http.ResponseWriter, r *http.Request,
+	status string) {
+	id, err := getIDFromToken(a.DB, r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	tradeID, err := strconv.ParseUint(mux.Vars(r)["trade_id"], 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Trade not found")
+		return
+	}
+
+	// Query database
+	tx, err := a.DB.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	if !stock.CheckIfMatch(w, r, tx, id) {
+		return
+	}
+
+	trade := Trade{TradeID: uint32(tradeID)}
+	err = trade.LockTrade(tx)
+	if err != nil && err != sql.ErrNoRows {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// Trades of other players are not revealed
+	owner := trade.RecipientID
+	if status == TRADE_CANCELLED {
+		owner = trade.SenderID
+	}
+	if err == sql.ErrNoRows || owner != id {
+		respondWithError(w, http.StatusNotFound, "Trade not found")
+		return
+	}
+	if trade.Status != TRADE_PENDING {
+		respondWithError(w, http.StatusConflict, "Trade is no longer pending")
+		return
+	}
+
+	if status != TRADE_ACCEPTED {
+		err = trade.ReturnEscrow(tx, status)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	} else {
+		if trade.TradeExpire < time.Now().UnixNano() {
+			respondWithError(w, http.StatusGone, "Trade has expired")
+			return
+		}
+
+		// Take the requested items from the recipient
+		shortfalls, err := trade.Request.RemoveInventory(tx)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if len(shortfalls) > 0 {
+			respondWithJSON(w, http.StatusConflict, ShortfallResponse{
+				Error:      "Insufficient items in inventory",
+				Shortfalls: shortfalls,
+			})
+			return
+		}
+		err = trade.Request.LogRemoved(tx, stock.LEDGER_TRADED, trade.Source())
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		// Both players must have room for what they receive
+		received := trade.Offer.ForUser(trade.RecipientID)
+		paid := trade.Request.ForUser(trade.SenderID)
+		_, rejections, err := received.FitInventory(tx, itemCatalog)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if len(rejections) > 0 {
+			respondWithJSON(w, http.StatusConflict, RejectionResponse{
+				Error:    "Inventory limits exceeded",
+				Rejected: rejections,
+			})
+			return
+		}
+		_, rejections, err = paid.FitInventory(tx, itemCatalog)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if len(rejections) > 0 {
+			respondWithJSON(w, http.StatusConflict, RejectionResponse{
+				Error:    "Sender inventory limits exceeded",
+				Rejected: rejections,
+			})
+			return
+		}
+
+		for _, inv := range []stock.Inventory{received, paid} {
+			err = inv.AddInventory(tx)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			err = inv.LogAdded(tx, stock.LEDGER_TRADED, trade.Source())
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+		err = trade.SetStatus(tx, TRADE_ACCEPTED)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	version, err := stock.GetVersion(tx, id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = idempotency.Commit(tx, r)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("ETag", stock.FormatETag(version))
+
+	tradeRes, err := tradeResponse(a.DB, trade)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, tradeRes)
+}
+
+/* Build the response for a gift, looking up the usernames of both players */
+func giftResponse(db *sql.DB, gift Gift) (GiftResponse, error) {
+	giftRes := GiftResponse{
+		GiftID:     gift.GiftID,
+		Message:    gift.Message,
+		Status:     gift.Status,
+		GiftExpire: gift.GiftExpire,
+		Items:      make([]ItemResponse, 0),
+	}
+	// Pending gifts are only marked expired once the maintenance job runs
+	if gift.Status == GIFT_PENDING && gift.GiftExpire < time.Now().UnixNano() {
+		giftRes.Status = GIFT_EXPIRED
+	}
+	for i := 0; i < len(gift.Items.Items); i++ {
+		giftRes.Items = append(giftRes.Items, ItemResponse{
+			ItemID:   gift.Items.Items[i].ItemID,
+			Quantity: gift.Items.Items[i].Quantity,
+		})
+	}
+
+	stmt := "SELECT username FROM account WHERE user_id=?"
+	var username Username
+	err := db.QueryRow(stmt, gift.SenderID).Scan(&username.Value)
+	if err != nil {
+		return giftRes, err
+	}
+	giftRes.Sender = username.Value
+	err = db.QueryRow(stmt, gift.RecipientID).Scan(&username.Value)
+	if err != nil {
+		return giftRes, err
+	}
+	giftRes.Recipient = username.Value
+	return giftRes, nil
+}
+
+/* Send items to another player with a message. The items are removed from
+** user inventory and held in escrow until the gift is claimed or expires */
+func (a *App) createGift(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromToken(a.DB, r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	// Decode json body into gift request struct
+	decoder := json.NewDecoder(r.Body)
+	var giftReq GiftRequest
+	err = decoder.Decode(&giftReq)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid gift request")
+		return
+	}
+	err = checkValidInventory(stock.Inventory{Items: giftReq.Items})
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	giftReq.Message = strings.TrimSpace(giftReq.Message)
+	if len(giftReq.Message) > MAX_GIFT_MESSAGE {
+		respondWithError(w, http.StatusBadRequest,
+			fmt.Sprintf("Gift messages are at most %d characters",
+				MAX_GIFT_MESSAGE))
+		return
+	}
+
+	// Find the recipient
+	gift := Gift{SenderID: id, Message: giftReq.Message}
+	gift.RecipientID, err = getIDFromUsername(a.DB, giftReq.Username)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Recipient not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if gift.RecipientID == id {
+		respondWithError(w, http.StatusBadRequest, "Cannot gift to yourself")
+		return
+	}
+
+	gift.GiftExpire = time.Now().AddDate(giftExpire[0], giftExpire[1],
+		giftExpire[2]).UnixNano()
+	gift.Items, err = combineItems(giftReq.Items, gift.SenderID)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	gift.GiftID, err = generateID(a.DB, "gift", "gift_id")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Query database
+	tx, err := a.DB.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	if !stock.CheckIfMatch(w, r, tx, id) {
+		return
+	}
+
+	shortfalls, err := gift.Items.RemoveInventory(tx)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(shortfalls) > 0 {
+		respondWithJSON(w, http.StatusConflict, ShortfallResponse{
+			Error:      "Insufficient items in inventory",
+			Shortfalls: shortfalls,
+		})
+		return
+	}
+	err = gift.Items.LogRemoved(tx, stock.LEDGER_GIFTED, gift.Source())
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	err = gift.CreateGift(tx)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	version, err := stock.GetVersion(tx, id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = idempotency.Commit(tx, r)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("ETag", stock.FormatETag(version))
+
+	giftRes, err := giftResponse(a.DB, gift)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, giftRes)
+}
+
+/* Return gifts sent or received by the user, newest first, optionally
+** filtered by status */
+func (a *App) getGifts(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromToken(a.DB, r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "", GIFT_PENDING, GIFT_CLAIMED, GIFT_EXPIRED:
+	default:
+		respondWithError(w, http.StatusBadRequest, "Invalid gift status")
+		return
+	}
+
+	stmt := "SELECT gift_id, sender_id, recipient_id, message, status, gift_expire FROM gift WHERE sender_id=? OR recipient_id=? ORDER BY gift_expire DESC"
+	rows, err := a.DB.Query(stmt, id, id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+	var gifts []Gift
+	for rows.Next() {
+		var gift Gift
+		err = rows.Scan(&gift.GiftID, &gift.SenderID, &gift.RecipientID,
+			&gift.Message, &gift.Status, &gift.GiftExpire)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		gifts = append(gifts, gift)
+	}
+	// Handle any errors encountered during iteration
+	err = rows.Err()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	giftsRes := GiftsResponse{Gifts: make([]GiftResponse, 0)}
+	for i := 0; i < len(gifts); i++ {
+		err = gifts[i].GetGiftItems(a.DB)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		giftRes, err := giftResponse(a.DB, gifts[i])
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if status == "" || giftRes.Status == status {
+			giftsRes.Gifts = append(giftsRes.Gifts, giftRes)
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, giftsRes)
+}
+
+/* Claim a pending gift sent to the user, moving the escrowed items into
+** their inventory within its limits */
+func (a *App) claimGift(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromToken(a.DB, r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	giftID, err := strconv.ParseUint(mux.Vars(r)["gift_id"], 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Gift not found")
+		return
+	}
+
+	// Query database
+	tx, err := a.DB.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	if !stock.CheckIfMatch(w, r, tx, id) {
+		return
+	}
+
+	gift := Gift{GiftID: uint32(giftID)}
+	err = gift.LockGift(tx)
+	if err != nil && err != sql.ErrNoRows {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// Gifts to other players are not revealed
+	if err == sql.ErrNoRows || gift.RecipientID != id {
+		respondWithError(w, http.StatusNotFound, "Gift not found")
+		return
+	}
+	if gift.Status != GIFT_PENDING {
+		respondWithError(w, http.StatusConflict, "Gift is no longer pending")
+		return
+	}
+	if gift.GiftExpire < time.Now().UnixNano() {
+		respondWithError(w, http.StatusGone, "Gift has expired")
+		return
+	}
+
+	received := gift.Items.ForUser(id)
+	_, rejections, err := received.FitInventory(tx, itemCatalog)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(rejections) > 0 {
+		respondWithJSON(w, http.StatusConflict, RejectionResponse{
+			Error:    "Inventory limits exceeded",
+			Rejected: rejections,
+		})
+		return
+	}
+	err = received.AddInventory(tx)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = received.LogAdded(tx, stock.LEDGER_GIFTED, gift.Source())
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = gift.SetStatus(tx, GIFT_CLAIMED)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	version, err := stock.GetVersion(tx, id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = idempotency.Commit(tx, r)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("ETag", stock.FormatETag(version))
+
+	giftRes, err := giftResponse(a.DB, gift)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, giftRes)
+}
+
+/* Return a page of the user's inventory ledger */
+func (a *App) getLedger(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromToken(a.DB, r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	a.respondWithLedger(w, r, id)
+}
+
+/* Validate auth token, check user is developer and return a page of the
+** given user's inventory ledger */
+func (a *App) getUserLedger(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromToken(a.DB, r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	err = checkDeveloper(a.DB, id)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	userID, err := getIDFromUsername(a.DB, mux.Vars(r)["username"])
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "User not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	a.respondWithLedger(w, r, userID)
+}
+
+/* Respond with a page of a user's ledger. The page starts before the entry
+** ID given by the before parameter, and the next page starts before the last
+** entry returned */
+func (a *App) respondWithLedger(w http.ResponseWriter, r *http.Request,
+	userID uint32) {
+	limit := LEDGER_PAGE_SIZE
+	if param := r.URL.Query().Get("limit"); param != "" {
+		value, err := strconv.Atoi(param)
+		if err != nil || value <= 0 {
+			respondWithError(w, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+		limit = value
+		if limit > MAX_LEDGER_PAGE_SIZE {
+			limit = MAX_LEDGER_PAGE_SIZE
+		}
+	}
+	var before uint64
+	if param := r.URL.Query().Get("before"); param != "" {
+		value, err := strconv.ParseUint(param, 10, 63)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid before entry ID")
+			return
+		}
+		before = value
+	}
+
+	entries, err := getLedger(a.DB, userID, before, limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	ledgerRes := LedgerResponse{Entries: entries}
+	if len(entries) == limit {
+		ledgerRes.Next = entries[len(entries)-1].EntryID
+	}
+	respondWithJSON(w, http.StatusOK, ledgerRes)
+}
+
+/* Validate auth token, check user is developer and return the inventory of
+** any user */
+func (a *App) getAdminInventory(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromToken(a.DB, r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	err = checkDeveloper(a.DB, id)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	userID, err := getIDFromUsername(a.DB, mux.Vars(r)["username"])
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "User not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	a.respondWithInventory(w, r, userID)
+}
+
+func (a *App) setAdminInventory(w http.ResponseWriter, r *http.Request) {
+	a.adminChange(w, r, ADMIN_SET)
+}
+
+func (a *App) addAdminInventory(w http.ResponseWriter, r *http.Request) {
+	a.adminChange(w, r, ADMIN_ADD)
+}
+
+func (a *App) removeAdminInventory(w http.ResponseWriter, r *http.Request) {
+	a.adminChange(w, r, ADMIN_REMOVE)
+}
+
+/* Validate auth token, check user is developer and change the inventory of
+** any user, recording the reason given. Setting replaces the whole
+** inventory, while adding and removing change the listed items. The
+** inventory limits still apply, but the gain caps do not */
+func (a *App) adminChange(w http.ResponseWriter, r *http.Request,
+	action string) {
+	id, err := getIDFromToken(a.DB, r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	err = checkDeveloper(a.DB, id)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	userID, err := getIDFromUsername(a.DB, mux.Vars(r)["username"])
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "User not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Decode json body into admin request struct
+	decoder := json.NewDecoder(r.Body)
+	var adminReq AdminRequest
+	err = decoder.Decode(&adminReq)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid admin request")
+		return
+	}
+	adminReq.Reason = strings.TrimSpace(adminReq.Reason)
+	if len(adminReq.Reason) == 0 || len(adminReq.Reason) > MAX_ADMIN_REASON {
+		respondWithError(w, http.StatusBadRequest,
+			fmt.Sprintf("A reason between 1 and %d characters is required",
+				MAX_ADMIN_REASON))
+		return
+	}
+
+	// An empty list sets an empty inventory
+	inv := stock.Inventory{Items: adminReq.Items}
+	if action != ADMIN_SET || len(inv.Items) > 0 {
+		err = checkValidInventory(inv)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	// Add user ID to item(s)
+	for i := 0; i < len(inv.Items); i++ {
+		inv.Items[i].UserID = userID
+	}
+
+	// Query database
+	tx, err := a.DB.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	if !stock.CheckIfMatch(w, r, tx, userID) {
+		return
+	}
+
+	adminAction := AdminAction{AdminID: id, UserID: userID, Action: action,
+		Reason: adminReq.Reason}
+	err = adminAction.CreateAction(tx)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	source := adminAction.Source()
+
+	if action == ADMIN_SET {
+		removed, err := clearInventory(tx, userID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		err = removed.LogRemoved(tx, stock.LEDGER_ADMIN, source)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	if action == ADMIN_REMOVE {
+		shortfalls, err := inv.RemoveInventory(tx)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if len(shortfalls) > 0 {
+			respondWithJSON(w, http.StatusConflict, ShortfallResponse{
+				Error:      "Insufficient items in inventory",
+				Shortfalls: shortfalls,
+			})
+			return
+		}
+		err = inv.LogRemoved(tx, stock.LEDGER_ADMIN, source)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	} else if len(inv.Items) > 0 {
+		accepted, rejections, err := inv.FitInventory(tx, itemCatalog)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if len(rejections) > 0 {
+			respondWithJSON(w, http.StatusConflict, RejectionResponse{
+				Error:    "Inventory limits exceeded",
+				Rejected: rejections,
+			})
+			return
+		}
+		err = accepted.AddInventory(tx)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		err = accepted.LogAdded(tx, stock.LEDGER_ADMIN, source)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	adminRes := AdminResponse{ActionID: adminAction.ActionID}
+	adminRes.Items, err = getInventoryItems(tx, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	version, err := stock.GetVersion(tx, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = idempotency.Commit(tx, r)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("ETag", stock.FormatETag(version))
+
+	respondWithJSON(w, http.StatusOK, adminRes)
+}
+
+/* Validate auth token, check user is developer and return flagged gains.
+** Flags waiting for review are returned oldest first, or the newest reviewed
+** flags if reviewed=true is given */
+func (a *App) getFlags(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromToken(a.DB, r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	err = checkDeveloper(a.DB, id)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	limit := FLAG_PAGE_SIZE
+	if param := r.URL.Query().Get("limit"); param != "" {
+		value, err := strconv.Atoi(param)
+		if err != nil || value <= 0 {
+			respondWithError(w, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+		limit = value
+		if limit > MAX_FLAG_PAGE_SIZE {
+			limit = MAX_FLAG_PAGE_SIZE
+		}
+	}
+	reviewed := false
+	if param := r.URL.Query().Get("reviewed"); param != "" {
+		reviewed, err = strconv.ParseBool(param)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid reviewed filter")
+			return
+		}
+	}
+
+	flags, err := getFlags(a.DB, reviewed, limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, FlagsResponse{Flags: flags})
+}
+
+/* Validate auth token, check user is developer and mark a flag as reviewed */
+func (a *App) reviewFlag(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromToken(a.DB, r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	err = checkDeveloper(a.DB, id)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	flagID, err := strconv.ParseUint(mux.Vars(r)["flag_id"], 10, 63)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Flag not found")
+		return
+	}
+
+	res, err := a.DB.Exec("UPDATE flag SET reviewed=TRUE WHERE flag_id=?", flagID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if count == 0 {
+		// Reviewing a flag twice changes no rows, so check it exists
+		var flags Count
+		stmt := "SELECT COUNT(*) FROM flag WHERE flag_id=?"
+		err = a.DB.QueryRow(stmt, flagID).Scan(&flags.Value)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if flags.Value == 0 {
+			respondWithError(w, http.StatusNotFound, "Flag not found")
+			return
+		}
+	}
+
+	respondWithEmptyJSON(w, http.StatusOK)
+}
+
+/* Validate auth token, check user is developer and return maintenance job
+** metrics */
+func (a *App) getMaintenance(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromToken(a.DB, r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	err = checkDeveloper(a.DB, id)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, a.Maintenance.Metrics())
 }
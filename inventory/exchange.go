@@ -0,0 +1,128 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+/* An NPC exchange rate, set by developers, giving to_quantity of one item
+** for from_quantity of another. Players may exchange at the rate up to the
+** daily limit times each UTC day, and a daily limit of zero is unlimited */
+type ExchangeRate struct {
+	FromItemID   uint32 `json:"from_item_id"`
+	FromQuantity uint32 `json:"from_quantity"`
+	ToItemID     uint32 `json:"to_item_id"`
+	ToQuantity   uint32 `json:"to_quantity"`
+	DailyLimit   uint32 `json:"daily_limit"`
+}
+
+/* Insert the rate, replacing any existing rate between the same items */
+func (rate *ExchangeRate) SetRate(db *sql.DB) error {
+	stmt := "INSERT INTO exchange_rate VALUES (?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE from_quantity=VALUES(from_quantity), to_quantity=VALUES(to_quantity), daily_limit=VALUES(daily_limit)"
+	_, err := db.Exec(stmt, rate.FromItemID, rate.ToItemID, rate.FromQuantity,
+		rate.ToQuantity, rate.DailyLimit)
+	return err
+}
+
+/* Get the rate between two items, locking it until the transaction ends so
+** it cannot change while an exchange is made */
+func (rate *ExchangeRate) LockRate(tx *sql.Tx) error {
+	stmt := "SELECT from_quantity, to_quantity, daily_limit FROM exchange_rate WHERE from_item_id=? AND to_item_id=? LOCK IN SHARE MODE"
+	return tx.QueryRow(stmt, rate.FromItemID, rate.ToItemID).Scan(
+		&rate.FromQuantity, &rate.ToQuantity, &rate.DailyLimit)
+}
+
+/* Record an exchange made at the rate, returning the ledger source of the
+** inventory changes it makes */
+func (rate *ExchangeRate) LogExchange(tx *sql.Tx, userID,
+	count uint32) (string, error) {
+	stmt := "INSERT INTO exchange (user_id, from_item_id, to_item_id, count, exchange_time) VALUES (?, ?, ?, ?, ?)"
+	res, err := tx.Exec(stmt, userID, rate.FromItemID, rate.ToItemID, count,
+		time.Now().UnixNano())
+	if err != nil {
+		return "", err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("exchange:%d", id), nil
+}
+
+/* Check a rate is between two different storable items, in positive
+** quantities */
+func checkValidRate(rate ExchangeRate) error {
+	if !itemCatalog.IsStorable(rate.FromItemID) ||
+		!itemCatalog.IsStorable(rate.ToItemID) {
+		return errors.New("Invalid item ID in rate")
+	}
+	if rate.FromItemID == rate.ToItemID {
+		return errors.New("Cannot exchange an item for itself")
+	}
+	if rate.FromQuantity <= 0 || rate.ToQuantity <= 0 {
+		return errors.New("Invalid item quantity in rate")
+	}
+	return nil
+}
+
+/* The start of the current UTC day, when daily limits reset */
+func exchangeDayStart(now time.Time) time.Time {
+	return now.UTC().Truncate(24 * time.Hour)
+}
+
+/* Get every exchange rate */
+func getRates(db *sql.DB) ([]ExchangeRate, error) {
+	rates := make([]ExchangeRate, 0)
+	stmt := "SELECT from_item_id, from_quantity, to_item_id, to_quantity, daily_limit FROM exchange_rate ORDER BY from_item_id, to_item_id"
+	rows, err := db.Query(stmt)
+	if err != nil {
+		return rates, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rate ExchangeRate
+		err = rows.Scan(&rate.FromItemID, &rate.FromQuantity, &rate.ToItemID,
+			&rate.ToQuantity, &rate.DailyLimit)
+		if err != nil {
+			return rates, err
+		}
+		rates = append(rates, rate)
+	}
+	return rates, rows.Err()
+}
+
+/* Get the number of exchanges a user has made between each pair of items
+** since the given time, keyed by "from:to" */
+func getExchanged(db *sql.DB, userID uint32,
+	since int64) (map[string]uint64, error) {
+	exchanged := make(map[string]uint64)
+	stmt := "SELECT from_item_id, to_item_id, SUM(count) FROM exchange WHERE user_id=? AND exchange_time >= ? GROUP BY from_item_id, to_item_id"
+	rows, err := db.Query(stmt, userID, since)
+	if err != nil {
+		return exchanged, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var fromItemID, toItemID uint32
+		var count uint64
+		err = rows.Scan(&fromItemID, &toItemID, &count)
+		if err != nil {
+			return exchanged, err
+		}
+		exchanged[fmt.Sprintf("%d:%d", fromItemID, toItemID)] = count
+	}
+	return exchanged, rows.Err()
+}
+
+/* Get the number of exchanges a user has made at a rate since the given
+** time, within a transaction */
+func (rate *ExchangeRate) getExchangedSince(tx *sql.Tx, userID uint32,
+	since int64) (uint64, error) {
+	var count uint64
+	stmt := "SELECT COALESCE(SUM(count), 0) FROM exchange WHERE user_id=? AND from_item_id=? AND to_item_id=? AND exchange_time >= ?"
+	err := tx.QueryRow(stmt, userID, rate.FromItemID, rate.ToItemID,
+		since).Scan(&count)
+	return count, err
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"database/sql"
+)
+
+/* A client-reported gain rejected for breaking the economy limits, kept for
+** review by developers */
+type Flag struct {
+	FlagID    uint64 `json:"flag_id"`
+	Username  string `json:"username"`
+	ItemID    uint32 `json:"item_id"`
+	Requested uint64 `json:"requested"`
+	Accepted  uint32 `json:"accepted"`
+	Reason    string `json:"reason"`
+	Source    string `json:"source"`
+	FlagTime  int64  `json:"flag_time"`
+	Reviewed  bool   `json:"reviewed"`
+}
+
+/* Get flags waiting for review, oldest first, or the newest reviewed flags */
+func getFlags(db *sql.DB, reviewed bool, limit int) ([]Flag, error) {
+	flags := make([]Flag, 0)
+	stmt := "SELECT flag.flag_id, account.username, flag.item_id, flag.requested, flag.accepted, flag.reason, flag.source, flag.flag_time, flag.reviewed FROM flag INNER JOIN account ON flag.user_id = account.user_id WHERE flag.reviewed=? ORDER BY flag.flag_id"
+	if reviewed {
+		stmt += " DESC"
+	}
+	stmt += " LIMIT ?"
+	rows, err := db.Query(stmt, reviewed, limit)
+	if err != nil {
+		return flags, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var flag Flag
+		err = rows.Scan(&flag.FlagID, &flag.Username, &flag.ItemID,
+			&flag.Requested, &flag.Accepted, &flag.Reason, &flag.Source,
+			&flag.FlagTime, &flag.Reviewed)
+		if err != nil {
+			return flags, err
+		}
+		flags = append(flags, flag)
+	}
+	return flags, rows.Err()
+}
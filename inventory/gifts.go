@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/jaylees14/Manhattan-Server/stock"
+)
+
+/* A gift sends items from one player to another with a message. The items
+** are held in escrow, outside the sender's inventory, until the recipient
+** claims them or the gift expires and they are returned */
+type Gift struct {
+	GiftID      uint32          `json:"gift_id"`
+	SenderID    uint32          `json:"sender_id"`
+	RecipientID uint32          `json:"recipient_id"`
+	Message     string          `json:"message"`
+	Status      string          `json:"status"`
+	GiftExpire  int64           `json:"gift_expire"`
+	Items       stock.Inventory `json:"items"`
+}
+
+const (
+	GIFT_PENDING = "pending"
+	GIFT_CLAIMED = "claimed"
+	GIFT_EXPIRED = "expired"
+)
+
+const MAX_GIFT_MESSAGE int = 255
+
+/* Insert a pending gift and its items. The items must already have been
+** removed from the sender's inventory in the same transaction */
+func (gift *Gift) CreateGift(tx *sql.Tx) error {
+	stmt := "INSERT INTO gift VALUES (?, ?, ?, ?, ?, ?)"
+	_, err := tx.Exec(stmt, gift.GiftID, gift.SenderID, gift.RecipientID,
+		gift.Message, GIFT_PENDING, gift.GiftExpire)
+	if err != nil {
+		return err
+	}
+	gift.Status = GIFT_PENDING
+
+	itemStmt := "INSERT INTO gift_item VALUES (?, ?, ?)"
+	for i := 0; i < len(gift.Items.Items); i++ {
+		_, err = tx.Exec(itemStmt, gift.GiftID, gift.Items.Items[i].ItemID,
+			gift.Items.Items[i].Quantity)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Get a gift and its items, locking the gift until the transaction ends so
+** it can only change status once */
+func (gift *Gift) LockGift(tx *sql.Tx) error {
+	stmt := "SELECT sender_id, recipient_id, message, status, gift_expire FROM gift WHERE gift_id=? FOR UPDATE"
+	err := tx.QueryRow(stmt, gift.GiftID).Scan(&gift.SenderID,
+		&gift.RecipientID, &gift.Message, &gift.Status, &gift.GiftExpire)
+	if err != nil {
+		return err
+	}
+
+	itemStmt := "SELECT item_id, quantity FROM gift_item WHERE gift_id=?"
+	rows, err := tx.Query(itemStmt, gift.GiftID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	return gift.scanItems(rows)
+}
+
+/* Get the items of an unlocked gift, for listing */
+func (gift *Gift) GetGiftItems(db *sql.DB) error {
+	stmt := "SELECT item_id, quantity FROM gift_item WHERE gift_id=?"
+	rows, err := db.Query(stmt, gift.GiftID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	return gift.scanItems(rows)
+}
+
+/* Read gift item rows, owned by the sender while in escrow */
+func (gift *Gift) scanItems(rows *sql.Rows) error {
+	gift.Items.Items = make([]stock.Item, 0)
+	for rows.Next() {
+		item := stock.Item{UserID: gift.SenderID}
+		err := rows.Scan(&item.ItemID, &item.Quantity)
+		if err != nil {
+			return err
+		}
+		gift.Items.Items = append(gift.Items.Items, item)
+	}
+	return rows.Err()
+}
+
+func (gift *Gift) SetStatus(tx *sql.Tx, status string) error {
+	stmt := "UPDATE gift SET status=? WHERE gift_id=?"
+	_, err := tx.Exec(stmt, status, gift.GiftID)
+	if err == nil {
+		gift.Status = status
+	}
+	return err
+}
+
+/* Give the escrowed items back to the sender and expire the gift. They left
+** the sender's inventory within its limits, so they are returned regardless
+** of the limits rather than being lost */
+func (gift *Gift) ReturnGift(tx *sql.Tx) error {
+	if len(gift.Items.Items) > 0 {
+		err := gift.Items.AddInventory(tx)
+		if err != nil {
+			return err
+		}
+		err = gift.Items.LogAdded(tx, stock.LEDGER_GIFTED, gift.Source())
+		if err != nil {
+			return err
+		}
+	}
+	return gift.SetStatus(tx, GIFT_EXPIRED)
+}
+
+/* The ledger source of inventory changes made by the gift */
+func (gift *Gift) Source() string {
+	return fmt.Sprintf("gift:%d", gift.GiftID)
+}
+
+/* Expire a batch of pending gifts past their expiry, returning the escrowed
+** items to each sender. Each gift is expired in its own transaction, and a
+** gift which cannot be returned is logged and left for the next run rather
+** than holding back the rest. Run by the maintenance job */
+func expireGifts(ctx context.Context, conn *sql.Conn, now int64,
+	batchSize int) (int64, error) {
+	stmt := "SELECT gift_id FROM gift WHERE status=? AND gift_expire < ? LIMIT ?"
+	rows, err := conn.QueryContext(ctx, stmt, GIFT_PENDING, now, batchSize)
+	if err != nil {
+		return 0, err
+	}
+	var gifts []Gift
+	for rows.Next() {
+		var gift Gift
+		err = rows.Scan(&gift.GiftID)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		gifts = append(gifts, gift)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return 0, err
+	}
+
+	var expired int64
+	for i := 0; i < len(gifts); i++ {
+		err = gifts[i].expire(ctx, conn, now)
+		if err != nil {
+			log.Printf("gift %d not expired: %s", gifts[i].GiftID, err)
+			continue
+		}
+		expired++
+	}
+	return expired, nil
+}
+
+/* Expire a gift and return its items, unless it was claimed since it was
+** selected */
+func (gift *Gift) expire(ctx context.Context, conn *sql.Conn,
+	now int64) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = gift.LockGift(tx)
+	if err != nil {
+		return err
+	}
+	if gift.Status != GIFT_PENDING || gift.GiftExpire >= now {
+		return nil
+	}
+	err = gift.ReturnGift(tx)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
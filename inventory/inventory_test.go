@@ -11,14 +11,17 @@ import (
 	"os"
 	"strings"
 	"testing"
-)
 
-type Count struct {
-	Value int
-}
+	"github.com/gorilla/mux"
+	"github.com/jaylees14/Manhattan-Server/catalog"
+	"github.com/jaylees14/Manhattan-Server/idempotency"
+	"github.com/jaylees14/Manhattan-Server/stock"
+)
 
 const ACCESS_TOKEN string = "Bearer ydzvGQg2EcjTTHLSVHb7JTpkSRDdd0hQu2n5YPEM4CTfnqQIrqnufSIIOWchPNSZ"
 
+const PLAYER_ACCESS_TOKEN string = "Bearer CwlBrHSOzAC2NMLDREmeLeSdAeGMWcczp7KH2Ks9hWJtsMAey82kdRlggoqG0Yjr"
+
 var testA App
 var testConfig Configuration
 
@@ -70,6 +73,214 @@ func clearInventoryTable(t *testing.T) {
 	if err != nil {
 		t.Errorf("Failed to clear inventory table")
 	}
+	_, err = testA.DB.Exec("DELETE FROM inventory_version")
+	if err != nil {
+		t.Errorf("Failed to clear inventory version table")
+	}
+	// Gain caps are counted from the ledger
+	_, err = testA.DB.Exec("DELETE FROM ledger")
+	if err != nil {
+		t.Errorf("Failed to clear ledger table")
+	}
+	_, err = testA.DB.Exec("DELETE FROM flag")
+	if err != nil {
+		t.Errorf("Failed to clear flag table")
+	}
+	_, err = testA.DB.Exec("DELETE FROM admin_action")
+	if err != nil {
+		t.Errorf("Failed to clear admin action table")
+	}
+}
+
+func clearProgressTable(t *testing.T) {
+	_, err := testA.DB.Exec("DELETE FROM progress")
+	if err != nil {
+		t.Errorf("Failed to clear progress table")
+	}
+}
+
+func clearIdempotencyTable(t *testing.T) {
+	_, err := testA.DB.Exec("DELETE FROM idempotency")
+	if err != nil {
+		t.Errorf("Failed to clear idempotency table")
+	}
+}
+
+func clearLedgerTable(t *testing.T) {
+	_, err := testA.DB.Exec("DELETE FROM ledger")
+	if err != nil {
+		t.Errorf("Failed to clear ledger table")
+	}
+}
+
+func clearTradeTables(t *testing.T) {
+	_, err := testA.DB.Exec("DELETE FROM trade_item")
+	if err != nil {
+		t.Errorf("Failed to clear trade item table")
+	}
+	_, err = testA.DB.Exec("DELETE FROM trade")
+	if err != nil {
+		t.Errorf("Failed to clear trade table")
+	}
+}
+
+func clearJobTables(t *testing.T) {
+	_, err := testA.DB.Exec("DELETE FROM job_item")
+	if err != nil {
+		t.Errorf("Failed to clear job item table")
+	}
+	_, err = testA.DB.Exec("DELETE FROM job")
+	if err != nil {
+		t.Errorf("Failed to clear job table")
+	}
+}
+
+func clearGiftTables(t *testing.T) {
+	_, err := testA.DB.Exec("DELETE FROM gift_item")
+	if err != nil {
+		t.Errorf("Failed to clear gift item table")
+	}
+	_, err = testA.DB.Exec("DELETE FROM gift")
+	if err != nil {
+		t.Errorf("Failed to clear gift table")
+	}
+}
+
+/* Send 3 wood (1) from Will to John */
+func createTestGift(t *testing.T) GiftResponse {
+	payload := []byte(`{"username":"John","items":[{"item_id":1,"quantity":3}],"message":"For your furnace"}`)
+	res := sendTestRequest(t, ACCESS_TOKEN, http.MethodPost,
+		"/api/v1/inventory/gifts", payload)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var giftRes GiftResponse
+	err := json.NewDecoder(res.Body).Decode(&giftRes)
+	if err != nil {
+		t.Errorf("Failed to decode gift response")
+	}
+	return giftRes
+}
+
+func clearExchangeTables(t *testing.T) {
+	_, err := testA.DB.Exec("DELETE FROM exchange")
+	if err != nil {
+		t.Errorf("Failed to clear exchange table")
+	}
+	_, err = testA.DB.Exec("DELETE FROM exchange_rate")
+	if err != nil {
+		t.Errorf("Failed to clear exchange rate table")
+	}
+}
+
+/* Post a job request or action as Will */
+func sendTestJob(t *testing.T, url string,
+	payload []byte) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+	return executeRequest(req)
+}
+
+/* Add items to a user's inventory through the API */
+func addTestItems(t *testing.T, token string, payload []byte) {
+	req, err := http.NewRequest(http.MethodPost, "/api/v1/inventory",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", token)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+}
+
+/* Get a user's inventory through the API as a map of item ID to quantity */
+func getTestInventory(t *testing.T, token string) map[uint32]uint32 {
+	req, err := http.NewRequest(http.MethodGet, "/api/v1/inventory", nil)
+	req.Header.Set("Authorization", token)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var inv stock.Inventory
+	err = json.NewDecoder(res.Body).Decode(&inv)
+	if err != nil {
+		t.Errorf("Failed to decode inventory response")
+	}
+	quantities := make(map[uint32]uint32)
+	for i := 0; i < len(inv.Items); i++ {
+		quantities[inv.Items[i].ItemID] = inv.Items[i].Quantity
+	}
+	return quantities
+}
+
+/* Get flags through the API as a developer */
+func getTestFlags(t *testing.T, token, url string) FlagsResponse {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("Authorization", token)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var flagsRes FlagsResponse
+	err = json.NewDecoder(res.Body).Decode(&flagsRes)
+	if err != nil {
+		t.Errorf("Failed to decode flags response")
+	}
+	return flagsRes
+}
+
+/* Send a request with a JSON body as the given user */
+func sendTestRequest(t *testing.T, token, method, url string,
+	payload []byte) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, url, bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", token)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+	return executeRequest(req)
+}
+
+/* Offer 4 wood (1) from Will for 2 stone (2) from John */
+func createTestTrade(t *testing.T) TradeResponse {
+	payload := []byte(`{"username":"John","offer":[{"item_id":1,"quantity":4}],"request":[{"item_id":2,"quantity":2}]}`)
+
+	req, err := http.NewRequest(http.MethodPost, "/api/v1/inventory/trades",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var tradeRes TradeResponse
+	err = json.NewDecoder(res.Body).Decode(&tradeRes)
+	if err != nil {
+		t.Errorf("Failed to decode trade response")
+	}
+	return tradeRes
+}
+
+/* Post a trade action as the given user */
+func closeTestTrade(t *testing.T, token string, tradeID uint32,
+	action string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(http.MethodPost,
+		fmt.Sprintf("/api/v1/inventory/trades/%d/%s", tradeID, action), nil)
+	req.Header.Set("Authorization", token)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+	return executeRequest(req)
 }
 
 func executeRequest(req *http.Request) *httptest.ResponseRecorder {
@@ -135,7 +346,7 @@ func TestGetEmptyInventory(t *testing.T) {
 
 	// Check an empty items list is returned
 	decoder := json.NewDecoder(res.Body)
-	var inv Inventory
+	var inv stock.Inventory
 	err = decoder.Decode(&inv)
 	if err != nil {
 		t.Errorf("Failed to decode inventory response")
@@ -174,7 +385,7 @@ func TestAddGetInventory(t *testing.T) {
 
 	// Check the correct item ID, quantity pairs are returned
 	decoder := json.NewDecoder(res.Body)
-	var inv Inventory
+	var inv stock.Inventory
 	err = decoder.Decode(&inv)
 	if err != nil {
 		t.Errorf("Failed to decode inventory response")
@@ -192,6 +403,78 @@ func TestAddGetInventory(t *testing.T) {
 	}
 }
 
+/* Check inventory items can be expanded with item details, filtered by type
+** and sorted */
+func TestGetInventoryExpandSort(t *testing.T) {
+	clearInventoryTable(t)
+
+	// 4 wood, 9 sand, a furnace and 2 glass
+	_, err := testA.DB.Exec("INSERT INTO inventory VALUES (3149194563, 1, 4), (3149194563, 8, 9), (3149194563, 11, 1), (3149194563, 16, 2)")
+	if err != nil {
+		t.Errorf("Failed to add inventory")
+	}
+
+	getItems := func(url string) []ItemResponse {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("Authorization", ACCESS_TOKEN)
+		if err != nil {
+			t.Errorf("Failed to create request")
+		}
+		res := executeRequest(req)
+		checkResponseCode(t, http.StatusOK, res.Code)
+
+		var invRes InventoryResponse
+		err = json.NewDecoder(res.Body).Decode(&invRes)
+		if err != nil {
+			t.Errorf("Failed to decode inventory response")
+		}
+		return invRes.Items
+	}
+
+	items := getItems("/api/v1/inventory?expand=item&sort=-quantity")
+	order := []uint32{8, 1, 16, 11}
+	if len(items) != len(order) {
+		t.Fatalf("Expected %d items. Actual was %d", len(order), len(items))
+	}
+	for i := 0; i < len(order); i++ {
+		if items[i].ItemID != order[i] || items[i].Item == nil {
+			t.Errorf("Expected expanded item %d at %d. Actual was %d",
+				order[i], i, items[i].ItemID)
+		}
+	}
+	if items[1].Item.Name != "Wood" || items[1].Item.Type != catalog.TYPE_PRIMARY_RESOURCE {
+		t.Errorf("Expected wood details. Actual was %v", items[1].Item)
+	}
+	if !items[2].Item.Craftable || items[2].Item.Placeable {
+		t.Errorf("Expected glass to be craftable only")
+	}
+	if !items[3].Item.Placeable || items[3].Item.Craftable {
+		t.Errorf("Expected the furnace to be placeable only")
+	}
+
+	// Primary resources only, by name, without details
+	items = getItems("/api/v1/inventory?type=1&sort=name")
+	if len(items) != 2 || items[0].ItemID != 8 || items[1].ItemID != 1 ||
+		items[0].Item != nil {
+		t.Errorf("Expected sand then wood")
+	}
+	items = getItems("/api/v1/inventory?type=2,3&sort=item_id")
+	if len(items) != 2 || items[0].ItemID != 11 || items[1].ItemID != 16 {
+		t.Errorf("Expected the furnace then glass")
+	}
+
+	for _, url := range []string{"/api/v1/inventory?expand=recipe",
+		"/api/v1/inventory?type=wood", "/api/v1/inventory?sort=price"} {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("Authorization", ACCESS_TOKEN)
+		if err != nil {
+			t.Errorf("Failed to create request")
+		}
+		res := executeRequest(req)
+		checkResponseCode(t, http.StatusBadRequest, res.Code)
+	}
+}
+
 /* Check empty item lists are not accepted for adding */
 func TestAddEmptyInventory(t *testing.T) {
 	clearInventoryTable(t)
@@ -213,7 +496,7 @@ func TestAddEmptyInventory(t *testing.T) {
 func TestAddInvalidItemID(t *testing.T) {
 	clearInventoryTable(t)
 
-	// Item IDs must be greater than 0 and less than or equal 32
+	// Item IDs must exist in the item schema
 	payload := []byte(`{"items":[{"item_id":0,"quantity":4}]}`)
 
 	req, err := http.NewRequest(http.MethodPost, "/api/v1/inventory",
@@ -239,6 +522,24 @@ func TestAddInvalidItemID(t *testing.T) {
 	checkResponseCode(t, http.StatusBadRequest, res.Code)
 }
 
+/* Check intangible items, such as electricity (32), are not accepted for
+** adding */
+func TestAddIntangibleItem(t *testing.T) {
+	clearInventoryTable(t)
+
+	payload := []byte(`{"items":[{"item_id":32,"quantity":4}]}`)
+
+	req, err := http.NewRequest(http.MethodPost, "/api/v1/inventory",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, res.Code)
+}
+
 /* Check item lists with quantities less than or equal zero are not accepted
 ** for adding */
 func TestAddInvalidQuantity(t *testing.T) {
@@ -307,7 +608,7 @@ func TestDeleteInventory(t *testing.T) {
 
 	// Check an empty items list is returned
 	decoder := json.NewDecoder(res.Body)
-	var inv Inventory
+	var inv stock.Inventory
 	err = decoder.Decode(&inv)
 	if err != nil {
 		t.Errorf("Failed to decode inventory response")
@@ -316,3 +617,1523 @@ func TestDeleteInventory(t *testing.T) {
 		t.Errorf("Expected empty list. Actual length was %d", len(inv.Items))
 	}
 }
+
+/* Check removing part of an item quantity keeps the rest, and entries reaching
+** zero are deleted */
+func TestRemoveItems(t *testing.T) {
+	clearInventoryTable(t)
+
+	// Add items to inventory
+	payload := []byte(`{"items":[{"item_id":1,"quantity":4},{"item_id":9,"quantity":5}]}`)
+
+	req, err := http.NewRequest(http.MethodPost, "/api/v1/inventory",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	// Remove all of item 1 and some of item 9
+	payload = []byte(`{"items":[{"item_id":1,"quantity":4},{"item_id":9,"quantity":2}]}`)
+
+	req, err = http.NewRequest(http.MethodDelete, "/api/v1/inventory/items",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	// Get items from inventory
+	req, err = http.NewRequest(http.MethodGet, "/api/v1/inventory", nil)
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	// Check only the remaining quantity of item 9 is returned
+	decoder := json.NewDecoder(res.Body)
+	var inv stock.Inventory
+	err = decoder.Decode(&inv)
+	if err != nil {
+		t.Errorf("Failed to decode inventory response")
+	}
+	if len(inv.Items) != 1 {
+		t.Fatalf("Expected one item. Actual number was %d", len(inv.Items))
+	}
+	if inv.Items[0].ItemID != 9 || inv.Items[0].Quantity != 3 {
+		t.Errorf("Expected item 9 with quantity 3. Actual was item %d with quantity %d",
+			inv.Items[0].ItemID, inv.Items[0].Quantity)
+	}
+}
+
+/* Check removing more than the user has removes nothing and lists the
+** shortfalls */
+func TestRemoveItemsShortfall(t *testing.T) {
+	clearInventoryTable(t)
+
+	// Add items to inventory
+	payload := []byte(`{"items":[{"item_id":1,"quantity":4},{"item_id":9,"quantity":5}]}`)
+
+	req, err := http.NewRequest(http.MethodPost, "/api/v1/inventory",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	// Item 9 is available, item 1 and item 2 are not
+	payload = []byte(`{"items":[{"item_id":9,"quantity":5},{"item_id":1,"quantity":3},{"item_id":1,"quantity":2},{"item_id":2,"quantity":1}]}`)
+
+	req, err = http.NewRequest(http.MethodDelete, "/api/v1/inventory/items",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, res.Code)
+
+	var shortRes ShortfallResponse
+	err = json.NewDecoder(res.Body).Decode(&shortRes)
+	if err != nil {
+		t.Errorf("Failed to decode shortfall response")
+	}
+	if len(shortRes.Shortfalls) != 2 {
+		t.Fatalf("Expected two shortfalls. Actual number was %d",
+			len(shortRes.Shortfalls))
+	}
+	if shortRes.Shortfalls[0].ItemID != 1 ||
+		shortRes.Shortfalls[0].Required != 5 ||
+		shortRes.Shortfalls[0].Available != 4 {
+		t.Errorf("Expected item 1 to require 5 with 4 available")
+	}
+	if shortRes.Shortfalls[1].ItemID != 2 ||
+		shortRes.Shortfalls[1].Available != 0 {
+		t.Errorf("Expected item 2 to have none available")
+	}
+
+	// Check nothing was removed
+	req, err = http.NewRequest(http.MethodGet, "/api/v1/inventory", nil)
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var inv stock.Inventory
+	err = json.NewDecoder(res.Body).Decode(&inv)
+	if err != nil {
+		t.Errorf("Failed to decode inventory response")
+	}
+	if len(inv.Items) != 2 || inv.Items[0].Quantity != 4 ||
+		inv.Items[1].Quantity != 5 {
+		t.Errorf("Expected inventory to be unchanged")
+	}
+}
+
+/* Check adds beyond an item's max stack are rejected, or partially accepted
+** when requested */
+func TestAddStackLimit(t *testing.T) {
+	clearInventoryTable(t)
+
+	maxStack := itemCatalog.MaxStack(1)
+	payload := []byte(fmt.Sprintf(`{"items":[{"item_id":1,"quantity":%d},{"item_id":1,"quantity":1}]}`,
+		maxStack))
+
+	req, err := http.NewRequest(http.MethodPost, "/api/v1/inventory",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, res.Code)
+
+	var rejRes RejectionResponse
+	err = json.NewDecoder(res.Body).Decode(&rejRes)
+	if err != nil {
+		t.Errorf("Failed to decode rejection response")
+	}
+	if len(rejRes.Rejected) != 1 || rejRes.Rejected[0].ItemID != 1 ||
+		rejRes.Rejected[0].Accepted != maxStack {
+		t.Errorf("Expected item 1 to be rejected beyond its max stack")
+	}
+
+	// Add again, accepting as much as fits
+	payload = []byte(fmt.Sprintf(`{"items":[{"item_id":1,"quantity":%d},{"item_id":1,"quantity":1}],"partial":true}`,
+		maxStack))
+
+	req, err = http.NewRequest(http.MethodPost, "/api/v1/inventory",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var addRes AddResponse
+	err = json.NewDecoder(res.Body).Decode(&addRes)
+	if err != nil {
+		t.Errorf("Failed to decode add response")
+	}
+	if len(addRes.Accepted) != 1 || addRes.Accepted[0].Quantity != maxStack {
+		t.Errorf("Expected %d of item 1 to be accepted", maxStack)
+	}
+	if len(addRes.Rejected) != 1 || addRes.Rejected[0].Requested != uint64(maxStack)+1 {
+		t.Errorf("Expected the remainder of item 1 to be rejected")
+	}
+}
+
+/* Check new items are rejected once every inventory slot is used */
+func TestAddSlotCapacity(t *testing.T) {
+	clearInventoryTable(t)
+
+	// Fill every slot with a different storable item, leaving out a primary
+	// resource which could be collected
+	var inv stock.Inventory
+	var spare uint32
+	for i := 0; i < len(itemCatalog.Schema.Items); i++ {
+		itemID := itemCatalog.Schema.Items[i].ItemID
+		if !itemCatalog.IsStorable(itemID) {
+			continue
+		}
+		if spare == 0 && itemCatalog.IsSpawnable(itemID) && len(inv.Items) > 0 {
+			spare = itemID
+			continue
+		}
+		if uint32(len(inv.Items)) == itemCatalog.SlotCapacity() {
+			break
+		}
+		inv.Items = append(inv.Items, stock.Item{ItemID: itemID, Quantity: 1})
+	}
+	if uint32(len(inv.Items)) < itemCatalog.SlotCapacity() {
+		t.Skip("Item schema has no more items than inventory slots")
+	}
+	for i := 0; i < len(inv.Items); i++ {
+		_, err := testA.DB.Exec("INSERT INTO inventory VALUES (3149194563, ?, 1)",
+			inv.Items[i].ItemID)
+		if err != nil {
+			t.Errorf("Failed to add inventory")
+		}
+	}
+
+	// Items already held still fit, new items do not
+	payload := []byte(fmt.Sprintf(`{"items":[{"item_id":%d,"quantity":1},{"item_id":%d,"quantity":1}],"partial":true}`,
+		inv.Items[0].ItemID, spare))
+
+	req, err := http.NewRequest(http.MethodPost, "/api/v1/inventory",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var addRes AddResponse
+	err = json.NewDecoder(res.Body).Decode(&addRes)
+	if err != nil {
+		t.Errorf("Failed to decode add response")
+	}
+	if len(addRes.Accepted) != 1 || addRes.Accepted[0].ItemID != inv.Items[0].ItemID {
+		t.Errorf("Expected the held item to be accepted")
+	}
+	if len(addRes.Rejected) != 1 || addRes.Rejected[0].ItemID != spare ||
+		addRes.Rejected[0].Reason != catalog.REASON_NO_SLOT {
+		t.Errorf("Expected item %d to be rejected for lack of a slot", spare)
+	}
+}
+
+/* Check items which must be crafted, built or traded cannot be added
+** directly, and are flagged for review */
+func TestAddUntrustedItem(t *testing.T) {
+	clearInventoryTable(t)
+
+	// A satellite dish (28) must be built
+	payload := []byte(`{"items":[{"item_id":1,"quantity":4},{"item_id":28,"quantity":1}]}`)
+
+	req, err := http.NewRequest(http.MethodPost, "/api/v1/inventory",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, res.Code)
+
+	var rejRes RejectionResponse
+	err = json.NewDecoder(res.Body).Decode(&rejRes)
+	if err != nil {
+		t.Errorf("Failed to decode rejection response")
+	}
+	if len(rejRes.Rejected) != 1 || rejRes.Rejected[0].ItemID != 28 ||
+		rejRes.Rejected[0].Reason != catalog.REASON_UNTRUSTED {
+		t.Errorf("Expected the satellite dish to be rejected as untrusted")
+	}
+	if len(getTestInventory(t, ACCESS_TOKEN)) != 0 {
+		t.Errorf("Expected inventory to be unchanged")
+	}
+
+	// Check the rejection was flagged, even though nothing was added
+	flagsRes := getTestFlags(t, ACCESS_TOKEN, "/api/v1/inventory/flags")
+	if len(flagsRes.Flags) != 1 || flagsRes.Flags[0].ItemID != 28 ||
+		flagsRes.Flags[0].Username != "Will" ||
+		flagsRes.Flags[0].Source != stock.FLAG_INVENTORY {
+		t.Errorf("Expected the satellite dish to be flagged")
+	}
+}
+
+/* Check client-reported gains are capped in each gain period, or partially
+** accepted when requested */
+func TestAddGainLimit(t *testing.T) {
+	clearInventoryTable(t)
+
+	maxGain := itemCatalog.MaxGain(1)
+	if maxGain == 0 {
+		t.Skip("Wood has no max gain")
+	}
+
+	// Removing items does not restore the allowance
+	addTestItems(t, ACCESS_TOKEN, []byte(fmt.Sprintf(`{"items":[{"item_id":1,"quantity":%d}]}`,
+		maxGain-1)))
+	req, err := http.NewRequest(http.MethodDelete, "/api/v1/inventory", nil)
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	payload := []byte(`{"items":[{"item_id":1,"quantity":3}],"partial":true}`)
+	req, err = http.NewRequest(http.MethodPost, "/api/v1/inventory",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var addRes AddResponse
+	err = json.NewDecoder(res.Body).Decode(&addRes)
+	if err != nil {
+		t.Errorf("Failed to decode add response")
+	}
+	if len(addRes.Accepted) != 1 || addRes.Accepted[0].Quantity != 1 {
+		t.Errorf("Expected 1 wood to be accepted")
+	}
+	if len(addRes.Rejected) != 1 ||
+		addRes.Rejected[0].Reason != catalog.REASON_GAIN_LIMIT {
+		t.Errorf("Expected the remaining wood to be rejected for the gain limit")
+	}
+
+	// The cap is per user
+	addTestItems(t, PLAYER_ACCESS_TOKEN, []byte(`{"items":[{"item_id":1,"quantity":3}]}`))
+}
+
+/* Check developers can set, add to and remove from another user's inventory,
+** with the reason recorded against each change */
+func TestAdminInventory(t *testing.T) {
+	clearInventoryTable(t)
+
+	url := "/api/v1/inventory/admin/John"
+
+	// Admins may give items which cannot be added directly
+	res := sendTestRequest(t, ACCESS_TOKEN, http.MethodPut, url,
+		[]byte(`{"items":[{"item_id":28,"quantity":1},{"item_id":1,"quantity":5}],"reason":"Restore lost items"}`))
+	checkResponseCode(t, http.StatusOK, res.Code)
+	if res.Header().Get("ETag") == "" {
+		t.Errorf("Expected an ETag")
+	}
+	var adminRes AdminResponse
+	err := json.NewDecoder(res.Body).Decode(&adminRes)
+	if err != nil {
+		t.Errorf("Failed to decode admin response")
+	}
+	if adminRes.ActionID == 0 || len(adminRes.Items) != 2 {
+		t.Errorf("Expected the action ID and the new inventory")
+	}
+
+	res = sendTestRequest(t, ACCESS_TOKEN, http.MethodPost, url,
+		[]byte(`{"items":[{"item_id":1,"quantity":3}],"reason":"Compensation"}`))
+	checkResponseCode(t, http.StatusOK, res.Code)
+	res = sendTestRequest(t, ACCESS_TOKEN, http.MethodDelete, url+"/items",
+		[]byte(`{"items":[{"item_id":1,"quantity":2}],"reason":"Duplicated items"}`))
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	inv := getTestInventory(t, PLAYER_ACCESS_TOKEN)
+	if len(inv) != 2 || inv[1] != 6 || inv[28] != 1 {
+		t.Errorf("Expected 6 wood and a satellite dish. Actual was %v", inv)
+	}
+
+	// Removing more than is held changes nothing
+	res = sendTestRequest(t, ACCESS_TOKEN, http.MethodDelete, url+"/items",
+		[]byte(`{"items":[{"item_id":1,"quantity":7}],"reason":"Duplicated items"}`))
+	checkResponseCode(t, http.StatusConflict, res.Code)
+
+	// Check each change was recorded with its reason
+	var count Count
+	err = testA.DB.QueryRow("SELECT COUNT(*) FROM admin_action WHERE user_id=2121631167 AND admin_id=3149194563").Scan(&count.Value)
+	if err != nil || count.Value != 3 {
+		t.Errorf("Expected 3 admin actions. Actual was %d", count.Value)
+	}
+	var reason string
+	stmt := "SELECT reason FROM admin_action WHERE CONCAT('admin:', action_id) = (SELECT source FROM ledger WHERE user_id=2121631167 AND delta=-2)"
+	err = testA.DB.QueryRow(stmt).Scan(&reason)
+	if err != nil || reason != "Duplicated items" {
+		t.Errorf("Expected the ledger entry to refer to the admin action")
+	}
+
+	// Setting an empty list empties the inventory
+	res = sendTestRequest(t, ACCESS_TOKEN, http.MethodPut, url,
+		[]byte(`{"items":[],"reason":"Account reset"}`))
+	checkResponseCode(t, http.StatusOK, res.Code)
+	if len(getTestInventory(t, PLAYER_ACCESS_TOKEN)) != 0 {
+		t.Errorf("Expected John's inventory to be empty")
+	}
+}
+
+/* Check admin changes need a developer, a known user and a reason */
+func TestAdminInventoryInvalid(t *testing.T) {
+	clearInventoryTable(t)
+
+	payload := []byte(`{"items":[{"item_id":1,"quantity":5}],"reason":"Restore lost items"}`)
+	res := sendTestRequest(t, PLAYER_ACCESS_TOKEN, http.MethodPost,
+		"/api/v1/inventory/admin/John", payload)
+	checkResponseCode(t, http.StatusUnauthorized, res.Code)
+
+	res = sendTestRequest(t, PLAYER_ACCESS_TOKEN, http.MethodGet,
+		"/api/v1/inventory/admin/Will", nil)
+	checkResponseCode(t, http.StatusUnauthorized, res.Code)
+
+	res = sendTestRequest(t, ACCESS_TOKEN, http.MethodPost,
+		"/api/v1/inventory/admin/Nobody", payload)
+	checkResponseCode(t, http.StatusNotFound, res.Code)
+
+	res = sendTestRequest(t, ACCESS_TOKEN, http.MethodPost,
+		"/api/v1/inventory/admin/John",
+		[]byte(`{"items":[{"item_id":1,"quantity":5}],"reason":"  "}`))
+	checkResponseCode(t, http.StatusBadRequest, res.Code)
+
+	if len(getTestInventory(t, PLAYER_ACCESS_TOKEN)) != 0 {
+		t.Errorf("Expected John's inventory to be unchanged")
+	}
+}
+
+/* Check only developers can view and review flags */
+func TestReviewFlagOnlyDeveloper(t *testing.T) {
+	clearInventoryTable(t)
+
+	payload := []byte(`{"items":[{"item_id":28,"quantity":1}]}`)
+	req, err := http.NewRequest(http.MethodPost, "/api/v1/inventory",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", PLAYER_ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, res.Code)
+
+	req, err = http.NewRequest(http.MethodGet, "/api/v1/inventory/flags", nil)
+	req.Header.Set("Authorization", PLAYER_ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, res.Code)
+
+	flagsRes := getTestFlags(t, ACCESS_TOKEN, "/api/v1/inventory/flags")
+	if len(flagsRes.Flags) != 1 || flagsRes.Flags[0].Username != "John" {
+		t.Fatalf("Expected John's flag to be waiting for review")
+	}
+	flagID := flagsRes.Flags[0].FlagID
+
+	for _, token := range []string{PLAYER_ACCESS_TOKEN, ACCESS_TOKEN} {
+		req, err = http.NewRequest(http.MethodPost,
+			fmt.Sprintf("/api/v1/inventory/flags/%d/review", flagID), nil)
+		req.Header.Set("Authorization", token)
+		if err != nil {
+			t.Errorf("Failed to create request")
+		}
+		res = executeRequest(req)
+		if token == ACCESS_TOKEN {
+			checkResponseCode(t, http.StatusOK, res.Code)
+		} else {
+			checkResponseCode(t, http.StatusUnauthorized, res.Code)
+		}
+	}
+
+	flagsRes = getTestFlags(t, ACCESS_TOKEN, "/api/v1/inventory/flags")
+	if len(flagsRes.Flags) != 0 {
+		t.Errorf("Expected no flags waiting for review")
+	}
+	flagsRes = getTestFlags(t, ACCESS_TOKEN, "/api/v1/inventory/flags?reviewed=true")
+	if len(flagsRes.Flags) != 1 || !flagsRes.Flags[0].Reviewed {
+		t.Errorf("Expected the reviewed flag")
+	}
+
+	req, err = http.NewRequest(http.MethodPost,
+		fmt.Sprintf("/api/v1/inventory/flags/%d/review", flagID+1), nil)
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, res.Code)
+}
+
+/* Check items can only be crafted once their machine blueprint is built */
+func TestCraftWithoutMachine(t *testing.T) {
+	clearInventoryTable(t)
+	clearProgressTable(t)
+
+	// Add wood to inventory
+	payload := []byte(`{"items":[{"item_id":1,"quantity":4}]}`)
+
+	req, err := http.NewRequest(http.MethodPost, "/api/v1/inventory",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	// Charcoal is crafted in the furnace
+	payload = []byte(`{"item_id":12,"count":1}`)
+
+	req, err = http.NewRequest(http.MethodPost, "/api/v1/inventory/craft",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusForbidden, res.Code)
+}
+
+/* Check items not crafted on a machine are not accepted for crafting */
+func TestCraftInvalidItem(t *testing.T) {
+	clearInventoryTable(t)
+
+	// Wood is a primary resource, Furnace is built from a blueprint
+	for _, payload := range [][]byte{[]byte(`{"item_id":1,"count":1}`),
+		[]byte(`{"item_id":11,"count":1}`), []byte(`{"item_id":33,"count":1}`),
+		[]byte(`{"item_id":12,"count":0}`)} {
+		req, err := http.NewRequest(http.MethodPost, "/api/v1/inventory/craft",
+			bytes.NewBuffer(payload))
+		req.Header.Set("Authorization", ACCESS_TOKEN)
+		if err != nil {
+			t.Errorf("Failed to create request")
+		}
+
+		res := executeRequest(req)
+		checkResponseCode(t, http.StatusBadRequest, res.Code)
+	}
+}
+
+/* Check crafting consumes the recipe inputs and adds the output */
+func TestCraftItem(t *testing.T) {
+	clearInventoryTable(t)
+	clearProgressTable(t)
+
+	_, err := testA.DB.Exec("INSERT INTO progress VALUES (3149194563, 11)")
+	if err != nil {
+		t.Errorf("Failed to add furnace to progress")
+	}
+
+	// Add wood to inventory
+	payload := []byte(`{"items":[{"item_id":1,"quantity":4}]}`)
+
+	req, err := http.NewRequest(http.MethodPost, "/api/v1/inventory",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	// Craft more charcoal than there is wood for
+	payload = []byte(`{"item_id":12,"count":5}`)
+
+	req, err = http.NewRequest(http.MethodPost, "/api/v1/inventory/craft",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, res.Code)
+
+	// Craft charcoal
+	payload = []byte(`{"item_id":12,"count":3}`)
+
+	req, err = http.NewRequest(http.MethodPost, "/api/v1/inventory/craft",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	// Get items from inventory
+	req, err = http.NewRequest(http.MethodGet, "/api/v1/inventory", nil)
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	// Check one wood remains and three charcoal were added
+	var inv stock.Inventory
+	err = json.NewDecoder(res.Body).Decode(&inv)
+	if err != nil {
+		t.Errorf("Failed to decode inventory response")
+	}
+	if len(inv.Items) != 2 {
+		t.Fatalf("Expected two items. Actual number was %d", len(inv.Items))
+	}
+	if inv.Items[0].ItemID != 1 || inv.Items[0].Quantity != 1 {
+		t.Errorf("Expected 1 wood. Actual was item %d with quantity %d",
+			inv.Items[0].ItemID, inv.Items[0].Quantity)
+	}
+	if inv.Items[1].ItemID != 12 || inv.Items[1].Quantity != 3 {
+		t.Errorf("Expected 3 charcoal. Actual was item %d with quantity %d",
+			inv.Items[1].ItemID, inv.Items[1].Quantity)
+	}
+
+	clearProgressTable(t)
+}
+
+/* Check a job takes its inputs and fuel, keeps the machine busy and can only
+** be collected once finished */
+func TestCollectJob(t *testing.T) {
+	clearJobTables(t)
+	clearInventoryTable(t)
+	clearProgressTable(t)
+
+	addTestItems(t, ACCESS_TOKEN, []byte(`{"items":[{"item_id":1,"quantity":10}]}`))
+
+	// The furnace has not been built
+	payload := []byte(`{"item_id":12,"count":3,"fuel_id":1}`)
+	res := sendTestJob(t, "/api/v1/inventory/jobs", payload)
+	checkResponseCode(t, http.StatusForbidden, res.Code)
+
+	_, err := testA.DB.Exec("INSERT INTO progress VALUES (3149194563, 11)")
+	if err != nil {
+		t.Errorf("Failed to add furnace to progress")
+	}
+
+	// Stone is not furnace fuel
+	res = sendTestJob(t, "/api/v1/inventory/jobs",
+		[]byte(`{"item_id":12,"count":3,"fuel_id":2}`))
+	checkResponseCode(t, http.StatusBadRequest, res.Code)
+
+	// Burn 3 wood to make 3 charcoal from 3 wood
+	res = sendTestJob(t, "/api/v1/inventory/jobs", payload)
+	checkResponseCode(t, http.StatusOK, res.Code)
+	var jobRes JobResponse
+	err = json.NewDecoder(res.Body).Decode(&jobRes)
+	if err != nil {
+		t.Errorf("Failed to decode job response")
+	}
+	if jobRes.Status != JOB_RUNNING || jobRes.MachineID != 11 ||
+		jobRes.FinishTime <= jobRes.StartTime {
+		t.Errorf("Expected a running furnace job. Actual was %v", jobRes)
+	}
+	if inv := getTestInventory(t, ACCESS_TOKEN); inv[1] != 4 {
+		t.Errorf("Expected 4 wood to remain. Actual was %d", inv[1])
+	}
+
+	// The furnace is busy and the job has not finished
+	res = sendTestJob(t, "/api/v1/inventory/jobs",
+		[]byte(`{"item_id":12,"count":1,"fuel_id":1}`))
+	checkResponseCode(t, http.StatusConflict, res.Code)
+	collectURL := fmt.Sprintf("/api/v1/inventory/jobs/%d/collect",
+		jobRes.JobID)
+	res = sendTestJob(t, collectURL, nil)
+	checkResponseCode(t, http.StatusConflict, res.Code)
+
+	_, err = testA.DB.Exec("UPDATE job SET finish_time=1 WHERE job_id=?",
+		jobRes.JobID)
+	if err != nil {
+		t.Errorf("Failed to finish job")
+	}
+
+	// Finished jobs are listed as complete and cannot be cancelled
+	req, err := http.NewRequest(http.MethodGet,
+		"/api/v1/inventory/jobs?status=complete", nil)
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+	var jobsRes JobsResponse
+	err = json.NewDecoder(res.Body).Decode(&jobsRes)
+	if err != nil {
+		t.Errorf("Failed to decode jobs response")
+	}
+	if len(jobsRes.Jobs) != 1 || jobsRes.Jobs[0].JobID != jobRes.JobID {
+		t.Errorf("Expected the job to be complete")
+	}
+	res = sendTestJob(t, fmt.Sprintf("/api/v1/inventory/jobs/%d/cancel",
+		jobRes.JobID), nil)
+	checkResponseCode(t, http.StatusConflict, res.Code)
+
+	res = sendTestJob(t, collectURL, nil)
+	checkResponseCode(t, http.StatusOK, res.Code)
+	if inv := getTestInventory(t, ACCESS_TOKEN); inv[12] != 3 {
+		t.Errorf("Expected 3 charcoal. Actual was %d", inv[12])
+	}
+	res = sendTestJob(t, collectURL, nil)
+	checkResponseCode(t, http.StatusConflict, res.Code)
+
+	clearProgressTable(t)
+}
+
+/* Check cancelling a job refunds its inputs and fuel and frees the machine */
+func TestCancelJob(t *testing.T) {
+	clearJobTables(t)
+	clearInventoryTable(t)
+	clearProgressTable(t)
+
+	_, err := testA.DB.Exec("INSERT INTO progress VALUES (3149194563, 11)")
+	if err != nil {
+		t.Errorf("Failed to add furnace to progress")
+	}
+	addTestItems(t, ACCESS_TOKEN, []byte(`{"items":[{"item_id":1,"quantity":2},{"item_id":8,"quantity":5}]}`))
+
+	// Not enough wood to fuel 5 glass
+	payload := []byte(`{"item_id":16,"count":5,"fuel_id":1}`)
+	res := sendTestJob(t, "/api/v1/inventory/jobs", payload)
+	checkResponseCode(t, http.StatusConflict, res.Code)
+
+	payload = []byte(`{"item_id":16,"count":2,"fuel_id":1}`)
+	res = sendTestJob(t, "/api/v1/inventory/jobs", payload)
+	checkResponseCode(t, http.StatusOK, res.Code)
+	var jobRes JobResponse
+	err = json.NewDecoder(res.Body).Decode(&jobRes)
+	if err != nil {
+		t.Errorf("Failed to decode job response")
+	}
+
+	// Another user cannot cancel the job
+	req, err := http.NewRequest(http.MethodPost,
+		fmt.Sprintf("/api/v1/inventory/jobs/%d/cancel", jobRes.JobID), nil)
+	req.Header.Set("Authorization", PLAYER_ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, res.Code)
+
+	res = sendTestJob(t, fmt.Sprintf("/api/v1/inventory/jobs/%d/cancel",
+		jobRes.JobID), nil)
+	checkResponseCode(t, http.StatusOK, res.Code)
+	inv := getTestInventory(t, ACCESS_TOKEN)
+	if inv[1] != 2 || inv[8] != 5 || inv[16] != 0 {
+		t.Errorf("Expected the wood and sand to be refunded. Actual was %v",
+			inv)
+	}
+
+	// The furnace is free again
+	res = sendTestJob(t, "/api/v1/inventory/jobs", payload)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	clearProgressTable(t)
+}
+
+/* Check only developers set exchange rates, and players exchange within the
+** daily limit */
+func TestExchange(t *testing.T) {
+	clearExchangeTables(t)
+	clearInventoryTable(t)
+
+	// 10 stone (2) for a diamond (7), twice a day
+	rate := []byte(`{"from_item_id":2,"from_quantity":10,"to_item_id":7,"to_quantity":1,"daily_limit":2}`)
+	res := sendTestRequest(t, PLAYER_ACCESS_TOKEN, http.MethodPut,
+		"/api/v1/inventory/exchange/rates", rate)
+	checkResponseCode(t, http.StatusUnauthorized, res.Code)
+	res = sendTestRequest(t, ACCESS_TOKEN, http.MethodPut,
+		"/api/v1/inventory/exchange/rates",
+		[]byte(`{"from_item_id":2,"from_quantity":10,"to_item_id":2,"to_quantity":1}`))
+	checkResponseCode(t, http.StatusBadRequest, res.Code)
+	res = sendTestRequest(t, ACCESS_TOKEN, http.MethodPut,
+		"/api/v1/inventory/exchange/rates", rate)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	addTestItems(t, PLAYER_ACCESS_TOKEN, []byte(`{"items":[{"item_id":2,"quantity":30}]}`))
+
+	exchange := func(payload string) *httptest.ResponseRecorder {
+		return sendTestRequest(t, PLAYER_ACCESS_TOKEN, http.MethodPost,
+			"/api/v1/inventory/exchange", []byte(payload))
+	}
+	res = exchange(`{"from_item_id":2,"to_item_id":7,"count":3}`)
+	checkResponseCode(t, http.StatusConflict, res.Code)
+	res = exchange(`{"from_item_id":7,"to_item_id":2,"count":1}`)
+	checkResponseCode(t, http.StatusNotFound, res.Code)
+
+	res = exchange(`{"from_item_id":2,"to_item_id":7,"count":2}`)
+	checkResponseCode(t, http.StatusOK, res.Code)
+	var exchangeRes ExchangeResponse
+	err := json.NewDecoder(res.Body).Decode(&exchangeRes)
+	if err != nil {
+		t.Errorf("Failed to decode exchange response")
+	}
+	if exchangeRes.Given.Quantity != 20 || exchangeRes.Received.Quantity != 2 ||
+		exchangeRes.Remaining == nil || *exchangeRes.Remaining != 0 {
+		t.Errorf("Expected 20 stone for 2 diamonds with none left today")
+	}
+	inv := getTestInventory(t, PLAYER_ACCESS_TOKEN)
+	if inv[2] != 10 || inv[7] != 2 {
+		t.Errorf("Expected 10 stone and 2 diamonds. Actual was %d and %d",
+			inv[2], inv[7])
+	}
+
+	// The daily limit has been reached
+	res = exchange(`{"from_item_id":2,"to_item_id":7,"count":1}`)
+	checkResponseCode(t, http.StatusConflict, res.Code)
+
+	req, err := http.NewRequest(http.MethodGet,
+		"/api/v1/inventory/exchange/rates", nil)
+	req.Header.Set("Authorization", PLAYER_ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+	var ratesRes ExchangeRatesResponse
+	err = json.NewDecoder(res.Body).Decode(&ratesRes)
+	if err != nil {
+		t.Errorf("Failed to decode exchange rates response")
+	}
+	if len(ratesRes.Rates) != 1 || ratesRes.Rates[0].Remaining == nil ||
+		*ratesRes.Rates[0].Remaining != 0 {
+		t.Errorf("Expected one rate with no exchanges left")
+	}
+
+	res = sendTestRequest(t, ACCESS_TOKEN, http.MethodDelete,
+		"/api/v1/inventory/exchange/rates/2/7", nil)
+	checkResponseCode(t, http.StatusOK, res.Code)
+	res = sendTestRequest(t, ACCESS_TOKEN, http.MethodDelete,
+		"/api/v1/inventory/exchange/rates/2/7", nil)
+	checkResponseCode(t, http.StatusNotFound, res.Code)
+}
+
+/* Check gifted items leave the sender at once and reach the recipient when
+** claimed */
+func TestClaimGift(t *testing.T) {
+	clearGiftTables(t)
+	clearInventoryTable(t)
+
+	addTestItems(t, ACCESS_TOKEN, []byte(`{"items":[{"item_id":1,"quantity":5}]}`))
+
+	// Gifts must be to another player, of items the sender has
+	res := sendTestRequest(t, ACCESS_TOKEN, http.MethodPost,
+		"/api/v1/inventory/gifts",
+		[]byte(`{"username":"Will","items":[{"item_id":1,"quantity":1}]}`))
+	checkResponseCode(t, http.StatusBadRequest, res.Code)
+	res = sendTestRequest(t, ACCESS_TOKEN, http.MethodPost,
+		"/api/v1/inventory/gifts",
+		[]byte(`{"username":"John","items":[{"item_id":1,"quantity":6}]}`))
+	checkResponseCode(t, http.StatusConflict, res.Code)
+
+	giftRes := createTestGift(t)
+	if giftRes.Sender != "Will" || giftRes.Recipient != "John" ||
+		giftRes.Status != GIFT_PENDING || giftRes.Message != "For your furnace" {
+		t.Errorf("Expected a pending gift from Will to John")
+	}
+	if inv := getTestInventory(t, ACCESS_TOKEN); inv[1] != 2 {
+		t.Errorf("Expected 2 wood to remain. Actual was %d", inv[1])
+	}
+
+	// The gift is in John's pending list
+	req, err := http.NewRequest(http.MethodGet,
+		"/api/v1/inventory/gifts?status=pending", nil)
+	req.Header.Set("Authorization", PLAYER_ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+	var giftsRes GiftsResponse
+	err = json.NewDecoder(res.Body).Decode(&giftsRes)
+	if err != nil {
+		t.Errorf("Failed to decode gifts response")
+	}
+	if len(giftsRes.Gifts) != 1 || giftsRes.Gifts[0].GiftID != giftRes.GiftID {
+		t.Errorf("Expected the gift to be pending")
+	}
+
+	// Only the recipient may claim, and only once
+	claimURL := fmt.Sprintf("/api/v1/inventory/gifts/%d/claim", giftRes.GiftID)
+	res = sendTestRequest(t, ACCESS_TOKEN, http.MethodPost, claimURL, nil)
+	checkResponseCode(t, http.StatusNotFound, res.Code)
+	res = sendTestRequest(t, PLAYER_ACCESS_TOKEN, http.MethodPost, claimURL,
+		nil)
+	checkResponseCode(t, http.StatusOK, res.Code)
+	if inv := getTestInventory(t, PLAYER_ACCESS_TOKEN); inv[1] != 3 {
+		t.Errorf("Expected John to have 3 wood. Actual was %d", inv[1])
+	}
+	res = sendTestRequest(t, PLAYER_ACCESS_TOKEN, http.MethodPost, claimURL,
+		nil)
+	checkResponseCode(t, http.StatusConflict, res.Code)
+}
+
+/* Check unclaimed gifts are returned to the sender once expired */
+func TestMaintenanceExpireGifts(t *testing.T) {
+	clearGiftTables(t)
+	clearInventoryTable(t)
+
+	addTestItems(t, ACCESS_TOKEN, []byte(`{"items":[{"item_id":1,"quantity":5}]}`))
+	giftRes := createTestGift(t)
+
+	_, err := testA.DB.Exec("UPDATE gift SET gift_expire=1 WHERE gift_id=?",
+		giftRes.GiftID)
+	if err != nil {
+		t.Errorf("Failed to expire gift")
+	}
+
+	// Expired gifts cannot be claimed, even before the job has run
+	res := sendTestRequest(t, PLAYER_ACCESS_TOKEN, http.MethodPost,
+		fmt.Sprintf("/api/v1/inventory/gifts/%d/claim", giftRes.GiftID), nil)
+	checkResponseCode(t, http.StatusGone, res.Code)
+
+	err = testA.Maintenance.Run()
+	if err != nil {
+		t.Errorf("Maintenance run failed: %s", err)
+	}
+
+	if inv := getTestInventory(t, ACCESS_TOKEN); inv[1] != 5 {
+		t.Errorf("Expected the gifted wood to be returned. Actual was %d",
+			inv[1])
+	}
+	var status string
+	err = testA.DB.QueryRow("SELECT status FROM gift WHERE gift_id=?",
+		giftRes.GiftID).Scan(&status)
+	if err != nil || status != GIFT_EXPIRED {
+		t.Errorf("Expected the gift to be expired")
+	}
+}
+
+/* Check a gift which cannot be returned to its sender is left pending without
+** holding back the other expired gifts */
+func TestMaintenanceExpireGiftsSkipsFailed(t *testing.T) {
+	clearGiftTables(t)
+	clearInventoryTable(t)
+
+	addTestItems(t, ACCESS_TOKEN, []byte(`{"items":[{"item_id":1,"quantity":5}]}`))
+	giftRes := createTestGift(t)
+
+	// Returning the stone of the second gift would pass the largest quantity
+	failedID := uint32(1)
+	if giftRes.GiftID == failedID {
+		failedID = 2
+	}
+	_, err := testA.DB.Exec("INSERT INTO inventory VALUES (3149194563, 2, 4294967295)")
+	if err != nil {
+		t.Errorf("Failed to add inventory")
+	}
+	_, err = testA.DB.Exec("INSERT INTO gift VALUES (?, 3149194563, 2121631167, '', ?, 1)",
+		failedID, GIFT_PENDING)
+	if err != nil {
+		t.Errorf("Failed to add gift")
+	}
+	_, err = testA.DB.Exec("INSERT INTO gift_item VALUES (?, 2, 1)", failedID)
+	if err != nil {
+		t.Errorf("Failed to add gift item")
+	}
+	_, err = testA.DB.Exec("UPDATE gift SET gift_expire=1 WHERE gift_id=?",
+		giftRes.GiftID)
+	if err != nil {
+		t.Errorf("Failed to expire gift")
+	}
+
+	err = testA.Maintenance.Run()
+	if err != nil {
+		t.Errorf("Maintenance run failed: %s", err)
+	}
+
+	inv := getTestInventory(t, ACCESS_TOKEN)
+	if inv[1] != 5 || inv[2] != 4294967295 {
+		t.Errorf("Expected only the wood to be returned. Actual was %d wood and %d stone",
+			inv[1], inv[2])
+	}
+	statuses := map[uint32]string{
+		giftRes.GiftID: GIFT_EXPIRED,
+		failedID:       GIFT_PENDING,
+	}
+	for giftID, expected := range statuses {
+		var status string
+		err = testA.DB.QueryRow("SELECT status FROM gift WHERE gift_id=?",
+			giftID).Scan(&status)
+		if err != nil || status != expected {
+			t.Errorf("Expected gift %d to be %s. Actual was %s", giftID,
+				expected, status)
+		}
+	}
+}
+
+/* Check the offered items are held in escrow and swapped on acceptance */
+func TestAcceptTrade(t *testing.T) {
+	clearTradeTables(t)
+	clearInventoryTable(t)
+
+	addTestItems(t, ACCESS_TOKEN, []byte(`{"items":[{"item_id":1,"quantity":5}]}`))
+	addTestItems(t, PLAYER_ACCESS_TOKEN, []byte(`{"items":[{"item_id":2,"quantity":3}]}`))
+
+	tradeRes := createTestTrade(t)
+	if tradeRes.Sender != "Will" || tradeRes.Recipient != "John" ||
+		tradeRes.Status != TRADE_PENDING {
+		t.Errorf("Expected a pending trade from Will to John")
+	}
+
+	// The offered wood is in escrow
+	inv := getTestInventory(t, ACCESS_TOKEN)
+	if inv[1] != 1 {
+		t.Errorf("Expected 1 wood to remain. Actual was %d", inv[1])
+	}
+
+	// Only the recipient may accept
+	res := closeTestTrade(t, ACCESS_TOKEN, tradeRes.TradeID, "accept")
+	checkResponseCode(t, http.StatusNotFound, res.Code)
+
+	res = closeTestTrade(t, PLAYER_ACCESS_TOKEN, tradeRes.TradeID, "accept")
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	inv = getTestInventory(t, ACCESS_TOKEN)
+	if inv[1] != 1 || inv[2] != 2 {
+		t.Errorf("Expected Will to have 1 wood and 2 stone. Actual was %d and %d",
+			inv[1], inv[2])
+	}
+	inv = getTestInventory(t, PLAYER_ACCESS_TOKEN)
+	if inv[1] != 4 || inv[2] != 1 {
+		t.Errorf("Expected John to have 4 wood and 1 stone. Actual was %d and %d",
+			inv[1], inv[2])
+	}
+
+	// A trade can only be closed once
+	res = closeTestTrade(t, PLAYER_ACCESS_TOKEN, tradeRes.TradeID, "accept")
+	checkResponseCode(t, http.StatusConflict, res.Code)
+
+	// The sender's devices are told of the stone received
+	var payload string
+	var version uint64
+	stmt := "SELECT payload, version FROM event WHERE user_id=3149194563 AND event_type=? ORDER BY event_id DESC LIMIT 1"
+	err := testA.DB.QueryRow(stmt, stock.EVENT_INVENTORY).Scan(&payload, &version)
+	if err != nil {
+		t.Fatalf("Expected an inventory event for Will")
+	}
+	var event stock.InventoryEvent
+	err = json.Unmarshal([]byte(payload), &event)
+	if err != nil || event.Source != fmt.Sprintf("trade:%d", tradeRes.TradeID) ||
+		len(event.Items) != 1 || event.Items[0].ItemID != 2 ||
+		event.Items[0].Delta != 2 || version == 0 {
+		t.Errorf("Expected an event for 2 stone from the trade. Actual was %s",
+			payload)
+	}
+}
+
+/* Check a trade cannot be accepted without the requested items, and that
+** rejecting it returns the escrowed items */
+func TestRejectTrade(t *testing.T) {
+	clearTradeTables(t)
+	clearInventoryTable(t)
+
+	addTestItems(t, ACCESS_TOKEN, []byte(`{"items":[{"item_id":1,"quantity":5}]}`))
+	addTestItems(t, PLAYER_ACCESS_TOKEN, []byte(`{"items":[{"item_id":2,"quantity":1}]}`))
+
+	tradeRes := createTestTrade(t)
+
+	res := closeTestTrade(t, PLAYER_ACCESS_TOKEN, tradeRes.TradeID, "accept")
+	checkResponseCode(t, http.StatusConflict, res.Code)
+
+	// Only the sender may cancel
+	res = closeTestTrade(t, PLAYER_ACCESS_TOKEN, tradeRes.TradeID, "cancel")
+	checkResponseCode(t, http.StatusNotFound, res.Code)
+
+	res = closeTestTrade(t, PLAYER_ACCESS_TOKEN, tradeRes.TradeID, "reject")
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	inv := getTestInventory(t, ACCESS_TOKEN)
+	if inv[1] != 5 {
+		t.Errorf("Expected the escrowed wood to be returned. Actual was %d",
+			inv[1])
+	}
+	inv = getTestInventory(t, PLAYER_ACCESS_TOKEN)
+	if inv[2] != 1 {
+		t.Errorf("Expected John's stone to be unchanged. Actual was %d", inv[2])
+	}
+}
+
+/* Check trades with unknown recipients, yourself or items the sender does
+** not have are not accepted */
+func TestCreateInvalidTrade(t *testing.T) {
+	clearTradeTables(t)
+	clearInventoryTable(t)
+
+	payloads := map[int][]byte{
+		http.StatusNotFound:   []byte(`{"username":"Nobody","offer":[{"item_id":1,"quantity":4}],"request":[{"item_id":2,"quantity":2}]}`),
+		http.StatusBadRequest: []byte(`{"username":"Will","offer":[{"item_id":1,"quantity":4}],"request":[{"item_id":2,"quantity":2}]}`),
+		http.StatusConflict:   []byte(`{"username":"John","offer":[{"item_id":1,"quantity":4}],"request":[{"item_id":2,"quantity":2}]}`),
+	}
+
+	for code, payload := range payloads {
+		req, err := http.NewRequest(http.MethodPost, "/api/v1/inventory/trades",
+			bytes.NewBuffer(payload))
+		req.Header.Set("Authorization", ACCESS_TOKEN)
+		if err != nil {
+			t.Errorf("Failed to create request")
+		}
+
+		res := executeRequest(req)
+		checkResponseCode(t, code, res.Code)
+	}
+}
+
+/* Check trades are listed for both players and can be filtered by status */
+func TestGetTrades(t *testing.T) {
+	clearTradeTables(t)
+	clearInventoryTable(t)
+
+	addTestItems(t, ACCESS_TOKEN, []byte(`{"items":[{"item_id":1,"quantity":8}]}`))
+	first := createTestTrade(t)
+	createTestTrade(t)
+	res := closeTestTrade(t, ACCESS_TOKEN, first.TradeID, "cancel")
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	for _, token := range []string{ACCESS_TOKEN, PLAYER_ACCESS_TOKEN} {
+		req, err := http.NewRequest(http.MethodGet,
+			"/api/v1/inventory/trades?status=pending", nil)
+		req.Header.Set("Authorization", token)
+		if err != nil {
+			t.Errorf("Failed to create request")
+		}
+
+		res = executeRequest(req)
+		checkResponseCode(t, http.StatusOK, res.Code)
+
+		var tradesRes TradesResponse
+		err = json.NewDecoder(res.Body).Decode(&tradesRes)
+		if err != nil {
+			t.Errorf("Failed to decode trades response")
+		}
+		if len(tradesRes.Trades) != 1 {
+			t.Fatalf("Expected one pending trade. Actual number was %d",
+				len(tradesRes.Trades))
+		}
+		if len(tradesRes.Trades[0].Offer) != 1 ||
+			tradesRes.Trades[0].Offer[0].Quantity != 4 {
+			t.Errorf("Expected the trade to offer 4 wood")
+		}
+	}
+}
+
+/* Check expired trades return their escrowed items to the sender */
+func TestMaintenanceExpireTrades(t *testing.T) {
+	clearTradeTables(t)
+	clearInventoryTable(t)
+
+	addTestItems(t, ACCESS_TOKEN, []byte(`{"items":[{"item_id":1,"quantity":5}]}`))
+	addTestItems(t, PLAYER_ACCESS_TOKEN, []byte(`{"items":[{"item_id":2,"quantity":3}]}`))
+	tradeRes := createTestTrade(t)
+
+	_, err := testA.DB.Exec("UPDATE trade SET trade_expire=1 WHERE trade_id=?",
+		tradeRes.TradeID)
+	if err != nil {
+		t.Errorf("Failed to expire trade")
+	}
+
+	// Expired trades cannot be accepted, even before the job has run
+	res := closeTestTrade(t, PLAYER_ACCESS_TOKEN, tradeRes.TradeID, "accept")
+	checkResponseCode(t, http.StatusGone, res.Code)
+
+	err = testA.Maintenance.Run()
+	if err != nil {
+		t.Errorf("Maintenance run failed: %s", err)
+	}
+
+	inv := getTestInventory(t, ACCESS_TOKEN)
+	if inv[1] != 5 {
+		t.Errorf("Expected the escrowed wood to be returned. Actual was %d",
+			inv[1])
+	}
+	var status string
+	err = testA.DB.QueryRow("SELECT status FROM trade WHERE trade_id=?",
+		tradeRes.TradeID).Scan(&status)
+	if err != nil || status != TRADE_EXPIRED {
+		t.Errorf("Expected the trade to be expired")
+	}
+}
+
+/* Get a page of a ledger through the API */
+func getTestLedger(t *testing.T, token, target string) LedgerResponse {
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set("Authorization", token)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var ledgerRes LedgerResponse
+	err = json.NewDecoder(res.Body).Decode(&ledgerRes)
+	if err != nil {
+		t.Errorf("Failed to decode ledger response")
+	}
+	return ledgerRes
+}
+
+/* Check inventory changes are recorded in the ledger, newest first, and can
+** be paged through */
+func TestLedger(t *testing.T) {
+	clearLedgerTable(t)
+	clearInventoryTable(t)
+
+	addTestItems(t, ACCESS_TOKEN, []byte(`{"items":[{"item_id":1,"quantity":5}]}`))
+
+	payload := []byte(`{"items":[{"item_id":1,"quantity":2}]}`)
+	req, err := http.NewRequest(http.MethodDelete, "/api/v1/inventory/items",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	req, err = http.NewRequest(http.MethodDelete, "/api/v1/inventory", nil)
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	// Page through the three entries two at a time
+	first := getTestLedger(t, ACCESS_TOKEN, "/api/v1/inventory/ledger?limit=2")
+	if len(first.Entries) != 2 || first.Next == 0 {
+		t.Fatalf("Expected a full first page. Actual length was %d",
+			len(first.Entries))
+	}
+	second := getTestLedger(t, ACCESS_TOKEN,
+		fmt.Sprintf("/api/v1/inventory/ledger?limit=2&before=%d", first.Next))
+	if len(second.Entries) != 1 || second.Next != 0 {
+		t.Fatalf("Expected a final page of one entry. Actual length was %d",
+			len(second.Entries))
+	}
+
+	entries := append(first.Entries, second.Entries...)
+	deltas := []int64{-3, -2, 5}
+	for i := 0; i < len(entries); i++ {
+		if entries[i].ItemID != 1 || entries[i].Delta != deltas[i] ||
+			entries[i].Reason != stock.LEDGER_CLIENT_SYNC {
+			t.Errorf("Expected a client-sync delta of %d. Actual was %d",
+				deltas[i], entries[i].Delta)
+		}
+	}
+}
+
+/* Check only developers can view the ledger of another user */
+func TestGetUserLedgerOnlyDeveloper(t *testing.T) {
+	clearLedgerTable(t)
+	clearInventoryTable(t)
+
+	addTestItems(t, PLAYER_ACCESS_TOKEN, []byte(`{"items":[{"item_id":1,"quantity":5}]}`))
+
+	req, err := http.NewRequest(http.MethodGet, "/api/v1/inventory/ledger/John",
+		nil)
+	req.Header.Set("Authorization", PLAYER_ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, res.Code)
+
+	ledgerRes := getTestLedger(t, ACCESS_TOKEN, "/api/v1/inventory/ledger/John")
+	if len(ledgerRes.Entries) != 1 || ledgerRes.Entries[0].Delta != 5 {
+		t.Errorf("Expected John's single ledger entry")
+	}
+
+	req, err = http.NewRequest(http.MethodGet, "/api/v1/inventory/ledger/Nobody",
+		nil)
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, res.Code)
+}
+
+/* Check retried adds with the same idempotency key are only applied once, and
+** are given the ETag of the first response */
+func TestAddInventoryIdempotent(t *testing.T) {
+	clearIdempotencyTable(t)
+	clearInventoryTable(t)
+
+	payload := []byte(`{"items":[{"item_id":1,"quantity":5}]}`)
+
+	var etag string
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequest(http.MethodPost, "/api/v1/inventory",
+			bytes.NewBuffer(payload))
+		req.Header.Set("Authorization", ACCESS_TOKEN)
+		req.Header.Set(idempotency.HEADER, "add-wood")
+		if err != nil {
+			t.Errorf("Failed to create request")
+		}
+
+		res := executeRequest(req)
+		checkResponseCode(t, http.StatusOK, res.Code)
+		if i == 0 {
+			etag = res.Header().Get("ETag")
+			continue
+		}
+		if res.Header().Get(idempotency.REPLAYED_HEADER) != "true" {
+			t.Errorf("Expected the response to be replayed")
+		}
+		if res.Header().Get("ETag") != etag || etag == "" {
+			t.Errorf("Expected the replayed ETag %s. Actual was %s", etag,
+				res.Header().Get("ETag"))
+		}
+	}
+
+	inv := getTestInventory(t, ACCESS_TOKEN)
+	if inv[1] != 5 {
+		t.Errorf("Expected 5 wood. Actual was %d", inv[1])
+	}
+
+	// Keys belong to a single user, so another user's add is applied
+	req, err := http.NewRequest(http.MethodPost, "/api/v1/inventory",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", PLAYER_ACCESS_TOKEN)
+	req.Header.Set(idempotency.HEADER, "add-wood")
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+	if res.Header().Get(idempotency.REPLAYED_HEADER) != "" {
+		t.Errorf("Expected another user's request not to be replayed")
+	}
+}
+
+/* Check a server error is replayed once the request has committed a change,
+** so a retry cannot apply it twice, but otherwise lets the request be retried,
+** as do claims left without a response */
+func TestIdempotentServerErrors(t *testing.T) {
+	clearIdempotencyTable(t)
+	clearInventoryTable(t)
+
+	applied := 0
+	router := mux.NewRouter()
+	router.Use(testA.Idempotency.Handler)
+	router.HandleFunc("/committed", func(w http.ResponseWriter, r *http.Request) {
+		applied++
+		tx, err := testA.DB.Begin()
+		if err != nil {
+			t.Fatalf("Failed to begin transaction")
+		}
+		defer tx.Rollback()
+		_, err = tx.Exec("INSERT INTO inventory VALUES (3149194563, 1, 1) ON DUPLICATE KEY UPDATE quantity=quantity+1")
+		if err != nil {
+			t.Errorf("Failed to add inventory")
+		}
+		err = idempotency.Commit(tx, r)
+		if err != nil {
+			t.Errorf("Failed to commit")
+		}
+		respondWithError(w, http.StatusInternalServerError, "Failed after commit")
+	}).Methods(http.MethodPost)
+	router.HandleFunc("/failed", func(w http.ResponseWriter, r *http.Request) {
+		applied++
+		respondWithError(w, http.StatusInternalServerError, "Failed")
+	}).Methods(http.MethodPost)
+
+	tests := []struct {
+		path     string
+		replayed string
+		applied  int
+	}{
+		{"/committed", "true", 1},
+		{"/failed", "", 2},
+	}
+	for _, test := range tests {
+		applied = 0
+		for i := 0; i < 2; i++ {
+			req, _ := http.NewRequest(http.MethodPost, test.path, nil)
+			req.Header.Set("Authorization", ACCESS_TOKEN)
+			req.Header.Set(idempotency.HEADER, "server-error"+test.path)
+			res := httptest.NewRecorder()
+			router.ServeHTTP(res, req)
+			checkResponseCode(t, http.StatusInternalServerError, res.Code)
+			replayed := res.Header().Get(idempotency.REPLAYED_HEADER)
+			if i == 1 && replayed != test.replayed {
+				t.Errorf("Expected replayed %q for %s. Actual was %q",
+					test.replayed, test.path, replayed)
+			}
+		}
+		if applied != test.applied {
+			t.Errorf("Expected %s to be applied %d times. Actual was %d",
+				test.path, test.applied, applied)
+		}
+	}
+
+	inv := getTestInventory(t, ACCESS_TOKEN)
+	if inv[1] != 1 {
+		t.Errorf("Expected 1 wood. Actual was %d", inv[1])
+	}
+
+	// A claim left without a response, as by a crashed request, expires
+	_, err := testA.DB.Exec("INSERT INTO idempotency (service, user_id, idem_key, fingerprint, response_code, committed, idempotency_expire) VALUES (?, 3149194563, 'crashed', '', 0, FALSE, 1)",
+		IDEMPOTENCY_SERVICE)
+	if err != nil {
+		t.Errorf("Failed to add claim")
+	}
+	applied = 0
+	req, _ := http.NewRequest(http.MethodPost, "/failed", nil)
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	req.Header.Set(idempotency.HEADER, "crashed")
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	checkResponseCode(t, http.StatusInternalServerError, res.Code)
+	if applied != 1 {
+		t.Errorf("Expected the expired claim to be replaced")
+	}
+}
+
+/* Check invalid idempotency keys are not accepted */
+func TestInvalidIdempotencyKey(t *testing.T) {
+	clearIdempotencyTable(t)
+
+	payload := []byte(`{"items":[{"item_id":1,"quantity":5}]}`)
+	req, err := http.NewRequest(http.MethodPost, "/api/v1/inventory",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	req.Header.Set(idempotency.HEADER, strings.Repeat("k", idempotency.MAX_KEY+1))
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, res.Code)
+}
+
+/* Check the inventory ETag changes with the inventory, and mutations with a
+** stale If-Match header are refused */
+func TestInventoryETag(t *testing.T) {
+	clearInventoryTable(t)
+
+	req, err := http.NewRequest(http.MethodGet, "/api/v1/inventory", nil)
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+	etag := res.Header().Get("ETag")
+	if etag == "" {
+		t.Errorf("Expected an ETag")
+	}
+
+	// Add items while the ETag is current
+	payload := []byte(`{"items":[{"item_id":1,"quantity":5}]}`)
+	req, err = http.NewRequest(http.MethodPost, "/api/v1/inventory",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	req.Header.Set("If-Match", etag)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+	newETag := res.Header().Get("ETag")
+	if newETag == "" || newETag == etag {
+		t.Errorf("Expected a new ETag. Actual was %s", newETag)
+	}
+
+	// The old ETag is now stale
+	req, err = http.NewRequest(http.MethodDelete, "/api/v1/inventory", nil)
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	req.Header.Set("If-Match", etag)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusPreconditionFailed, res.Code)
+	if res.Header().Get("ETag") != newETag {
+		t.Errorf("Expected the current ETag %s. Actual was %s", newETag,
+			res.Header().Get("ETag"))
+	}
+
+	inv := getTestInventory(t, ACCESS_TOKEN)
+	if inv[1] != 5 {
+		t.Errorf("Expected 5 wood. Actual was %d", inv[1])
+	}
+
+	// Changes made by other users do not change the ETag
+	addTestItems(t, PLAYER_ACCESS_TOKEN, payload)
+	req, err = http.NewRequest(http.MethodDelete, "/api/v1/inventory", nil)
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	req.Header.Set("If-Match", newETag)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+}
+
+/* Check only developers can view maintenance metrics */
+func TestGetMaintenanceOnlyDeveloper(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "/api/v1/inventory/maintenance",
+		nil)
+	req.Header.Set("Authorization", PLAYER_ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, res.Code)
+
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+}
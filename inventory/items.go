@@ -2,36 +2,57 @@ package main
 
 import (
 	"database/sql"
-	"strings"
+
+	"github.com/jaylees14/Manhattan-Server/stock"
 )
 
-type Inventory struct {
-	Items []Item `json:"items"`
-}
+/* Remove every item from user inventory within a transaction, returning the
+** items removed */
+func clearInventory(tx *sql.Tx, userID uint32) (stock.Inventory, error) {
+	var removed stock.Inventory
+	stmt := "SELECT item_id, quantity FROM inventory WHERE user_id=? FOR UPDATE"
+	rows, err := tx.Query(stmt, userID)
+	if err != nil {
+		return removed, err
+	}
+	for rows.Next() {
+		item := stock.Item{UserID: userID}
+		err = rows.Scan(&item.ItemID, &item.Quantity)
+		if err != nil {
+			rows.Close()
+			return removed, err
+		}
+		removed.Items = append(removed.Items, item)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return removed, err
+	}
 
-type Item struct {
-	UserID   uint32 `json:"user_id"`
-	ItemID   uint32 `json:"item_id"`
-	Quantity uint32 `json:"quantity"`
+	_, err = tx.Exec("DELETE FROM inventory WHERE user_id=?", userID)
+	if err != nil || len(removed.Items) == 0 {
+		return removed, err
+	}
+	return removed, stock.BumpVersion(tx, userID)
 }
 
-/* Add a variable number of items to user inventory, checking if an entry
-** exists for the given user ID, item ID pair. If one does exist, the
-** quantity is added to the existing entry, otherwise a new entry is added
- */
-func (inv *Inventory) AddInventory(db *sql.DB) error {
-	stmt := "INSERT INTO inventory VALUES"
-	values := []interface{}{}
-	for i := 0; i < len(inv.Items); i++ {
-		stmt += " (?, ?, ?),"
-		values = append(values, inv.Items[i].UserID, inv.Items[i].ItemID,
-			inv.Items[i].Quantity)
+/* Get the items in user inventory within a transaction */
+func getInventoryItems(tx *sql.Tx, userID uint32) ([]ItemResponse, error) {
+	items := make([]ItemResponse, 0)
+	stmt := "SELECT item_id, quantity FROM inventory WHERE user_id=?"
+	rows, err := tx.Query(stmt, userID)
+	if err != nil {
+		return items, err
 	}
-	// Remove the trailing comma
-	stmt = strings.TrimSuffix(stmt, ",")
-	stmt += " ON DUPLICATE KEY UPDATE quantity = quantity + VALUES (quantity)"
-
-	_, err := db.Exec(stmt, values...)
-
-	return err
+	defer rows.Close()
+	for rows.Next() {
+		var itemRes ItemResponse
+		err = rows.Scan(&itemRes.ItemID, &itemRes.Quantity)
+		if err != nil {
+			return items, err
+		}
+		items = append(items, itemRes)
+	}
+	return items, rows.Err()
 }
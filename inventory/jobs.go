@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jaylees14/Manhattan-Server/stock"
+)
+
+/* A job crafts items on a built machine over time. The recipe inputs and
+** fuel are taken from the user's inventory when the job starts, and the
+** output can be collected once the finish time has passed, whether or not
+** the user was online. A machine runs one job at a time */
+type Job struct {
+	JobID      uint32          `json:"job_id"`
+	UserID     uint32          `json:"user_id"`
+	MachineID  uint32          `json:"machine_id"`
+	ItemID     uint32          `json:"item_id"`
+	Count      uint32          `json:"count"`
+	FuelID     uint32          `json:"fuel_id"`
+	Status     string          `json:"status"`
+	StartTime  int64           `json:"start_time"`
+	FinishTime int64           `json:"finish_time"`
+	Inputs     stock.Inventory `json:"inputs"`
+	Fuel       stock.Inventory `json:"fuel"`
+}
+
+const (
+	JOB_RUNNING   = "running"
+	JOB_COMPLETE  = "complete"
+	JOB_COLLECTED = "collected"
+	JOB_CANCELLED = "cancelled"
+)
+
+// Longest a single job may run for
+const MAX_JOB_DURATION time.Duration = 7 * 24 * time.Hour
+
+/* Insert a running job and its items. The inputs and fuel must already have
+** been removed from the user's inventory in the same transaction */
+func (job *Job) CreateJob(tx *sql.Tx) error {
+	stmt := "INSERT INTO job VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	_, err := tx.Exec(stmt, job.JobID, job.UserID, job.MachineID, job.ItemID,
+		job.Count, job.FuelID, JOB_RUNNING, job.StartTime, job.FinishTime)
+	if err != nil {
+		return err
+	}
+	job.Status = JOB_RUNNING
+
+	itemStmt := "INSERT INTO job_item VALUES (?, ?, ?, ?)"
+	for i := 0; i < len(job.Inputs.Items); i++ {
+		_, err = tx.Exec(itemStmt, job.JobID, false,
+			job.Inputs.Items[i].ItemID, job.Inputs.Items[i].Quantity)
+		if err != nil {
+			return err
+		}
+	}
+	for i := 0; i < len(job.Fuel.Items); i++ {
+		_, err = tx.Exec(itemStmt, job.JobID, true, job.Fuel.Items[i].ItemID,
+			job.Fuel.Items[i].Quantity)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Get a job and its items, locking the job until the transaction ends so it
+** can only be collected or cancelled once */
+func (job *Job) LockJob(tx *sql.Tx) error {
+	stmt := "SELECT user_id, machine_id, item_id, count, fuel_id, status, start_time, finish_time FROM job WHERE job_id=? FOR UPDATE"
+	err := tx.QueryRow(stmt, job.JobID).Scan(&job.UserID, &job.MachineID,
+		&job.ItemID, &job.Count, &job.FuelID, &job.Status, &job.StartTime,
+		&job.FinishTime)
+	if err != nil {
+		return err
+	}
+
+	itemStmt := "SELECT fuel, item_id, quantity FROM job_item WHERE job_id=?"
+	rows, err := tx.Query(itemStmt, job.JobID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	return job.scanItems(rows)
+}
+
+/* Get the items of an unlocked job, for listing */
+func (job *Job) GetJobItems(db *sql.DB) error {
+	stmt := "SELECT fuel, item_id, quantity FROM job_item WHERE job_id=?"
+	rows, err := db.Query(stmt, job.JobID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	return job.scanItems(rows)
+}
+
+/* Split job item rows into the recipe inputs and the fuel */
+func (job *Job) scanItems(rows *sql.Rows) error {
+	job.Inputs.Items = make([]stock.Item, 0)
+	job.Fuel.Items = make([]stock.Item, 0)
+	for rows.Next() {
+		var fuel bool
+		item := stock.Item{UserID: job.UserID}
+		err := rows.Scan(&fuel, &item.ItemID, &item.Quantity)
+		if err != nil {
+			return err
+		}
+		if fuel {
+			job.Fuel.Items = append(job.Fuel.Items, item)
+		} else {
+			job.Inputs.Items = append(job.Inputs.Items, item)
+		}
+	}
+	return rows.Err()
+}
+
+func (job *Job) SetStatus(tx *sql.Tx, status string) error {
+	stmt := "UPDATE job SET status=? WHERE job_id=?"
+	_, err := tx.Exec(stmt, status, job.JobID)
+	if err == nil {
+		job.Status = status
+	}
+	return err
+}
+
+/* Running jobs are only reported complete once their finish time passes */
+func (job *Job) CurrentStatus(now int64) string {
+	if job.Status == JOB_RUNNING && job.FinishTime <= now {
+		return JOB_COMPLETE
+	}
+	return job.Status
+}
+
+/* The items crafted by the job */
+func (job *Job) Output() stock.Inventory {
+	return stock.Inventory{Items: []stock.Item{
+		{UserID: job.UserID, ItemID: job.ItemID, Quantity: job.Count},
+	}}
+}
+
+/* Give the inputs and fuel back to the user and cancel the job. They left
+** the user's inventory within its limits, so they are returned regardless of
+** the limits rather than being lost */
+func (job *Job) Refund(tx *sql.Tx) error {
+	for _, inv := range []stock.Inventory{job.Inputs, job.Fuel} {
+		if len(inv.Items) == 0 {
+			continue
+		}
+		err := inv.AddInventory(tx)
+		if err != nil {
+			return err
+		}
+		err = inv.LogAdded(tx, stock.LEDGER_CRAFTED, job.Source())
+		if err != nil {
+			return err
+		}
+	}
+	return job.SetStatus(tx, JOB_CANCELLED)
+}
+
+/* The ledger source of inventory changes made by the job */
+func (job *Job) Source() string {
+	return fmt.Sprintf("job:%d", job.JobID)
+}
+
+/* Check whether a user's machine is running a job, including finished jobs
+** which have not been collected */
+func checkMachineBusy(tx *sql.Tx, userID, machineID uint32) (bool, error) {
+	stmt := "SELECT COUNT(*) FROM job WHERE user_id=? AND machine_id=? AND status=?"
+	var count Count
+	err := tx.QueryRow(stmt, userID, machineID, JOB_RUNNING).Scan(
+		&count.Value)
+	return count.Value > 0, err
+}
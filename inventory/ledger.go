@@ -0,0 +1,43 @@
+package main
+
+import (
+	"database/sql"
+	"math"
+)
+
+/* An append-only record of a single change to user inventory */
+type LedgerEntry struct {
+	EntryID   uint64 `json:"entry_id"`
+	UserID    uint32 `json:"user_id"`
+	ItemID    uint32 `json:"item_id"`
+	Delta     int64  `json:"delta"`
+	Reason    string `json:"reason"`
+	Source    string `json:"source"`
+	EntryTime int64  `json:"entry_time"`
+}
+
+/* Get a page of a user's ledger, newest first. Entries before the given
+** entry ID are returned, or the newest entries if it is zero */
+func getLedger(db *sql.DB, userID uint32, before uint64,
+	limit int) ([]LedgerEntry, error) {
+	entries := make([]LedgerEntry, 0)
+	stmt := "SELECT entry_id, user_id, item_id, delta, reason, source, entry_time FROM ledger WHERE user_id=? AND entry_id<? ORDER BY entry_id DESC LIMIT ?"
+	if before == 0 {
+		before = math.MaxInt64
+	}
+	rows, err := db.Query(stmt, userID, before, limit)
+	if err != nil {
+		return entries, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entry LedgerEntry
+		err = rows.Scan(&entry.EntryID, &entry.UserID, &entry.ItemID,
+			&entry.Delta, &entry.Reason, &entry.Source, &entry.EntryTime)
+		if err != nil {
+			return entries, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/* Item details from the item schema, added to inventory responses when
+** expand=item is given */
+type ItemDetails struct {
+	Name      string `json:"name"`
+	Type      uint32 `json:"type"`
+	Craftable bool   `json:"craftable"`
+	Placeable bool   `json:"placeable"`
+}
+
+/* Options for listing an inventory, from the URL parameters:
+**   expand - "item" to add item details from the item schema
+**   type   - comma separated item types to keep
+**   sort   - "item_id", "name" or "quantity", prefixed with "-" to reverse */
+type InventoryQuery struct {
+	Expand     bool
+	Types      map[uint32]bool
+	Sort       string
+	Descending bool
+}
+
+const (
+	SORT_ITEM_ID  = "item_id"
+	SORT_NAME     = "name"
+	SORT_QUANTITY = "quantity"
+)
+
+func parseInventoryQuery(r *http.Request) (InventoryQuery, error) {
+	var query InventoryQuery
+	params := r.URL.Query()
+
+	switch params.Get("expand") {
+	case "":
+	case "item":
+		query.Expand = true
+	default:
+		return query, errors.New("Invalid expand option")
+	}
+
+	if param := params.Get("type"); param != "" {
+		query.Types = make(map[uint32]bool)
+		types := strings.Split(param, ",")
+		for i := 0; i < len(types); i++ {
+			itemType, err := strconv.ParseUint(strings.TrimSpace(types[i]), 10,
+				32)
+			if err != nil {
+				return query, errors.New("Invalid item type filter")
+			}
+			query.Types[uint32(itemType)] = true
+		}
+	}
+
+	query.Sort = params.Get("sort")
+	if strings.HasPrefix(query.Sort, "-") {
+		query.Sort = query.Sort[1:]
+		query.Descending = true
+	}
+	switch query.Sort {
+	case "", SORT_ITEM_ID, SORT_NAME, SORT_QUANTITY:
+	default:
+		return query, errors.New("Invalid sort option")
+	}
+	return query, nil
+}
+
+/* Filter, sort and expand inventory items. Items with the same sort key are
+** kept in item ID order */
+func (query *InventoryQuery) Apply(items []ItemResponse) []ItemResponse {
+	result := make([]ItemResponse, 0)
+	for i := 0; i < len(items); i++ {
+		item, _ := itemCatalog.Item(items[i].ItemID)
+		if query.Types != nil && !query.Types[item.Type] {
+			continue
+		}
+		if query.Expand {
+			items[i].Item = &ItemDetails{
+				Name:      item.Name,
+				Type:      item.Type,
+				Craftable: itemCatalog.IsCraftable(item.ItemID),
+				Placeable: itemCatalog.IsPlaceable(item.ItemID),
+			}
+		}
+		result = append(result, items[i])
+	}
+
+	if query.Sort == "" {
+		return result
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ItemID < result[j].ItemID
+	})
+	sort.SliceStable(result, func(i, j int) bool {
+		if query.Descending {
+			i, j = j, i
+		}
+		switch query.Sort {
+		case SORT_NAME:
+			a, _ := itemCatalog.Item(result[i].ItemID)
+			b, _ := itemCatalog.Item(result[j].ItemID)
+			return a.Name < b.Name
+		case SORT_QUANTITY:
+			return result[i].Quantity < result[j].Quantity
+		}
+		return result[i].ItemID < result[j].ItemID
+	})
+	return result
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/jaylees14/Manhattan-Server/stock"
+)
+
+/* A trade offers items from the sender for items from the recipient. The
+** offered items are held in escrow, outside the sender's inventory, until
+** the trade is accepted, rejected, cancelled or expires */
+type Trade struct {
+	TradeID     uint32          `json:"trade_id"`
+	SenderID    uint32          `json:"sender_id"`
+	RecipientID uint32          `json:"recipient_id"`
+	Status      string          `json:"status"`
+	TradeExpire int64           `json:"trade_expire"`
+	Offer       stock.Inventory `json:"offer"`
+	Request     stock.Inventory `json:"request"`
+}
+
+const (
+	TRADE_PENDING   = "pending"
+	TRADE_ACCEPTED  = "accepted"
+	TRADE_REJECTED  = "rejected"
+	TRADE_CANCELLED = "cancelled"
+	TRADE_EXPIRED   = "expired"
+)
+
+/* Insert a pending trade and its items. The offered items must already have
+** been removed from the sender's inventory in the same transaction */
+func (trade *Trade) CreateTrade(tx *sql.Tx) error {
+	stmt := "INSERT INTO trade VALUES (?, ?, ?, ?, ?)"
+	_, err := tx.Exec(stmt, trade.TradeID, trade.SenderID, trade.RecipientID,
+		TRADE_PENDING, trade.TradeExpire)
+	if err != nil {
+		return err
+	}
+	trade.Status = TRADE_PENDING
+
+	itemStmt := "INSERT INTO trade_item VALUES (?, ?, ?, ?)"
+	for i := 0; i < len(trade.Offer.Items); i++ {
+		_, err = tx.Exec(itemStmt, trade.TradeID, true,
+			trade.Offer.Items[i].ItemID, trade.Offer.Items[i].Quantity)
+		if err != nil {
+			return err
+		}
+	}
+	for i := 0; i < len(trade.Request.Items); i++ {
+		_, err = tx.Exec(itemStmt, trade.TradeID, false,
+			trade.Request.Items[i].ItemID, trade.Request.Items[i].Quantity)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Get a trade and its items, locking the trade until the transaction ends so
+** it can only change status once */
+func (trade *Trade) LockTrade(tx *sql.Tx) error {
+	stmt := "SELECT sender_id, recipient_id, status, trade_expire FROM trade WHERE trade_id=? FOR UPDATE"
+	err := tx.QueryRow(stmt, trade.TradeID).Scan(&trade.SenderID,
+		&trade.RecipientID, &trade.Status, &trade.TradeExpire)
+	if err != nil {
+		return err
+	}
+
+	itemStmt := "SELECT offered, item_id, quantity FROM trade_item WHERE trade_id=?"
+	rows, err := tx.Query(itemStmt, trade.TradeID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	return trade.scanItems(rows)
+}
+
+/* Get the items of an unlocked trade, for listing */
+func (trade *Trade) GetTradeItems(db *sql.DB) error {
+	stmt := "SELECT offered, item_id, quantity FROM trade_item WHERE trade_id=?"
+	rows, err := db.Query(stmt, trade.TradeID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	return trade.scanItems(rows)
+}
+
+/* Split trade item rows into the offer, owned by the sender, and the
+** request, owned by the recipient */
+func (trade *Trade) scanItems(rows *sql.Rows) error {
+	trade.Offer.Items = make([]stock.Item, 0)
+	trade.Request.Items = make([]stock.Item, 0)
+	for rows.Next() {
+		var offered bool
+		var item stock.Item
+		err := rows.Scan(&offered, &item.ItemID, &item.Quantity)
+		if err != nil {
+			return err
+		}
+		if offered {
+			item.UserID = trade.SenderID
+			trade.Offer.Items = append(trade.Offer.Items, item)
+		} else {
+			item.UserID = trade.RecipientID
+			trade.Request.Items = append(trade.Request.Items, item)
+		}
+	}
+	return rows.Err()
+}
+
+func (trade *Trade) SetStatus(tx *sql.Tx, status string) error {
+	stmt := "UPDATE trade SET status=? WHERE trade_id=?"
+	_, err := tx.Exec(stmt, status, trade.TradeID)
+	if err == nil {
+		trade.Status = status
+	}
+	return err
+}
+
+/* Give the escrowed items back to the sender and close the trade. Escrowed
+** items left the sender's inventory within its limits, so they are returned
+** regardless of the limits rather than being lost */
+func (trade *Trade) ReturnEscrow(tx *sql.Tx, status string) error {
+	if len(trade.Offer.Items) > 0 {
+		err := trade.Offer.AddInventory(tx)
+		if err != nil {
+			return err
+		}
+		err = trade.Offer.LogAdded(tx, stock.LEDGER_TRADED, trade.Source())
+		if err != nil {
+			return err
+		}
+	}
+	return trade.SetStatus(tx, status)
+}
+
+/* The ledger source of inventory changes made by the trade */
+func (trade *Trade) Source() string {
+	return fmt.Sprintf("trade:%d", trade.TradeID)
+}
+
+/* Expire a batch of pending trades past their expiry, returning the
+** escrowed items to each sender. Each trade is expired in its own
+** transaction, and a trade which cannot be returned is logged and left for
+** the next run rather than holding back the rest. Run by the maintenance job */
+func expireTrades(ctx context.Context, conn *sql.Conn, now int64,
+	batchSize int) (int64, error) {
+	stmt := "SELECT trade_id FROM trade WHERE status=? AND trade_expire < ? LIMIT ?"
+	rows, err := conn.QueryContext(ctx, stmt, TRADE_PENDING, now, batchSize)
+	if err != nil {
+		return 0, err
+	}
+	var trades []Trade
+	for rows.Next() {
+		var trade Trade
+		err = rows.Scan(&trade.TradeID)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		trades = append(trades, trade)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return 0, err
+	}
+
+	var expired int64
+	for i := 0; i < len(trades); i++ {
+		err = trades[i].expire(ctx, conn, now)
+		if err != nil {
+			log.Printf("trade %d not expired: %s", trades[i].TradeID, err)
+			continue
+		}
+		expired++
+	}
+	return expired, nil
+}
+
+/* Expire a trade and return its escrow, unless it was closed since it was
+** selected */
+func (trade *Trade) expire(ctx context.Context, conn *sql.Conn,
+	now int64) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = trade.LockTrade(tx)
+	if err != nil {
+		return err
+	}
+	if trade.Status != TRADE_PENDING || trade.TradeExpire >= now {
+		return nil
+	}
+	err = trade.ReturnEscrow(tx, TRADE_EXPIRED)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
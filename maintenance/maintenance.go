@@ -0,0 +1,174 @@
+package maintenance
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+)
+
+/* A purge task deletes stale rows from a table in batches, where the
+** statement takes the current time and the batch size as parameters. Tasks
+** which cannot be expressed as a single statement provide a function instead,
+** which handles one batch and returns the number of rows it dealt with */
+type PurgeTask struct {
+	Name string
+	Stmt string
+	Func func(ctx context.Context, conn *sql.Conn, now int64,
+		batchSize int) (int64, error)
+}
+
+type Metrics struct {
+	Runs         uint64           `json:"runs"`
+	SkippedRuns  uint64           `json:"skipped_runs"`
+	FailedRuns   uint64           `json:"failed_runs"`
+	LastRun      int64            `json:"last_run"`
+	LastDuration int64            `json:"last_duration"`
+	LastError    string           `json:"last_error"`
+	Purged       map[string]int64 `json:"purged"`
+}
+
+type Job struct {
+	DB        *sql.DB
+	LockName  string
+	BatchSize int
+	Tasks     []PurgeTask
+	mutex     sync.Mutex
+	metrics   Metrics
+}
+
+const BATCH_SIZE int = 1000
+
+/* Run the maintenance job every interval, a non-positive interval disables
+** the job */
+func (m *Job) Start(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			err := m.Run()
+			if err != nil {
+				log.Printf("maintenance %s failed: %s", m.LockName, err)
+			}
+		}
+	}()
+}
+
+/* Run each purge task once, provided the leader lock can be taken. MySQL
+** named locks belong to a single connection, so one connection is held for
+** the entire run */
+func (m *Job) Run() error {
+	ctx := context.Background()
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		m.recordFailure(err)
+		return err
+	}
+	defer conn.Close()
+
+	// Only one replica may hold the lock, the rest skip this run
+	var acquired sql.NullInt64
+	err = conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 0)",
+		m.LockName).Scan(&acquired)
+	if err != nil {
+		m.recordFailure(err)
+		return err
+	}
+	if !acquired.Valid || acquired.Int64 != 1 {
+		m.mutex.Lock()
+		m.metrics.SkippedRuns++
+		m.mutex.Unlock()
+		return nil
+	}
+	defer func() {
+		var released sql.NullInt64
+		conn.QueryRowContext(ctx, "SELECT RELEASE_LOCK(?)",
+			m.LockName).Scan(&released)
+	}()
+
+	start := time.Now()
+	purged := make(map[string]int64)
+	for i := 0; i < len(m.Tasks); i++ {
+		count, err := m.purge(ctx, conn, m.Tasks[i], start.UnixNano())
+		purged[m.Tasks[i].Name] += count
+		if err != nil {
+			m.recordFailure(err)
+			return err
+		}
+	}
+
+	// Update metrics
+	m.mutex.Lock()
+	m.metrics.Runs++
+	m.metrics.LastRun = start.UnixNano()
+	m.metrics.LastDuration = time.Since(start).Nanoseconds()
+	m.metrics.LastError = ""
+	if m.metrics.Purged == nil {
+		m.metrics.Purged = make(map[string]int64)
+	}
+	for name, count := range purged {
+		m.metrics.Purged[name] += count
+	}
+	m.mutex.Unlock()
+
+	log.Printf("maintenance %s purged %v in %s", m.LockName, purged,
+		time.Since(start))
+	return nil
+}
+
+/* Delete batches of stale rows until a batch comes back short */
+func (m *Job) purge(ctx context.Context, conn *sql.Conn,
+	task PurgeTask, now int64) (int64, error) {
+	batchSize := m.BatchSize
+	if batchSize <= 0 {
+		batchSize = BATCH_SIZE
+	}
+	var total int64
+	for {
+		var count int64
+		if task.Func != nil {
+			var err error
+			count, err = task.Func(ctx, conn, now, batchSize)
+			if err != nil {
+				return total, err
+			}
+		} else {
+			res, err := conn.ExecContext(ctx, task.Stmt, now, batchSize)
+			if err != nil {
+				return total, err
+			}
+			count, err = res.RowsAffected()
+			if err != nil {
+				return total, err
+			}
+		}
+		total += count
+		if count < int64(batchSize) {
+			return total, nil
+		}
+	}
+}
+
+/* Record a failed run */
+func (m *Job) recordFailure(err error) {
+	m.mutex.Lock()
+	m.metrics.FailedRuns++
+	m.metrics.LastError = err.Error()
+	m.mutex.Unlock()
+}
+
+/* Return a copy of the current metrics */
+func (m *Job) Metrics() Metrics {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	metrics := m.metrics
+	metrics.Purged = make(map[string]int64)
+	for name, count := range m.metrics.Purged {
+		metrics.Purged[name] = count
+	}
+	return metrics
+}
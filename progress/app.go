@@ -1,29 +1,42 @@
 package main
 
 import (
+	crand "crypto/rand"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	mrand "math/rand"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
+	"github.com/jaylees14/Manhattan-Server/catalog"
+	"github.com/jaylees14/Manhattan-Server/idempotency"
+	"github.com/jaylees14/Manhattan-Server/maintenance"
+	"github.com/jaylees14/Manhattan-Server/stock"
 )
 
 type App struct {
-	Router *mux.Router
-	DB     *sql.DB
+	Router            *mux.Router
+	DB                *sql.DB
+	Maintenance       *maintenance.Job
+	Idempotency       *idempotency.Middleware
+	EventPollInterval time.Duration
 }
 
 type ID struct {
 	Value uint32
 }
 
+type Count struct {
+	Value int
+}
+
 type AccountType struct {
 	Value string
 }
@@ -45,45 +58,120 @@ type LeaderboardElementResponse struct {
 	ItemID   uint32 `json:"item_id"`
 }
 
-type ItemSchema struct {
-	Items []SchemaItem `json:"items"`
+type BuildRequest struct {
+	ItemID uint32 `json:"item_id"`
+}
+
+type BuildResponse struct {
+	Built    BlueprintResponse `json:"built"`
+	Consumed []ItemResponse    `json:"consumed"`
+}
+
+type CraftResponse struct {
+	Crafted  ItemResponse   `json:"crafted"`
+	Consumed []ItemResponse `json:"consumed"`
+}
+
+type InventoryResponse struct {
+	Items []ItemResponse `json:"items"`
+}
+
+type SyncResponse struct {
+	Results   []SyncResult      `json:"results"`
+	Inventory InventoryResponse `json:"inventory"`
+	Progress  ProgressResponse  `json:"progress"`
 }
 
-type SchemaItem struct {
-	ItemID    uint32                  `json:"item_id"`
-	Name      string                  `json:"name"`
-	Type      uint32                  `json:"type"`
-	Blueprint []SchemaBlueprintRecipe `json:"blueprint"`
-	MachineID uint32                  `json:"machine_id"`
-	Recipe    []SchemaBlueprintRecipe `json:"recipe"`
-	Fuel      []SchemaFuel            `json:"fuel"`
+/* The results of a sync whose final inventory and progress could not be
+** read */
+type SyncErrorResponse struct {
+	Error   string       `json:"error"`
+	Results []SyncResult `json:"results"`
 }
 
-type SchemaBlueprintRecipe struct {
+type ItemResponse struct {
 	ItemID   uint32 `json:"item_id"`
 	Quantity uint32 `json:"quantity"`
 }
 
-type SchemaFuel struct {
-	ItemID uint32 `json:"item_id"`
+type ShortfallResponse struct {
+	Error      string            `json:"error"`
+	Shortfalls []stock.Shortfall `json:"shortfalls"`
+}
+
+type RejectionResponse struct {
+	Error    string              `json:"error"`
+	Rejected []catalog.Rejection `json:"rejected"`
+}
+
+type ClassRequest struct {
+	Name string `json:"name"`
+}
+
+type JoinRequest struct {
+	JoinCode string `json:"join_code"`
+}
+
+type ClassesResponse struct {
+	Classes []ClassResponse `json:"classes"`
+}
+
+type ClassResponse struct {
+	ClassID  uint32 `json:"class_id"`
+	Name     string `json:"name"`
+	JoinCode string `json:"join_code"`
+	Students int    `json:"students"`
+}
+
+type JoinResponse struct {
+	ClassID uint32 `json:"class_id"`
+	Name    string `json:"name"`
+}
+
+type ClassDetailResponse struct {
+	ClassID  uint32            `json:"class_id"`
+	Name     string            `json:"name"`
+	JoinCode string            `json:"join_code"`
+	Students []StudentResponse `json:"students"`
+}
+
+type StudentResponse struct {
+	Username   string                   `json:"username"`
+	Blueprints []BlueprintResponse      `json:"blueprints"`
+	Inventory  InventorySummaryResponse `json:"inventory"`
+}
+
+type InventorySummaryResponse struct {
+	DistinctItems uint32 `json:"distinct_items"`
+	TotalQuantity uint64 `json:"total_quantity"`
 }
 
 const BEARER_PREFIX string = "Bearer "
-const MAX_ITEM_ID uint32 = 32
-const ITEM_SCHEMA string = "serve/item-schema-v2.json"
-
-const (
-	TYPE_PRIMARY_RESOURCE      = 1
-	TYPE_BLUEPRINT_PLACEABLE   = 2
-	TYPE_MACHINERY_UNPLACEABLE = 3
-	TYPE_BLUEPRINT_UNPLACEABLE = 4
-	TYPE_INTANGIBLE            = 5
-)
 
-var itemSchema ItemSchema
-var itemTypeMap map[uint32]uint32
+// Stored idempotency keys are kept apart from those of other services
+const IDEMPOTENCY_SERVICE string = "progress"
+const MAX_CLASS_NAME int = 64
+
+// Join codes avoid characters that are easily confused, such as O and 0
+const JOIN_CODE_SIZE int = 8
+const JOIN_CODE_CHARACTERS string = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+var itemCatalog *catalog.Catalog
 
-/* Initialise database connection, mux router, routes and item schema */
+// Stale rows purged by the maintenance job
+var maintenanceTasks = []maintenance.PurgeTask{
+	{
+		Name: "idempotency",
+		Stmt: "DELETE FROM idempotency WHERE service='progress' AND idempotency_expire < ? LIMIT ?",
+	},
+	{
+		Name: "event",
+		Stmt: "DELETE FROM event WHERE event_expire < ? LIMIT ?",
+	},
+}
+
+/* Initialise database connection, maintenance job, mux router, routes, item
+** schema and inventory limits */
 func (a *App) Initialise(dbUser, dbPassword, dbHost, dbName string) error {
 	connectionString := fmt.Sprintf("%s:%s@tcp(%s)/%s", dbUser, dbPassword,
 		dbHost, dbName)
@@ -92,10 +180,30 @@ func (a *App) Initialise(dbUser, dbPassword, dbHost, dbName string) error {
 	if err != nil {
 		return err
 	}
+	a.Maintenance = &maintenance.Job{
+		DB:        a.DB,
+		LockName:  fmt.Sprintf("%s_progress_maintenance", dbName),
+		BatchSize: maintenance.BATCH_SIZE,
+		Tasks:     maintenanceTasks,
+	}
+	a.Idempotency = &idempotency.Middleware{
+		DB:      a.DB,
+		Service: IDEMPOTENCY_SERVICE,
+		TTL:     idempotency.TTL,
+		UserID: func(r *http.Request) (uint32, error) {
+			return getIDFromToken(a.DB, r)
+		},
+	}
+	a.EventPollInterval = EVENT_POLL_INTERVAL
 	a.Router = mux.NewRouter()
+	a.Router.Use(a.Idempotency.Handler)
 	a.initialiseRoutes()
 
-	err = GetItemSchema(ITEM_SCHEMA)
+	itemCatalog, err = catalog.Load(catalog.ITEM_SCHEMA)
+	if err != nil {
+		return err
+	}
+	err = itemCatalog.LoadLimits(catalog.ITEM_LIMITS)
 	if err != nil {
 		return err
 	}
@@ -108,27 +216,6 @@ func (a *App) Run(port int) error {
 	return http.ListenAndServe(fmt.Sprintf(":%s", strconv.Itoa(port)), a.Router)
 }
 
-func GetItemSchema(filename string) error {
-	file, err := os.Open(filename)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&itemSchema)
-	if err != nil {
-		return err
-	}
-
-	// Build type map
-	itemTypeMap = make(map[uint32]uint32)
-	for i := 0; i < len(itemSchema.Items); i++ {
-		itemTypeMap[itemSchema.Items[i].ItemID] = itemSchema.Items[i].Type
-	}
-
-	return nil
-}
-
 /* Map routes to functions */
 func (a *App) initialiseRoutes() {
 	prefix := "/api/v1"
@@ -136,15 +223,33 @@ func (a *App) initialiseRoutes() {
 		a.getProgress).Methods(http.MethodGet)
 	a.Router.HandleFunc(fmt.Sprintf("%s/progress", prefix),
 		a.addProgress).Methods(http.MethodPost)
+	a.Router.HandleFunc(fmt.Sprintf("%s/progress/build", prefix),
+		a.buildBlueprint).Methods(http.MethodPost)
 	a.Router.HandleFunc(fmt.Sprintf("%s/progress/leaderboard", prefix),
 		a.getLeaderboard).Methods(http.MethodGet)
 	a.Router.HandleFunc(fmt.Sprintf("%s/progress/desktop-state", prefix),
 		a.addDesktopState).Methods(http.MethodPost)
 	a.Router.HandleFunc(fmt.Sprintf("%s/progress/desktop-state", prefix),
 		a.getDesktopState).Methods(http.MethodGet)
-	// Serve item schema
+	a.Router.HandleFunc(fmt.Sprintf("%s/progress/classes", prefix),
+		a.addClass).Methods(http.MethodPost)
+	a.Router.HandleFunc(fmt.Sprintf("%s/progress/classes", prefix),
+		a.getClasses).Methods(http.MethodGet)
+	a.Router.HandleFunc(fmt.Sprintf("%s/progress/classes/join", prefix),
+		a.joinClass).Methods(http.MethodPost)
+	a.Router.HandleFunc(fmt.Sprintf("%s/progress/classes/{class_id:[0-9]+}",
+		prefix), a.getClass).Methods(http.MethodGet)
+	a.Router.HandleFunc(fmt.Sprintf("%s/progress/maintenance", prefix),
+		a.getMaintenance).Methods(http.MethodGet)
+	a.Router.HandleFunc(fmt.Sprintf("%s/sync", prefix),
+		a.syncOperations).Methods(http.MethodPost)
+	a.Router.HandleFunc(fmt.Sprintf("%s/events", prefix),
+		a.streamEvents).Methods(http.MethodGet)
+	// Serve item schema and inventory limits
 	a.Router.HandleFunc(fmt.Sprintf("%s/item-schema", prefix),
 		a.getItemSchema).Methods(http.MethodGet)
+	a.Router.HandleFunc(fmt.Sprintf("%s/item-limits", prefix),
+		a.getItemLimits).Methods(http.MethodGet)
 }
 
 /* Respond with a error JSON */
@@ -216,6 +321,21 @@ func getIDFromToken(db *sql.DB, r *http.Request) (uint32, error) {
 
 /* Validate user_id is a developer */
 func checkDeveloper(db *sql.DB, id uint32) error {
+	return checkAccountType(db, id, "developer")
+}
+
+/* Validate user_id is a lecturer */
+func checkLecturer(db *sql.DB, id uint32) error {
+	return checkAccountType(db, id, "lecturer")
+}
+
+/* Validate user_id is a player */
+func checkPlayer(db *sql.DB, id uint32) error {
+	return checkAccountType(db, id, "player")
+}
+
+/* Validate user_id has the given account type */
+func checkAccountType(db *sql.DB, id uint32, accountType string) error {
 	stmt := "SELECT account_type FROM account WHERE user_id=?"
 	var accType AccountType
 	err := db.QueryRow(stmt, id).Scan(&accType.Value)
@@ -223,12 +343,52 @@ func checkDeveloper(db *sql.DB, id uint32) error {
 		return errors.New("User not found")
 	}
 
-	if accType.Value != "developer" {
-		return errors.New("User must be a developer")
+	if accType.Value != accountType {
+		return fmt.Errorf("User must be a %s", accountType)
 	}
 	return nil
 }
 
+/* Generate a unique given target id in a given table */
+func generateID(db *sql.DB, table, targetID string) (uint32, error) {
+	seed := mrand.NewSource(time.Now().UnixNano())
+	random := mrand.New(seed)
+	stmt := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s=?", table, targetID)
+	var id uint32
+	idCount := Count{Value: 1}
+	for idCount.Value != 0 {
+		id = random.Uint32()
+		err := db.QueryRow(stmt, id).Scan(&idCount.Value)
+		if err != nil {
+			return id, err
+		}
+	}
+	return id, nil
+}
+
+/* Generate a unique class join code */
+func generateJoinCode(db *sql.DB) (string, error) {
+	stmt := "SELECT COUNT(*) FROM class WHERE join_code=?"
+	var code string
+	codeCount := Count{Value: 1}
+	for codeCount.Value != 0 {
+		b := make([]byte, JOIN_CODE_SIZE)
+		_, err := crand.Read(b)
+		if err != nil {
+			return code, err
+		}
+		for i := 0; i < len(b); i++ {
+			b[i] = JOIN_CODE_CHARACTERS[int(b[i])%len(JOIN_CODE_CHARACTERS)]
+		}
+		code = string(b)
+		err = db.QueryRow(stmt, code).Scan(&codeCount.Value)
+		if err != nil {
+			return code, err
+		}
+	}
+	return code, nil
+}
+
 /* Check sent blueprint list is valid */
 func checkValidProgress(pro Progress) error {
 	if len(pro.Blueprints) <= 0 {
@@ -236,15 +396,12 @@ func checkValidProgress(pro Progress) error {
 	}
 	// Check IDs exist and are blueprints
 	for i := 0; i < len(pro.Blueprints); i++ {
-		value, ok := itemTypeMap[pro.Blueprints[i].ItemID]
-		if ok {
-			if !(value == TYPE_BLUEPRINT_PLACEABLE ||
-				value == TYPE_BLUEPRINT_UNPLACEABLE) {
-				return errors.New("Invalid ID in blueprint list")
-			}
-		} else {
+		if !itemCatalog.IsValid(pro.Blueprints[i].ItemID) {
 			return errors.New("Out of range ID in blueprint list")
 		}
+		if !itemCatalog.IsBlueprint(pro.Blueprints[i].ItemID) {
+			return errors.New("Invalid ID in blueprint list")
+		}
 	}
 	return nil
 }
@@ -288,7 +445,9 @@ func (a *App) getProgress(w http.ResponseWriter, r *http.Request) {
 	respondWithJSON(w, http.StatusOK, proRes)
 }
 
-/* Add user progress */
+/* Validate auth token, check user is developer and add blueprint(s) to
+** their progress without building them. Players record progress through
+** progress/build */
 func (a *App) addProgress(w http.ResponseWriter, r *http.Request) {
 	id, err := getIDFromToken(a.DB, r)
 	if err != nil {
@@ -296,6 +455,12 @@ func (a *App) addProgress(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err = checkDeveloper(a.DB, id)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
 	// Decode json body into progress struct
 	decoder := json.NewDecoder(r.Body)
 	var pro Progress
@@ -326,6 +491,172 @@ func (a *App) addProgress(w http.ResponseWriter, r *http.Request) {
 	respondWithEmptyJSON(w, http.StatusOK)
 }
 
+/* Build a blueprint, consuming its components from user inventory and
+** recording the blueprint in progress in a single transaction */
+func (a *App) buildBlueprint(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromToken(a.DB, r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	// Decode json body into build request
+	decoder := json.NewDecoder(r.Body)
+	var buildReq BuildRequest
+	err = decoder.Decode(&buildReq)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid build request")
+		return
+	}
+
+	// Query database
+	tx, err := a.DB.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	if !stock.CheckIfMatch(w, r, tx, id) {
+		return
+	}
+
+	code, buildRes, err := buildItem(tx, id, buildReq.ItemID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if code != http.StatusOK {
+		respondWithJSON(w, code, buildRes)
+		return
+	}
+
+	version, err := stock.GetVersion(tx, id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = idempotency.Commit(tx, r)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("ETag", stock.FormatETag(version))
+
+	respondWithJSON(w, http.StatusOK, buildRes)
+}
+
+/* Build a blueprint within a transaction, returning the response code and
+** body for the build, or an error if it could not be attempted */
+func buildItem(tx *sql.Tx, id, itemID uint32) (int, interface{}, error) {
+	// Check the item is a blueprint
+	pro := Progress{Blueprints: []Blueprint{{UserID: id, ItemID: itemID}}}
+	err := checkValidProgress(pro)
+	if err != nil {
+		return errorResult(http.StatusBadRequest, err.Error())
+	}
+
+	// Get the blueprint components
+	item, _ := itemCatalog.Item(itemID)
+	var components stock.Inventory
+	buildRes := BuildResponse{
+		Built:    BlueprintResponse{ItemID: item.ItemID},
+		Consumed: make([]ItemResponse, 0),
+	}
+	for i := 0; i < len(item.Blueprint); i++ {
+		components.Items = append(components.Items, stock.Item{
+			UserID:   id,
+			ItemID:   item.Blueprint[i].ItemID,
+			Quantity: item.Blueprint[i].Quantity,
+		})
+		buildRes.Consumed = append(buildRes.Consumed, ItemResponse{
+			ItemID:   item.Blueprint[i].ItemID,
+			Quantity: item.Blueprint[i].Quantity,
+		})
+	}
+
+	shortfalls, err := components.RemoveInventory(tx)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(shortfalls) > 0 {
+		return http.StatusConflict, ShortfallResponse{
+			Error:      "Insufficient components in inventory",
+			Shortfalls: shortfalls,
+		}, nil
+	}
+	source := fmt.Sprintf("build:%d", item.ItemID)
+	err = components.LogRemoved(tx, stock.LEDGER_BUILT, source)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	err = pro.AddProgress(tx)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, buildRes, nil
+}
+
+/* Apply a batch of operations made offline in order, each under the same
+** validation as its own endpoint. Failed operations do not stop the rest of
+** the batch. Responds with the result of each operation and the final
+** inventory and progress, with the inventory version as an ETag */
+func (a *App) syncOperations(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromToken(a.DB, r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	// Decode json body into sync request
+	decoder := json.NewDecoder(r.Body)
+	var syncReq SyncRequest
+	err = decoder.Decode(&syncReq)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid operation list")
+		return
+	}
+
+	err = checkValidSync(syncReq)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Earlier operations stay committed when a later one fails, so failures
+	// are reported in its result rather than failing the whole request
+	results := make([]SyncResult, 0)
+	for i := 0; i < len(syncReq.Operations); i++ {
+		op := syncReq.Operations[i]
+		code, body, err := a.applyOperation(r, id, op)
+		if err != nil {
+			code = http.StatusInternalServerError
+			body = map[string]string{"error": err.Error()}
+		}
+		results = append(results, SyncResult{
+			Index:     i,
+			Type:      op.Type,
+			Timestamp: op.Timestamp,
+			Code:      code,
+			Response:  body,
+		})
+	}
+
+	syncRes, version, err := getSyncState(a.DB, id)
+	if err != nil {
+		respondWithJSON(w, http.StatusMultiStatus, SyncErrorResponse{
+			Error:   err.Error(),
+			Results: results,
+		})
+		return
+	}
+	syncRes.Results = results
+
+	w.Header().Set("ETag", stock.FormatETag(version))
+	respondWithJSON(w, http.StatusOK, syncRes)
+}
+
 /* Return all player progress */
 func (a *App) getLeaderboard(w http.ResponseWriter, r *http.Request) {
 	id, err := getIDFromToken(a.DB, r)
@@ -372,7 +703,30 @@ func (a *App) getLeaderboard(w http.ResponseWriter, r *http.Request) {
 
 /* Return item schema */
 func (a *App) getItemSchema(w http.ResponseWriter, r *http.Request) {
-	respondWithJSON(w, http.StatusOK, itemSchema)
+	respondWithJSON(w, http.StatusOK, itemCatalog.Schema)
+}
+
+/* Validate auth token, check user is developer and return maintenance job
+** metrics */
+func (a *App) getMaintenance(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromToken(a.DB, r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	err = checkDeveloper(a.DB, id)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, a.Maintenance.Metrics())
+}
+
+/* Return inventory limits */
+func (a *App) getItemLimits(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, itemCatalog.Limits)
 }
 
 /* Add player desktop state as a JSON */
@@ -427,3 +781,278 @@ func (a *App) getDesktopState(w http.ResponseWriter, r *http.Request) {
 
 	respondWithRaw(w, http.StatusOK, body)
 }
+
+/* Create a class from a lecturer account and return its join code */
+func (a *App) addClass(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromToken(a.DB, r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	err = checkLecturer(a.DB, id)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	// Decode json body into class request
+	decoder := json.NewDecoder(r.Body)
+	var classReq ClassRequest
+	err = decoder.Decode(&classReq)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid class name")
+		return
+	}
+	if len(classReq.Name) == 0 || len(classReq.Name) > MAX_CLASS_NAME {
+		respondWithError(w, http.StatusBadRequest,
+			fmt.Sprintf("Class name must be between 1 and %d characters",
+				MAX_CLASS_NAME))
+		return
+	}
+
+	class := Class{LecturerID: id, Name: classReq.Name}
+	class.ClassID, err = generateID(a.DB, "class", "class_id")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	class.JoinCode, err = generateJoinCode(a.DB)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Query database
+	err = class.CreateClass(a.DB)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	classRes := ClassResponse{
+		ClassID:  class.ClassID,
+		Name:     class.Name,
+		JoinCode: class.JoinCode,
+	}
+	respondWithJSON(w, http.StatusOK, classRes)
+}
+
+/* Return all classes owned by a lecturer account */
+func (a *App) getClasses(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromToken(a.DB, r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	err = checkLecturer(a.DB, id)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	stmt := "SELECT class.class_id, class.name, class.join_code, COUNT(enrolment.user_id) FROM class LEFT JOIN enrolment ON class.class_id = enrolment.class_id WHERE class.lecturer_id=? GROUP BY class.class_id ORDER BY class.name"
+	rows, err := a.DB.Query(stmt, id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	var classesRes ClassesResponse
+	// Handle no classes case
+	classesRes.Classes = make([]ClassResponse, 0)
+	for rows.Next() {
+		var classRes ClassResponse
+		err = rows.Scan(&classRes.ClassID, &classRes.Name, &classRes.JoinCode,
+			&classRes.Students)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		classesRes.Classes = append(classesRes.Classes, classRes)
+	}
+	// Handle any errors encountered during iteration
+	err = rows.Err()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, classesRes)
+}
+
+/* Return the progress and inventory summary of each student in a class owned
+** by a lecturer account */
+func (a *App) getClass(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromToken(a.DB, r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	err = checkLecturer(a.DB, id)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	classID, err := strconv.ParseUint(mux.Vars(r)["class_id"], 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid class ID")
+		return
+	}
+
+	// Lecturers can only see their own classes
+	class := Class{ClassID: uint32(classID), LecturerID: id}
+	err = class.GetOwnedClass(a.DB)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Class not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	classRes := ClassDetailResponse{
+		ClassID:  class.ClassID,
+		Name:     class.Name,
+		JoinCode: class.JoinCode,
+		Students: make([]StudentResponse, 0),
+	}
+
+	// Get enrolled students
+	stmt := "SELECT account.user_id, account.username FROM enrolment INNER JOIN account ON enrolment.user_id = account.user_id WHERE enrolment.class_id=? ORDER BY account.username"
+	rows, err := a.DB.Query(stmt, class.ClassID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	// Map user IDs to their position in the student list
+	studentIndex := make(map[uint32]int)
+	for rows.Next() {
+		var studentID ID
+		studentRes := StudentResponse{Blueprints: make([]BlueprintResponse, 0)}
+		err = rows.Scan(&studentID.Value, &studentRes.Username)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		studentIndex[studentID.Value] = len(classRes.Students)
+		classRes.Students = append(classRes.Students, studentRes)
+	}
+	// Handle any errors encountered during iteration
+	err = rows.Err()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Get student blueprints
+	stmt = "SELECT progress.user_id, progress.item_id FROM enrolment INNER JOIN progress ON enrolment.user_id = progress.user_id WHERE enrolment.class_id=?"
+	proRows, err := a.DB.Query(stmt, class.ClassID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer proRows.Close()
+	for proRows.Next() {
+		var studentID ID
+		var bluRes BlueprintResponse
+		err = proRows.Scan(&studentID.Value, &bluRes.ItemID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		i := studentIndex[studentID.Value]
+		classRes.Students[i].Blueprints = append(
+			classRes.Students[i].Blueprints, bluRes)
+	}
+	err = proRows.Err()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Get student inventory summaries
+	stmt = "SELECT inventory.user_id, COUNT(*), SUM(inventory.quantity) FROM enrolment INNER JOIN inventory ON enrolment.user_id = inventory.user_id WHERE enrolment.class_id=? GROUP BY inventory.user_id"
+	invRows, err := a.DB.Query(stmt, class.ClassID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer invRows.Close()
+	for invRows.Next() {
+		var studentID ID
+		var summary InventorySummaryResponse
+		err = invRows.Scan(&studentID.Value, &summary.DistinctItems,
+			&summary.TotalQuantity)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		classRes.Students[studentIndex[studentID.Value]].Inventory = summary
+	}
+	err = invRows.Err()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, classRes)
+}
+
+/* Enrol a player account in the class matching a join code */
+func (a *App) joinClass(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromToken(a.DB, r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	err = checkPlayer(a.DB, id)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	// Decode json body into join request
+	decoder := json.NewDecoder(r.Body)
+	var joinReq JoinRequest
+	err = decoder.Decode(&joinReq)
+	if err != nil || len(joinReq.JoinCode) != JOIN_CODE_SIZE {
+		respondWithError(w, http.StatusBadRequest, "Invalid join code")
+		return
+	}
+
+	class := Class{JoinCode: strings.ToUpper(joinReq.JoinCode)}
+	err = class.GetClassFromJoinCode(a.DB)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound,
+				"The join code provided does not match any class")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	// Query database
+	enrol := Enrolment{ClassID: class.ClassID, UserID: id}
+	err = enrol.AddEnrolment(a.DB)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, JoinResponse{
+		ClassID: class.ClassID,
+		Name:    class.Name,
+	})
+}
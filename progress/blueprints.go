@@ -1,8 +1,9 @@
 package main
 
 import (
-	"database/sql"
 	"strings"
+
+	"github.com/jaylees14/Manhattan-Server/stock"
 )
 
 type Progress struct {
@@ -14,7 +15,7 @@ type Blueprint struct {
 	ItemID uint32 `json:"item_id"`
 }
 
-func (pro *Progress) AddProgress(db *sql.DB) error {
+func (pro *Progress) AddProgress(db stock.Executor) error {
 	stmt := "INSERT IGNORE INTO progress VALUES"
 	values := []interface{}{}
 	for i := 0; i < len(pro.Blueprints); i++ {
@@ -25,6 +26,27 @@ func (pro *Progress) AddProgress(db *sql.DB) error {
 	stmt = strings.TrimSuffix(stmt, ",")
 
 	_, err := db.Exec(stmt, values...)
+	if err != nil {
+		return err
+	}
 
-	return err
+	// Notify each user's devices of the blueprints recorded
+	events := make(map[uint32]*ProgressEvent)
+	var users []uint32
+	for i := 0; i < len(pro.Blueprints); i++ {
+		event, ok := events[pro.Blueprints[i].UserID]
+		if !ok {
+			event = &ProgressEvent{}
+			events[pro.Blueprints[i].UserID] = event
+			users = append(users, pro.Blueprints[i].UserID)
+		}
+		event.Blueprints = append(event.Blueprints, pro.Blueprints[i].ItemID)
+	}
+	for i := 0; i < len(users); i++ {
+		err = stock.AddEvent(db, users[i], EVENT_PROGRESS, events[users[i]])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"database/sql"
+)
+
+type Class struct {
+	ClassID    uint32 `json:"class_id"`
+	LecturerID uint32 `json:"lecturer_id"`
+	Name       string `json:"name"`
+	JoinCode   string `json:"join_code"`
+}
+
+type Enrolment struct {
+	ClassID uint32 `json:"class_id"`
+	UserID  uint32 `json:"user_id"`
+}
+
+func (class *Class) CreateClass(db *sql.DB) error {
+	stmt := "INSERT INTO class VALUES (?, ?, ?, ?)"
+	_, err := db.Exec(stmt, class.ClassID, class.LecturerID, class.Name,
+		class.JoinCode)
+	return err
+}
+
+/* Get the class owned by the given lecturer, returning sql.ErrNoRows if the
+** class does not exist or belongs to another lecturer */
+func (class *Class) GetOwnedClass(db *sql.DB) error {
+	stmt := "SELECT name, join_code FROM class WHERE class_id=? AND lecturer_id=?"
+	return db.QueryRow(stmt, class.ClassID, class.LecturerID).Scan(&class.Name,
+		&class.JoinCode)
+}
+
+func (class *Class) GetClassFromJoinCode(db *sql.DB) error {
+	stmt := "SELECT class_id, lecturer_id, name FROM class WHERE join_code=?"
+	return db.QueryRow(stmt, class.JoinCode).Scan(&class.ClassID,
+		&class.LecturerID, &class.Name)
+}
+
+/* Enrol a user in a class, enrolling twice has no effect */
+func (enrol *Enrolment) AddEnrolment(db *sql.DB) error {
+	stmt := "INSERT IGNORE INTO enrolment VALUES (?, ?)"
+	_, err := db.Exec(stmt, enrol.ClassID, enrol.UserID)
+	return err
+}
@@ -11,6 +11,11 @@ type Configuration struct {
 	DBPassword string `json:"dbPassword"`
 	DBHost     string `json:"dbHost"`
 	DBName     string `json:"dbName"`
+	// Maintenance interval in seconds, zero disables the job
+	MaintenanceInterval  int `json:"maintenanceInterval"`
+	MaintenanceBatchSize int `json:"maintenanceBatchSize"`
+	// Time in seconds stored idempotency keys are kept for
+	IdempotencyTTL int `json:"idempotencyTTL"`
 }
 
 func GetConfiguration(fileName string) (Configuration, error) {
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"database/sql"
+	"github.com/jaylees14/Manhattan-Server/stock"
 )
 
 type DesktopState struct {
@@ -9,8 +9,13 @@ type DesktopState struct {
 	GameState string `json:"game_state"`
 }
 
-func (deskState *DesktopState) AddState(db *sql.DB) error {
+func (deskState *DesktopState) AddState(db stock.Executor) error {
 	stmt := "INSERT INTO desktop VALUES (?, ?) ON DUPLICATE KEY UPDATE state=VALUES(state)"
 	_, err := db.Exec(stmt, deskState.UserID, deskState.GameState)
-	return err
+	if err != nil {
+		return err
+	}
+
+	// Devices are told a save was made, and fetch the state themselves
+	return stock.AddEvent(db, deskState.UserID, EVENT_DESKTOP_STATE, struct{}{})
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/* Changes to inventory, progress and desktop state are recorded as events
+** and streamed to the user's connected devices as server-sent events. Events
+** are written in the transaction making the change, in this service and the
+** inventory service, so they are only sent once it commits. Each event
+** carries the user's inventory version, so a device can skip inventory
+** changes it made itself */
+
+/* Blueprints recorded in progress */
+type ProgressEvent struct {
+	Blueprints []uint32 `json:"blueprints"`
+}
+
+/* An event as sent in the stream */
+type Event struct {
+	EventID   uint64          `json:"event_id"`
+	Type      string          `json:"type"`
+	Version   uint64          `json:"version"`
+	EventTime int64           `json:"event_time"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// Event types recorded by this service, alongside stock.EVENT_INVENTORY
+const (
+	EVENT_PROGRESS      = "progress"
+	EVENT_DESKTOP_STATE = "desktop-state"
+)
+
+// How often streams check for new events, and send a comment to keep idle
+// connections open. Each open stream queries MySQL once per poll interval,
+// so a replica with n connected devices runs n event queries a second
+const EVENT_POLL_INTERVAL time.Duration = time.Second
+const EVENT_HEARTBEAT time.Duration = 15 * time.Second
+const EVENT_BATCH_SIZE int = 100
+
+/* Get the ID of a user's newest event, zero if there are none */
+func getLatestEvent(db *sql.DB, userID uint32) (uint64, error) {
+	var latest uint64
+	stmt := "SELECT COALESCE(MAX(event_id), 0) FROM event WHERE user_id=?"
+	err := db.QueryRow(stmt, userID).Scan(&latest)
+	return latest, err
+}
+
+/* Get a batch of a user's events after the given event ID, oldest first */
+func getEvents(db *sql.DB, userID uint32, after uint64) ([]Event, error) {
+	events := make([]Event, 0)
+	stmt := "SELECT event_id, event_type, version, event_time, payload FROM event WHERE user_id=? AND event_id>? ORDER BY event_id LIMIT ?"
+	rows, err := db.Query(stmt, userID, after, EVENT_BATCH_SIZE)
+	if err != nil {
+		return events, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var event Event
+		var payload string
+		err = rows.Scan(&event.EventID, &event.Type, &event.Version,
+			&event.EventTime, &payload)
+		if err != nil {
+			return events, err
+		}
+		event.Payload = json.RawMessage(payload)
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+/* Stream the user's events until the client disconnects or their token is
+** no longer valid. A stream resumes after the Last-Event-ID header sent by
+** reconnecting clients, otherwise it starts with the next event */
+func (a *App) streamEvents(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromToken(a.DB, r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError,
+			"Streaming is not supported")
+		return
+	}
+
+	var last uint64
+	if header := r.Header.Get("Last-Event-ID"); header != "" {
+		last, err = strconv.ParseUint(header, 10, 64)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid Last-Event-ID")
+			return
+		}
+	} else {
+		last, err = getLatestEvent(a.DB, id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	poll := time.NewTicker(a.EventPollInterval)
+	defer poll.Stop()
+	lastWrite := time.Now()
+	for {
+		events, err := getEvents(a.DB, id, last)
+		if err != nil {
+			return
+		}
+		for i := 0; i < len(events); i++ {
+			data, err := json.Marshal(events[i])
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n",
+				events[i].EventID, events[i].Type, data)
+			last = events[i].EventID
+		}
+		if len(events) > 0 {
+			flusher.Flush()
+			lastWrite = time.Now()
+		}
+
+		// Idle streams are kept open while the token is still valid
+		if time.Since(lastWrite) >= EVENT_HEARTBEAT {
+			_, err = getIDFromToken(a.DB, r)
+			if err != nil {
+				return
+			}
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+			lastWrite = time.Now()
+		}
+
+		// A full batch means more events are waiting
+		if len(events) == EVENT_BATCH_SIZE {
+			continue
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-poll.C:
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"log"
+	"time"
 )
 
 var config Configuration
@@ -23,5 +24,16 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	// Start purging stale rows in the background
+	if config.MaintenanceBatchSize > 0 {
+		a.Maintenance.BatchSize = config.MaintenanceBatchSize
+	}
+	a.Maintenance.Start(time.Duration(config.MaintenanceInterval) * time.Second)
+
+	if config.IdempotencyTTL > 0 {
+		a.Idempotency.TTL = time.Duration(config.IdempotencyTTL) * time.Second
+	}
+
 	log.Fatal(a.Run(config.Port))
 }
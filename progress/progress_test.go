@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,14 +12,18 @@ import (
 	"os"
 	"strings"
 	"testing"
-)
+	"time"
 
-type Count struct {
-	Value int
-}
+	"github.com/jaylees14/Manhattan-Server/catalog"
+	"github.com/jaylees14/Manhattan-Server/stock"
+)
 
 const ACCESS_TOKEN string = "Bearer ydzvGQg2EcjTTHLSVHb7JTpkSRDdd0hQu2n5YPEM4CTfnqQIrqnufSIIOWchPNSZ"
 
+const LECTURER_ACCESS_TOKEN string = "Bearer V3qk9x4oEs4Gc6h9MpT-kAnDNFxPdIix19MV-lPDCZUxGTVKrH1Hhz4drVar4rSw"
+
+const PLAYER_ACCESS_TOKEN string = "Bearer CwlBrHSOzAC2NMLDREmeLeSdAeGMWcczp7KH2Ks9hWJtsMAey82kdRlggoqG0Yjr"
+
 var testA App
 var testConfig Configuration
 
@@ -100,6 +105,53 @@ func clearDesktopTable(t *testing.T) {
 	}
 }
 
+func clearInventoryTable(t *testing.T) {
+	_, err := testA.DB.Exec("DELETE FROM inventory")
+	if err != nil {
+		t.Errorf("Failed to clear inventory table")
+	}
+	_, err = testA.DB.Exec("DELETE FROM ledger")
+	if err != nil {
+		t.Errorf("Failed to clear ledger table")
+	}
+	_, err = testA.DB.Exec("DELETE FROM inventory_version")
+	if err != nil {
+		t.Errorf("Failed to clear inventory version table")
+	}
+	_, err = testA.DB.Exec("DELETE FROM flag")
+	if err != nil {
+		t.Errorf("Failed to clear flag table")
+	}
+}
+
+func clearClassTables(t *testing.T) {
+	_, err := testA.DB.Exec("DELETE FROM enrolment")
+	if err != nil {
+		t.Errorf("Failed to clear enrolment table")
+	}
+	_, err = testA.DB.Exec("DELETE FROM class")
+	if err != nil {
+		t.Errorf("Failed to clear class table")
+	}
+}
+
+/* Stream Will's events until the wait has passed */
+func streamTestEvents(t *testing.T, lastEventID string,
+	wait time.Duration) *httptest.ResponseRecorder {
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, "/api/v1/events", nil)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	return executeRequest(req)
+}
+
 func executeRequest(req *http.Request) *httptest.ResponseRecorder {
 	rec := httptest.NewRecorder()
 	testA.Router.ServeHTTP(rec, req)
@@ -231,6 +283,29 @@ func TestAddGetProgress(t *testing.T) {
 	}
 }
 
+/* Check players cannot add blueprints without building them */
+func TestAddProgressPlayer(t *testing.T) {
+	clearProgressTable(t)
+
+	payload := []byte(`{"blueprints":[{"item_id":11}]}`)
+
+	req, err := http.NewRequest(http.MethodPost, "/api/v1/progress",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", PLAYER_ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, res.Code)
+
+	var count Count
+	err = testA.DB.QueryRow("SELECT COUNT(*) FROM progress").Scan(&count.Value)
+	if err != nil || count.Value != 0 {
+		t.Errorf("Expected no progress to be added")
+	}
+}
+
 /* Check empty blueprint lists are not accepted for adding */
 func TestAddEmptyProgress(t *testing.T) {
 	clearProgressTable(t)
@@ -370,6 +445,27 @@ func TestGetItemSchema(t *testing.T) {
 	/* TODO: This really should check the returned JSON matches the item schema file */
 }
 
+/* Check inventory limits are returned */
+func TestGetItemLimits(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "/api/v1/item-limits", nil)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var limits catalog.ItemLimits
+	err = json.NewDecoder(res.Body).Decode(&limits)
+	if err != nil {
+		t.Errorf("Failed to decode item limits")
+	}
+	if limits.SlotCapacity != itemCatalog.SlotCapacity() {
+		t.Errorf("Expected slot capacity %d. Got %d",
+			itemCatalog.SlotCapacity(), limits.SlotCapacity)
+	}
+}
+
 /* Check correct desktop state is added and returned */
 func TestAddGetDesktopState(t *testing.T) {
 	clearDesktopTable(t)
@@ -419,3 +515,571 @@ func TestGetEmptyDesktopState(t *testing.T) {
 		t.Errorf("JSON returned is non-empty")
 	}
 }
+
+/* Check only lecturers can create and list classes */
+func TestClassOnlyLecturer(t *testing.T) {
+	clearClassTables(t)
+
+	payload := []byte(`{"name":"COMS30400"}`)
+
+	req, err := http.NewRequest(http.MethodPost, "/api/v1/progress/classes",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", PLAYER_ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, res.Code)
+
+	req, err = http.NewRequest(http.MethodGet, "/api/v1/progress/classes", nil)
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, res.Code)
+}
+
+/* Check a blank class name is not accepted */
+func TestAddClassBlankName(t *testing.T) {
+	clearClassTables(t)
+
+	payload := []byte(`{"name":""}`)
+
+	req, err := http.NewRequest(http.MethodPost, "/api/v1/progress/classes",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", LECTURER_ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, res.Code)
+}
+
+/* Check a player can join a class with its join code and the lecturer can see
+** their progress and inventory summary */
+func TestJoinGetClass(t *testing.T) {
+	clearClassTables(t)
+	clearProgressTable(t)
+	clearInventoryTable(t)
+
+	// Create class
+	payload := []byte(`{"name":"COMS30400"}`)
+
+	req, err := http.NewRequest(http.MethodPost, "/api/v1/progress/classes",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", LECTURER_ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var classRes ClassResponse
+	err = json.NewDecoder(res.Body).Decode(&classRes)
+	if err != nil {
+		t.Errorf("Failed to decode class response")
+	}
+	if len(classRes.JoinCode) != JOIN_CODE_SIZE {
+		t.Errorf("Expected join code of length %d. Actual length was %d",
+			JOIN_CODE_SIZE, len(classRes.JoinCode))
+	}
+
+	// Incorrect join code
+	payload = []byte(`{"join_code":"AAAAAAAA"}`)
+	if classRes.JoinCode == "AAAAAAAA" {
+		payload = []byte(`{"join_code":"BBBBBBBB"}`)
+	}
+
+	req, err = http.NewRequest(http.MethodPost,
+		"/api/v1/progress/classes/join", bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", PLAYER_ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, res.Code)
+
+	// Correct join code
+	payload = []byte(fmt.Sprintf("{\"join_code\":\"%s\"}", classRes.JoinCode))
+
+	req, err = http.NewRequest(http.MethodPost,
+		"/api/v1/progress/classes/join", bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", PLAYER_ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	// Player progress and inventory
+	_, err = testA.DB.Exec("INSERT INTO progress VALUES (2121631167, 11)")
+	if err != nil {
+		t.Errorf("Failed to add progress")
+	}
+
+	_, err = testA.DB.Exec("INSERT INTO inventory VALUES (2121631167, 1, 4), (2121631167, 2, 5)")
+	if err != nil {
+		t.Errorf("Failed to add inventory")
+	}
+
+	// Get class
+	req, err = http.NewRequest(http.MethodGet,
+		fmt.Sprintf("/api/v1/progress/classes/%d", classRes.ClassID), nil)
+	req.Header.Set("Authorization", LECTURER_ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var classDetail ClassDetailResponse
+	err = json.NewDecoder(res.Body).Decode(&classDetail)
+	if err != nil {
+		t.Errorf("Failed to decode class response")
+	}
+	if len(classDetail.Students) != 1 {
+		t.Fatalf("Expected 1 student. Actual number was %d",
+			len(classDetail.Students))
+	}
+	student := classDetail.Students[0]
+	if student.Username != "John" {
+		t.Errorf("Expected student John. Actual was %s", student.Username)
+	}
+	if len(student.Blueprints) != 1 || student.Blueprints[0].ItemID != 11 {
+		t.Errorf("Expected blueprint 11 only")
+	}
+	if student.Inventory.DistinctItems != 2 || student.Inventory.TotalQuantity != 9 {
+		t.Errorf("Expected 2 distinct items and quantity 9. Actual was %d and %d",
+			student.Inventory.DistinctItems, student.Inventory.TotalQuantity)
+	}
+
+	// Unknown classes are not found
+	req, err = http.NewRequest(http.MethodGet,
+		fmt.Sprintf("/api/v1/progress/classes/%d", classRes.ClassID+1), nil)
+	req.Header.Set("Authorization", LECTURER_ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, res.Code)
+
+	clearInventoryTable(t)
+}
+
+/* Check building a blueprint without its components changes nothing */
+func TestBuildMissingComponents(t *testing.T) {
+	clearProgressTable(t)
+	clearInventoryTable(t)
+
+	// The furnace needs 4 stone and 4 clay
+	_, err := testA.DB.Exec("INSERT INTO inventory VALUES (3149194563, 2, 4), (3149194563, 3, 3)")
+	if err != nil {
+		t.Errorf("Failed to add inventory")
+	}
+
+	payload := []byte(`{"item_id":11}`)
+
+	req, err := http.NewRequest(http.MethodPost, "/api/v1/progress/build",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, res.Code)
+
+	// Check no progress was recorded and no items were removed
+	var count Count
+	err = testA.DB.QueryRow("SELECT COUNT(*) FROM progress").Scan(&count.Value)
+	if err != nil || count.Value != 0 {
+		t.Errorf("Expected no progress")
+	}
+	err = testA.DB.QueryRow("SELECT SUM(quantity) FROM inventory").Scan(&count.Value)
+	if err != nil || count.Value != 7 {
+		t.Errorf("Expected inventory to be unchanged")
+	}
+
+	clearInventoryTable(t)
+}
+
+/* Check building a blueprint consumes its components and records progress,
+** without adding the built item to inventory */
+func TestBuildBlueprint(t *testing.T) {
+	clearProgressTable(t)
+	clearInventoryTable(t)
+
+	_, err := testA.DB.Exec("INSERT INTO inventory VALUES (3149194563, 2, 5), (3149194563, 3, 4)")
+	if err != nil {
+		t.Errorf("Failed to add inventory")
+	}
+
+	// Primary resources are not blueprints
+	payload := []byte(`{"item_id":2}`)
+
+	req, err := http.NewRequest(http.MethodPost, "/api/v1/progress/build",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, res.Code)
+
+	// Build the furnace
+	payload = []byte(`{"item_id":11}`)
+
+	req, err = http.NewRequest(http.MethodPost, "/api/v1/progress/build",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	// Check the furnace is in progress
+	req, err = http.NewRequest(http.MethodGet, "/api/v1/progress", nil)
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var pro Progress
+	err = json.NewDecoder(res.Body).Decode(&pro)
+	if err != nil {
+		t.Errorf("Failed to decode progress response")
+	}
+	if len(pro.Blueprints) != 1 || pro.Blueprints[0].ItemID != 11 {
+		t.Errorf("Expected the furnace blueprint only")
+	}
+
+	// Check one stone remains and the clay is gone
+	rows, err := testA.DB.Query("SELECT item_id, quantity FROM inventory ORDER BY item_id")
+	if err != nil {
+		t.Fatalf("Failed to get inventory")
+	}
+	defer rows.Close()
+	var items []stock.Item
+	for rows.Next() {
+		var item stock.Item
+		rows.Scan(&item.ItemID, &item.Quantity)
+		items = append(items, item)
+	}
+	if len(items) != 1 || items[0].ItemID != 2 || items[0].Quantity != 1 {
+		t.Errorf("Expected 1 stone. Actual was %v", items)
+	}
+
+	// Check the components were recorded in the ledger
+	var delta int64
+	err = testA.DB.QueryRow("SELECT SUM(delta) FROM ledger WHERE reason=? AND source=?",
+		stock.LEDGER_BUILT, "build:11").Scan(&delta)
+	if err != nil || delta != -8 {
+		t.Errorf("Expected a ledger total of -8 for the build. Actual was %d",
+			delta)
+	}
+
+	clearInventoryTable(t)
+}
+
+/* Check a batch of offline operations is applied in order, with failed
+** operations leaving the rest of the batch to be applied */
+func TestSync(t *testing.T) {
+	clearProgressTable(t)
+	clearDesktopTable(t)
+	clearInventoryTable(t)
+
+	// Glass cannot be crafted until the furnace is built, and is not a
+	// primary resource so cannot be reported as collected
+	payload := []byte(`{"operations":[
+		{"type":"collect","timestamp":1546300800000000000,"items":[{"item_id":2,"quantity":5},{"item_id":3,"quantity":4},{"item_id":8,"quantity":2}]},
+		{"type":"craft","timestamp":1546300801000000000,"item_id":16,"count":1},
+		{"type":"build","timestamp":1546300802000000000,"item_id":11},
+		{"type":"craft","timestamp":1546300803000000000,"item_id":16,"count":2},
+		{"type":"state","timestamp":1546300804000000000,"state":{"level":2}},
+		{"type":"collect","timestamp":1546300805000000000,"items":[{"item_id":16,"quantity":1}]}
+	]}`)
+
+	req, err := http.NewRequest(http.MethodPost, "/api/v1/sync",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+	if res.Header().Get("ETag") == "" {
+		t.Errorf("Expected an ETag")
+	}
+
+	var syncRes SyncResponse
+	err = json.NewDecoder(res.Body).Decode(&syncRes)
+	if err != nil {
+		t.Fatalf("Failed to decode sync response")
+	}
+	codes := []int{http.StatusOK, http.StatusForbidden, http.StatusOK,
+		http.StatusOK, http.StatusOK, http.StatusConflict}
+	if len(syncRes.Results) != len(codes) {
+		t.Fatalf("Expected %d results. Actual was %d", len(codes),
+			len(syncRes.Results))
+	}
+	for i := 0; i < len(codes); i++ {
+		if syncRes.Results[i].Index != i || syncRes.Results[i].Code != codes[i] {
+			t.Errorf("Expected result %d to have code %d. Actual was %d", i,
+				codes[i], syncRes.Results[i].Code)
+		}
+	}
+
+	// Check the final inventory and progress
+	inv := make(map[uint32]uint32)
+	for i := 0; i < len(syncRes.Inventory.Items); i++ {
+		inv[syncRes.Inventory.Items[i].ItemID] = syncRes.Inventory.Items[i].Quantity
+	}
+	if len(inv) != 2 || inv[2] != 1 || inv[16] != 2 {
+		t.Errorf("Expected 1 stone and 2 glass. Actual was %v", inv)
+	}
+	if len(syncRes.Progress.Blueprints) != 1 ||
+		syncRes.Progress.Blueprints[0].ItemID != 11 {
+		t.Errorf("Expected the furnace blueprint only")
+	}
+
+	// Check the collected glass was flagged for review
+	var count Count
+	err = testA.DB.QueryRow("SELECT COUNT(*) FROM flag WHERE user_id=3149194563 AND item_id=16 AND source=?",
+		stock.FLAG_SYNC).Scan(&count.Value)
+	if err != nil || count.Value != 1 {
+		t.Errorf("Expected the collected glass to be flagged")
+	}
+
+	// Check the desktop state was saved
+	var state string
+	err = testA.DB.QueryRow("SELECT state FROM desktop WHERE user_id=3149194563").Scan(&state)
+	if err != nil || state != `{"level":2}` {
+		t.Errorf("Expected the synced desktop state. Actual was %s", state)
+	}
+
+	clearDesktopTable(t)
+	clearInventoryTable(t)
+}
+
+/* Check an operation failing with a server error is reported in its result,
+** leaving earlier operations applied and the rest of the batch to be applied */
+func TestSyncServerError(t *testing.T) {
+	clearDesktopTable(t)
+	clearInventoryTable(t)
+
+	// The desktop state column holds at most 64KB, so a larger state fails
+	// to save under MySQL's default strict mode
+	large := strings.Repeat("a", 70000)
+	payload := []byte(`{"operations":[
+		{"type":"collect","timestamp":1546300800000000000,"items":[{"item_id":2,"quantity":5}]},
+		{"type":"state","timestamp":1546300801000000000,"state":{"level":"` + large + `"}},
+		{"type":"state","timestamp":1546300802000000000,"state":{"level":3}}
+	]}`)
+
+	req, err := http.NewRequest(http.MethodPost, "/api/v1/sync",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var syncRes SyncResponse
+	err = json.NewDecoder(res.Body).Decode(&syncRes)
+	if err != nil {
+		t.Fatalf("Failed to decode sync response")
+	}
+	codes := []int{http.StatusOK, http.StatusInternalServerError,
+		http.StatusOK}
+	if len(syncRes.Results) != len(codes) {
+		t.Fatalf("Expected %d results. Actual was %d", len(codes),
+			len(syncRes.Results))
+	}
+	for i := 0; i < len(codes); i++ {
+		if syncRes.Results[i].Code != codes[i] {
+			t.Errorf("Expected result %d to have code %d. Actual was %d", i,
+				codes[i], syncRes.Results[i].Code)
+		}
+	}
+	if len(syncRes.Inventory.Items) != 1 ||
+		syncRes.Inventory.Items[0].Quantity != 5 {
+		t.Errorf("Expected the collected stone to be kept")
+	}
+
+	clearDesktopTable(t)
+	clearInventoryTable(t)
+}
+
+/* Check batches with operations out of timestamp order are not applied */
+func TestSyncOutOfOrder(t *testing.T) {
+	clearInventoryTable(t)
+
+	payload := []byte(`{"operations":[
+		{"type":"collect","timestamp":1546300801000000000,"items":[{"item_id":2,"quantity":5}]},
+		{"type":"collect","timestamp":1546300800000000000,"items":[{"item_id":3,"quantity":4}]}
+	]}`)
+
+	req, err := http.NewRequest(http.MethodPost, "/api/v1/sync",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, res.Code)
+
+	var count Count
+	err = testA.DB.QueryRow("SELECT COUNT(*) FROM inventory").Scan(&count.Value)
+	if err != nil || count.Value != 0 {
+		t.Errorf("Expected inventory to be unchanged")
+	}
+}
+
+/* Check expired idempotency keys are purged and only developers can view the
+** maintenance metrics */
+/* Check inventory, progress and desktop state changes are streamed, and a
+** stream can resume after the last event received */
+func TestEventStream(t *testing.T) {
+	clearProgressTable(t)
+	clearDesktopTable(t)
+	clearInventoryTable(t)
+	_, err := testA.DB.Exec("DELETE FROM event")
+	if err != nil {
+		t.Errorf("Failed to clear event table")
+	}
+
+	// New streams only send events from now on
+	res := streamTestEvents(t, "", 100*time.Millisecond)
+	checkResponseCode(t, http.StatusOK, res.Code)
+	if res.Header().Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Expected an event stream")
+	}
+	if strings.Contains(res.Body.String(), "event:") {
+		t.Errorf("Expected no events. Actual was %s", res.Body.String())
+	}
+
+	payload := []byte(`{"operations":[
+		{"type":"collect","timestamp":1546300800000000000,"items":[{"item_id":2,"quantity":5}]},
+		{"type":"state","timestamp":1546300801000000000,"state":{"level":2}}
+	]}`)
+	req, err := http.NewRequest(http.MethodPost, "/api/v1/sync",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	req, err = http.NewRequest(http.MethodPost, "/api/v1/progress",
+		bytes.NewBuffer([]byte(`{"blueprints":[{"item_id":11}]}`)))
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	res = streamTestEvents(t, "0", 100*time.Millisecond)
+	checkResponseCode(t, http.StatusOK, res.Code)
+	var events []Event
+	lines := strings.Split(res.Body.String(), "\n")
+	for i := 0; i < len(lines); i++ {
+		if !strings.HasPrefix(lines[i], "data: ") {
+			continue
+		}
+		var event Event
+		err = json.Unmarshal([]byte(strings.TrimPrefix(lines[i], "data: ")),
+			&event)
+		if err != nil {
+			t.Fatalf("Failed to decode event")
+		}
+		events = append(events, event)
+	}
+	types := []string{stock.EVENT_INVENTORY, EVENT_DESKTOP_STATE, EVENT_PROGRESS}
+	if len(events) != len(types) {
+		t.Fatalf("Expected %d events. Actual was %d", len(types), len(events))
+	}
+	for i := 0; i < len(types); i++ {
+		if events[i].Type != types[i] {
+			t.Errorf("Expected a %s event. Actual was %s", types[i],
+				events[i].Type)
+		}
+	}
+	var inventoryEvent stock.InventoryEvent
+	err = json.Unmarshal(events[0].Payload, &inventoryEvent)
+	if err != nil || len(inventoryEvent.Items) != 1 ||
+		inventoryEvent.Items[0].Delta != 5 || events[0].Version != 1 {
+		t.Errorf("Expected 5 stone at version 1. Actual was %s",
+			events[0].Payload)
+	}
+
+	// Resume after the first event
+	res = streamTestEvents(t, fmt.Sprintf("%d", events[0].EventID),
+		100*time.Millisecond)
+	if strings.Count(res.Body.String(), "event: ") != 2 ||
+		strings.Contains(res.Body.String(), "event: inventory") {
+		t.Errorf("Expected the stream to resume after the first event")
+	}
+
+	res = streamTestEvents(t, "first", 100*time.Millisecond)
+	checkResponseCode(t, http.StatusBadRequest, res.Code)
+
+	clearProgressTable(t)
+}
+
+func TestMaintenancePurgeIdempotency(t *testing.T) {
+	_, err := testA.DB.Exec("DELETE FROM idempotency")
+	if err != nil {
+		t.Errorf("Failed to clear idempotency table")
+	}
+	_, err = testA.DB.Exec("INSERT INTO idempotency VALUES ('progress', 1, 'old', '', 200, FALSE, '{}', '{}', 1), ('progress', 1, 'new', '', 200, FALSE, '{}', '{}', 9223372036854775807)")
+	if err != nil {
+		t.Errorf("Failed to add idempotency keys")
+	}
+
+	err = testA.Maintenance.Run()
+	if err != nil {
+		t.Errorf("Maintenance run failed: %s", err)
+	}
+
+	var keyCount Count
+	err = testA.DB.QueryRow("SELECT COUNT(*) FROM idempotency").Scan(&keyCount.Value)
+	if err != nil || keyCount.Value != 1 {
+		t.Errorf("Expected one idempotency key to remain")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "/api/v1/progress/maintenance",
+		nil)
+	req.Header.Set("Authorization", PLAYER_ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, res.Code)
+
+	req.Header.Set("Authorization", ACCESS_TOKEN)
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+}
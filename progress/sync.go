@@ -0,0 +1,295 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jaylees14/Manhattan-Server/idempotency"
+	"github.com/jaylees14/Manhattan-Server/stock"
+)
+
+/* An operation made by a client while offline, applied in order by a sync.
+** Each type uses its own fields:
+**   collect - items, primary resources picked up from the map, as for
+**             /inventory
+**   craft   - item_id and count, as for /inventory/craft
+**   build   - item_id, as for /progress/build
+**   state   - state, the desktop state JSON to save */
+type SyncOperation struct {
+	Type      string          `json:"type"`
+	Timestamp int64           `json:"timestamp"`
+	ItemID    uint32          `json:"item_id"`
+	Count     uint32          `json:"count"`
+	Items     []stock.Item    `json:"items"`
+	State     json.RawMessage `json:"state"`
+}
+
+type SyncRequest struct {
+	Operations []SyncOperation `json:"operations"`
+}
+
+/* The outcome of one operation, with the response code and body its own
+** endpoint would have sent */
+type SyncResult struct {
+	Index     int         `json:"index"`
+	Type      string      `json:"type"`
+	Timestamp int64       `json:"timestamp"`
+	Code      int         `json:"code"`
+	Response  interface{} `json:"response"`
+}
+
+const (
+	SYNC_COLLECT = "collect"
+	SYNC_CRAFT   = "craft"
+	SYNC_BUILD   = "build"
+	SYNC_STATE   = "state"
+)
+
+const MAX_SYNC_OPERATIONS int = 500
+
+// Allowance for client clocks running ahead of the server
+const SYNC_CLOCK_SKEW time.Duration = 5 * time.Minute
+
+/* Check a batch is not empty or too large, every operation has a known type
+** and the timestamps are in order and not in the future */
+func checkValidSync(syncReq SyncRequest) error {
+	if len(syncReq.Operations) <= 0 {
+		return errors.New("Empty operation list")
+	}
+	if len(syncReq.Operations) > MAX_SYNC_OPERATIONS {
+		return fmt.Errorf("At most %d operations can be synced at once",
+			MAX_SYNC_OPERATIONS)
+	}
+	latest := time.Now().Add(SYNC_CLOCK_SKEW).UnixNano()
+	for i := 0; i < len(syncReq.Operations); i++ {
+		op := syncReq.Operations[i]
+		switch op.Type {
+		case SYNC_COLLECT, SYNC_CRAFT, SYNC_BUILD, SYNC_STATE:
+		default:
+			return fmt.Errorf("Invalid operation type at index %d", i)
+		}
+		if op.Timestamp <= 0 || op.Timestamp > latest {
+			return fmt.Errorf("Invalid timestamp at index %d", i)
+		}
+		if i > 0 && op.Timestamp < syncReq.Operations[i-1].Timestamp {
+			return errors.New("Operations must be in timestamp order")
+		}
+	}
+	return nil
+}
+
+/* Apply a single operation in its own transaction, so a failed operation
+** leaves the rest of the batch to be applied. Returns the response code and
+** body for the operation, or an error if it could not be attempted */
+func (a *App) applyOperation(r *http.Request, id uint32,
+	op SyncOperation) (int, interface{}, error) {
+	tx, err := a.DB.Begin()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	var code int
+	var body interface{}
+	switch op.Type {
+	case SYNC_COLLECT:
+		code, body, err = a.collectItems(tx, id, op.Items)
+	case SYNC_CRAFT:
+		code, body, err = craftItem(tx, id, op.ItemID, op.Count)
+	case SYNC_BUILD:
+		code, body, err = buildItem(tx, id, op.ItemID)
+	case SYNC_STATE:
+		code, body, err = saveState(tx, id, op.State)
+	}
+	if err != nil || code != http.StatusOK {
+		return code, body, err
+	}
+
+	return code, body, idempotency.Commit(tx, r)
+}
+
+/* Add collected items to user inventory, within the gain caps and inventory
+** limits. Gains breaking the caps are flagged for review */
+func (a *App) collectItems(tx *sql.Tx, id uint32, items []stock.Item) (int,
+	interface{}, error) {
+	if len(items) <= 0 {
+		return errorResult(http.StatusBadRequest, "Empty item list")
+	}
+	inv := stock.Inventory{Items: make([]stock.Item, 0)}
+	for i := 0; i < len(items); i++ {
+		if !itemCatalog.IsValid(items[i].ItemID) {
+			return errorResult(http.StatusBadRequest, "Invalid item ID in list")
+		}
+		if !itemCatalog.IsStorable(items[i].ItemID) {
+			return errorResult(http.StatusBadRequest,
+				"Item in list cannot be stored")
+		}
+		if items[i].Quantity <= 0 {
+			return errorResult(http.StatusBadRequest,
+				"Invalid item quantity in list")
+		}
+		inv.Items = append(inv.Items, stock.Item{UserID: id,
+			ItemID: items[i].ItemID, Quantity: items[i].Quantity})
+	}
+
+	capped, flagged, err := inv.CapGains(tx, itemCatalog)
+	if err != nil {
+		return 0, nil, err
+	}
+	err = stock.FlagRejections(a.DB, id, flagged, stock.FLAG_SYNC)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	accepted, rejections, err := capped.FitInventory(tx, itemCatalog)
+	if err != nil {
+		return 0, nil, err
+	}
+	rejections = append(flagged, rejections...)
+	if len(rejections) > 0 {
+		return http.StatusConflict, RejectionResponse{
+			Error:    "Inventory limits exceeded",
+			Rejected: rejections,
+		}, nil
+	}
+
+	err = accepted.AddInventory(tx)
+	if err != nil {
+		return 0, nil, err
+	}
+	err = accepted.LogAdded(tx, stock.LEDGER_CLIENT_SYNC, "sync")
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, struct{}{}, nil
+}
+
+/* Craft an item on a built machine, consuming the recipe inputs from user
+** inventory and adding the output, as the inventory service does */
+func craftItem(tx *sql.Tx, id, itemID, count uint32) (int, interface{},
+	error) {
+	// Check the item is crafted on a machine, scaling the recipe by the count
+	craft, err := stock.NewCraft(itemCatalog, id, itemID, count)
+	if err != nil {
+		return errorResult(http.StatusBadRequest, err.Error())
+	}
+
+	// Check the user has built the machine
+	stmt := "SELECT COUNT(*) FROM progress WHERE user_id=? AND item_id=?"
+	var built Count
+	err = tx.QueryRow(stmt, id, craft.MachineID).Scan(&built.Value)
+	if err != nil {
+		return 0, nil, err
+	}
+	if built.Value == 0 {
+		machine, _ := itemCatalog.Item(craft.MachineID)
+		return errorResult(http.StatusForbidden,
+			fmt.Sprintf("The %s blueprint has not been built", machine.Name))
+	}
+
+	craftRes := CraftResponse{Consumed: make([]ItemResponse, 0)}
+	for i := 0; i < len(craft.Inputs.Items); i++ {
+		craftRes.Consumed = append(craftRes.Consumed, ItemResponse{
+			ItemID:   craft.Inputs.Items[i].ItemID,
+			Quantity: craft.Inputs.Items[i].Quantity,
+		})
+	}
+	craftRes.Crafted = ItemResponse{ItemID: craft.ItemID, Quantity: count}
+
+	shortfalls, rejections, err := craft.Apply(tx, itemCatalog)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(shortfalls) > 0 {
+		return http.StatusConflict, ShortfallResponse{
+			Error:      "Insufficient items in inventory",
+			Shortfalls: shortfalls,
+		}, nil
+	}
+	if len(rejections) > 0 {
+		return http.StatusConflict, RejectionResponse{
+			Error:    "Inventory limits exceeded",
+			Rejected: rejections,
+		}, nil
+	}
+	return http.StatusOK, craftRes, nil
+}
+
+/* Save desktop state, which must be a JSON object */
+func saveState(tx *sql.Tx, id uint32, state json.RawMessage) (int,
+	interface{}, error) {
+	var object map[string]interface{}
+	if len(state) == 0 || json.Unmarshal(state, &object) != nil ||
+		object == nil {
+		return errorResult(http.StatusBadRequest, "Invalid desktop state")
+	}
+
+	deskState := DesktopState{UserID: id, GameState: string(state)}
+	err := deskState.AddState(tx)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, struct{}{}, nil
+}
+
+/* The error body sent by respondWithError, for operation results */
+func errorResult(code int, message string) (int, interface{}, error) {
+	return code, map[string]string{"error": message}, nil
+}
+
+/* Read user inventory, progress and inventory version from one snapshot */
+func getSyncState(db *sql.DB, id uint32) (SyncResponse, uint64, error) {
+	syncRes := SyncResponse{
+		Inventory: InventoryResponse{Items: make([]ItemResponse, 0)},
+		Progress:  ProgressResponse{Blueprints: make([]BlueprintResponse, 0)},
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return syncRes, 0, err
+	}
+	defer tx.Rollback()
+
+	version, err := stock.GetVersion(tx, id)
+	if err != nil {
+		return syncRes, 0, err
+	}
+
+	rows, err := tx.Query("SELECT item_id, quantity FROM inventory WHERE user_id=?", id)
+	if err != nil {
+		return syncRes, 0, err
+	}
+	for rows.Next() {
+		var itemRes ItemResponse
+		err = rows.Scan(&itemRes.ItemID, &itemRes.Quantity)
+		if err != nil {
+			rows.Close()
+			return syncRes, 0, err
+		}
+		syncRes.Inventory.Items = append(syncRes.Inventory.Items, itemRes)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return syncRes, 0, err
+	}
+
+	rows, err = tx.Query("SELECT item_id FROM progress WHERE user_id=?", id)
+	if err != nil {
+		return syncRes, 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var bluRes BlueprintResponse
+		err = rows.Scan(&bluRes.ItemID)
+		if err != nil {
+			return syncRes, 0, err
+		}
+		syncRes.Progress.Blueprints = append(syncRes.Progress.Blueprints,
+			bluRes)
+	}
+	return syncRes, version, rows.Err()
+}
@@ -13,11 +13,21 @@ import (
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
+	"github.com/jaylees14/Manhattan-Server/catalog"
+	"github.com/jaylees14/Manhattan-Server/idempotency"
+	"github.com/jaylees14/Manhattan-Server/maintenance"
+	"github.com/jaylees14/Manhattan-Server/stock"
 )
 
 type App struct {
-	Router *mux.Router
-	DB     *sql.DB
+	Router      *mux.Router
+	DB          *sql.DB
+	Maintenance *maintenance.Job
+	Idempotency *idempotency.Middleware
+	// Furthest a player may be from a spawn to collect it, in metres
+	CollectRadius float64
+	// Largest radius resources can be searched within, in kilometres
+	MaxRadius float64
 }
 
 type ID struct {
@@ -36,10 +46,49 @@ type ResourcesResReq struct {
 	Spawns []SpawnResReq `json:"spawns"`
 }
 
+/* Nearby spawns, with the limit applied to the query. Truncated is set when
+** the limit was reached, so more spawns may be within the radius */
+type NearbyResourcesResponse struct {
+	Spawns    []SpawnResReq `json:"spawns"`
+	Limit     int           `json:"limit"`
+	Truncated bool          `json:"truncated"`
+}
+
 type SpawnResReq struct {
+	SpawnID  uint32         `json:"spawn_id"`
 	ItemID   uint32         `json:"item_id"`
 	Location LocationResReq `json:"location"`
 	Quantity uint32         `json:"quantity"`
+	// Seconds until the spawn expires, only sent when adding
+	ExpireIn uint32 `json:"expire_in,omitempty"`
+	// When the spawn expires, in Unix nanoseconds
+	ExpireAt int64 `json:"expire_at,omitempty"`
+	// Kilometres from the searched location, only sent in search results
+	Distance *float64 `json:"distance,omitempty"`
+}
+
+type RemoveSpawnsRequest struct {
+	SpawnIDs []uint32 `json:"spawn_ids"`
+	// Deprecated, spawns matched by item ID, location and quantity
+	Spawns []SpawnResReq `json:"spawns"`
+}
+
+type CollectRequest struct {
+	Location LocationResReq `json:"location"`
+	Quantity uint32         `json:"quantity"`
+}
+
+type CollectResponse struct {
+	SpawnID   uint32              `json:"spawn_id"`
+	ItemID    uint32              `json:"item_id"`
+	Collected uint32              `json:"collected"`
+	Remaining uint32              `json:"remaining"`
+	Rejected  []catalog.Rejection `json:"rejected"`
+}
+
+type RejectionResponse struct {
+	Error    string              `json:"error"`
+	Rejected []catalog.Rejection `json:"rejected"`
 }
 
 type LocationResReq struct {
@@ -48,15 +97,36 @@ type LocationResReq struct {
 }
 
 const BEARER_PREFIX string = "Bearer "
-const MAX_ITEM_ID uint32 = 32
 
-// Radius to return resources from, in kilometres
-const RESOURCE_RADIUS int = 1
+// Stored idempotency keys are kept apart from those of other services
+const IDEMPOTENCY_SERVICE string = "resources"
+
+// Default and largest radius to return resources from, in kilometres
+const RESOURCE_RADIUS float64 = 1
+const MAX_RESOURCE_RADIUS float64 = 5
+
+// Furthest a player may be from a spawn to collect it, in metres
+const COLLECT_RADIUS float64 = 50
 
 // Expiration in years, months, days
 var resourceExpire = [3]int{0, 1, 0}
 
-/* Initialise database connection, mux router and routes */
+var itemCatalog *catalog.Catalog
+
+// Stale rows purged by the maintenance job
+var maintenanceTasks = []maintenance.PurgeTask{
+	{
+		Name: "idempotency",
+		Stmt: "DELETE FROM idempotency WHERE service='resources' AND idempotency_expire < ? LIMIT ?",
+	},
+	{
+		Name: "resources",
+		Stmt: "DELETE FROM resources WHERE resource_expire < ? LIMIT ?",
+	},
+}
+
+/* Initialise database connection, maintenance job, mux router, routes and
+** item catalog */
 func (a *App) Initialise(dbUser, dbPassword, dbHost, dbName string) error {
 	connectionString := fmt.Sprintf("%s:%s@tcp(%s)/%s", dbUser, dbPassword,
 		dbHost, dbName)
@@ -65,8 +135,35 @@ func (a *App) Initialise(dbUser, dbPassword, dbHost, dbName string) error {
 	if err != nil {
 		return err
 	}
+	a.Maintenance = &maintenance.Job{
+		DB:        a.DB,
+		LockName:  fmt.Sprintf("%s_resources_maintenance", dbName),
+		BatchSize: maintenance.BATCH_SIZE,
+		Tasks:     maintenanceTasks,
+	}
+	a.Idempotency = &idempotency.Middleware{
+		DB:      a.DB,
+		Service: IDEMPOTENCY_SERVICE,
+		TTL:     idempotency.TTL,
+		UserID: func(r *http.Request) (uint32, error) {
+			return getIDFromToken(a.DB, r)
+		},
+	}
+	a.CollectRadius = COLLECT_RADIUS
+	a.MaxRadius = MAX_RESOURCE_RADIUS
 	a.Router = mux.NewRouter()
+	a.Router.Use(a.Idempotency.Handler)
 	a.initialiseRoutes()
+
+	itemCatalog, err = catalog.Load(catalog.ITEM_SCHEMA)
+	if err != nil {
+		return err
+	}
+	err = itemCatalog.LoadLimits(catalog.ITEM_LIMITS)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -84,6 +181,12 @@ func (a *App) initialiseRoutes() {
 		a.addResources).Methods(http.MethodPost)
 	a.Router.HandleFunc(fmt.Sprintf("%s/resources", prefix),
 		a.removeResources).Methods(http.MethodDelete)
+	a.Router.HandleFunc(fmt.Sprintf("%s/resources/{spawn_id:[0-9]+}", prefix),
+		a.removeResource).Methods(http.MethodDelete)
+	a.Router.HandleFunc(fmt.Sprintf("%s/resources/{spawn_id:[0-9]+}/collect",
+		prefix), a.collectResource).Methods(http.MethodPost)
+	a.Router.HandleFunc(fmt.Sprintf("%s/resources/maintenance", prefix),
+		a.getMaintenance).Methods(http.MethodGet)
 }
 
 /* Respond with a error JSON */
@@ -163,10 +266,14 @@ func checkValidResources(res ResourcesResReq) error {
 	if len(res.Spawns) <= 0 {
 		return errors.New("Empty spawn list")
 	}
+	now := time.Now().UnixNano()
 	for i := 0; i < len(res.Spawns); i++ {
-		if res.Spawns[i].ItemID <= 0 || res.Spawns[i].ItemID > MAX_ITEM_ID {
+		if !itemCatalog.IsValid(res.Spawns[i].ItemID) {
 			return errors.New("Invalid item ID in list")
 		}
+		if !itemCatalog.IsSpawnable(res.Spawns[i].ItemID) {
+			return errors.New("Only primary resources can be spawned")
+		}
 		err := checkValidLatLong(res.Spawns[i].Location.Latitude,
 			res.Spawns[i].Location.Longitude)
 		if err != nil {
@@ -175,10 +282,45 @@ func checkValidResources(res ResourcesResReq) error {
 		if res.Spawns[i].Quantity <= 0 {
 			return errors.New("Invalid resource quantity in list")
 		}
+		if res.Spawns[i].ExpireIn > 0 && res.Spawns[i].ExpireAt != 0 {
+			return errors.New("Only one of expire_in and expire_at may be given")
+		}
+		if res.Spawns[i].ExpireAt != 0 && res.Spawns[i].ExpireAt <= now {
+			return errors.New("Invalid expiry in list, must be in the future")
+		}
 	}
 	return nil
 }
 
+/* When a spawn being added expires, from its expiry duration or time, or
+** the default expiration if neither is given */
+func spawnExpire(spawn SpawnResReq, now time.Time) int64 {
+	if spawn.ExpireAt != 0 {
+		return spawn.ExpireAt
+	}
+	if spawn.ExpireIn > 0 {
+		return now.Add(time.Duration(spawn.ExpireIn) * time.Second).UnixNano()
+	}
+	return now.AddDate(resourceExpire[0], resourceExpire[1],
+		resourceExpire[2]).UnixNano()
+}
+
+/* Check sent spawn ID list is valid, returning it without repeated IDs */
+func checkValidSpawnIDs(req RemoveSpawnsRequest) ([]uint32, error) {
+	if len(req.SpawnIDs) <= 0 {
+		return nil, errors.New("Empty spawn ID list")
+	}
+	seen := make(map[uint32]bool)
+	spawnIDs := make([]uint32, 0, len(req.SpawnIDs))
+	for i := 0; i < len(req.SpawnIDs); i++ {
+		if !seen[req.SpawnIDs[i]] {
+			seen[req.SpawnIDs[i]] = true
+			spawnIDs = append(spawnIDs, req.SpawnIDs[i])
+		}
+	}
+	return spawnIDs, nil
+}
+
 /* Check floats are valid latitude and longitude */
 func checkValidLatLong(lat, long float64) error {
 	if lat < -90 || lat > 90 {
@@ -207,7 +349,52 @@ func generateID(db *sql.DB, table, targetID string) (uint32, error) {
 	return id, nil
 }
 
-/* Validate auth token and return resources within radius */
+/* Get unexpired resources matching the query, nearest first */
+func getNearbySpawns(db *sql.DB, query ResourceQuery) ([]SpawnResReq, error) {
+	/* Get resources within radius, using the Haversine formula, where 6371 is
+	** the radius of Earth in kilometres. Rounding can take the cosine just
+	** past 1 at the location itself, so it is capped. Only spawns in the grid
+	** cells and bounding box around the location are checked */
+	box := boundingBox(query.Lat, query.Long, query.Radius)
+	condition, boxValues := box.condition()
+	values := []interface{}{query.Lat, query.Long, query.Lat}
+	values = append(values, boxValues...)
+	if query.ItemID != nil {
+		condition += " AND item_id=?"
+		values = append(values, *query.ItemID)
+	}
+	values = append(values, time.Now().UnixNano(), query.Radius, query.Limit)
+	stmt := "SELECT spawn_id, item_id, gcs_lat, gcs_long, quantity, resource_expire, distance FROM (SELECT spawn_id, item_id, gcs_lat, gcs_long, quantity, resource_expire, (6371 * ACOS(LEAST(1, COS(RADIANS(?)) * COS(RADIANS(gcs_lat)) * COS(RADIANS(gcs_long) - RADIANS(?)) + SIN(RADIANS(?)) * SIN(RADIANS(gcs_lat))))) AS distance FROM resources WHERE " +
+		condition + " AND resource_expire >= ? " +
+		"HAVING distance < ? ORDER BY distance ASC LIMIT ?) AS with_distance"
+
+	// Handle no resources case
+	spawns := make([]SpawnResReq, 0)
+	rows, err := db.Query(stmt, values...)
+	if err != nil {
+		return spawns, err
+	}
+	defer rows.Close()
+
+	// Convert result rows into resources response structure
+	for rows.Next() {
+		var spawnRes SpawnResReq
+		var locRes LocationResReq
+		var distance float64
+		err = rows.Scan(&spawnRes.SpawnID, &spawnRes.ItemID, &locRes.Latitude,
+			&locRes.Longitude, &spawnRes.Quantity, &spawnRes.ExpireAt, &distance)
+		if err != nil {
+			return spawns, err
+		}
+		spawnRes.Location = locRes
+		spawnRes.Distance = &distance
+		spawns = append(spawns, spawnRes)
+	}
+	return spawns, rows.Err()
+}
+
+/* Validate auth token and return resources within radius, optionally
+** limited in number and to one item */
 func (a *App) getResources(w http.ResponseWriter, r *http.Request) {
 	_, err := getIDFromToken(a.DB, r)
 	if err != nil {
@@ -242,41 +429,19 @@ func (a *App) getResources(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	/* Get resources within radius, using the Haversine formula, where 6371 is
-	** the radius of Earth in kilometres */
-	stmt := "SELECT item_id, gcs_lat, gcs_long, quantity FROM (SELECT item_id, gcs_lat, gcs_long, quantity, (6371 * ACOS(COS(RADIANS(?)) * COS(RADIANS(gcs_lat)) * COS(RADIANS(gcs_long) - RADIANS(?)) + SIN(RADIANS(?)) * SIN(RADIANS(gcs_lat)))) AS distance FROM resources " +
-		fmt.Sprintf("HAVING distance < %d ", RESOURCE_RADIUS) +
-		"ORDER BY distance ASC) AS with_distance"
-
-	rows, err := a.DB.Query(stmt, lat, long, lat)
+	query, err := parseResourceQuery(r, lat, long, a.MaxRadius)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	defer rows.Close()
 
-	// Convert result rows into resources response structure
-	var resRes ResourcesResReq
-	// Handle no resources case
-	resRes.Spawns = make([]SpawnResReq, 0)
-	for rows.Next() {
-		var spawnRes SpawnResReq
-		var locRes LocationResReq
-		err = rows.Scan(&spawnRes.ItemID, &locRes.Latitude, &locRes.Longitude,
-			&spawnRes.Quantity)
-		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, err.Error())
-			return
-		}
-		spawnRes.Location = locRes
-		resRes.Spawns = append(resRes.Spawns, spawnRes)
-	}
-	// Handle any errors encountered during iteration
-	err = rows.Err()
+	resRes := NearbyResourcesResponse{Limit: query.Limit}
+	resRes.Spawns, err = getNearbySpawns(a.DB, query)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	resRes.Truncated = len(resRes.Spawns) >= query.Limit
 
 	respondWithJSON(w, http.StatusOK, resRes)
 }
@@ -312,6 +477,8 @@ func (a *App) addResources(w http.ResponseWriter, r *http.Request) {
 
 	// Convert resources request into database resources struct
 	var res Resources
+	resRes := ResourcesResReq{Spawns: resReq.Spawns}
+	now := time.Now()
 	for i := 0; i < len(resReq.Spawns); i++ {
 		var spawn Spawn
 		// Create a unique spawn_id
@@ -321,14 +488,16 @@ func (a *App) addResources(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		resRes.Spawns[i].SpawnID = spawn.SpawnID
 		spawn.ItemID = resReq.Spawns[i].ItemID
 		spawn.GCSLat = resReq.Spawns[i].Location.Latitude
 		spawn.GCSLong = resReq.Spawns[i].Location.Longitude
 		spawn.Quantity = resReq.Spawns[i].Quantity
 
 		// Change expiry
-		spawn.ResourceExpire = time.Now().AddDate(resourceExpire[0],
-			resourceExpire[1], resourceExpire[2]).UnixNano()
+		spawn.ResourceExpire = spawnExpire(resReq.Spawns[i], now)
+		resRes.Spawns[i].ExpireIn = 0
+		resRes.Spawns[i].ExpireAt = spawn.ResourceExpire
 
 		res.Spawns = append(res.Spawns, spawn)
 	}
@@ -340,10 +509,11 @@ func (a *App) addResources(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	respondWithEmptyJSON(w, http.StatusOK)
+	respondWithJSON(w, http.StatusOK, resRes)
 }
 
-/* Validate auth token, check user is developer and remove resource(s) */
+/* Validate auth token, check user is developer and remove resource(s) by
+** spawn ID */
 func (a *App) removeResources(w http.ResponseWriter, r *http.Request) {
 	id, err := getIDFromToken(a.DB, r)
 	if err != nil {
@@ -357,34 +527,81 @@ func (a *App) removeResources(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Decode json body into resources request
+	// Decode json body into remove request
 	decoder := json.NewDecoder(r.Body)
-	var resReq ResourcesResReq
-	err = decoder.Decode(&resReq)
+	var removeReq RemoveSpawnsRequest
+	err = decoder.Decode(&removeReq)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid spawn list")
+		respondWithError(w, http.StatusBadRequest, "Invalid spawn ID list")
 		return
 	}
 
-	err = checkValidResources(resReq)
+	// Spawn lists are still accepted until clients have moved to spawn IDs
+	if len(removeReq.Spawns) > 0 {
+		if len(removeReq.SpawnIDs) > 0 {
+			respondWithError(w, http.StatusBadRequest,
+				"Send either spawn IDs or spawns")
+			return
+		}
+		a.removeMatchingSpawns(w, ResourcesResReq{Spawns: removeReq.Spawns})
+		return
+	}
+
+	spawnIDs, err := checkValidSpawnIDs(removeReq)
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	stmt := "DELETE FROM resources WHERE (item_id, gcs_lat, gcs_long, quantity) IN ("
-	values := []interface{}{}
-	for i := 0; i < len(resReq.Spawns); i++ {
-		stmt += "(?, ?, ?, ?), "
-		values = append(values, resReq.Spawns[i].ItemID,
-			resReq.Spawns[i].Location.Latitude,
-			resReq.Spawns[i].Location.Longitude, resReq.Spawns[i].Quantity)
+	a.removeSpawnIDs(w, r, spawnIDs)
+}
+
+/* Validate auth token, check user is developer and remove a single resource
+** by spawn ID */
+func (a *App) removeResource(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromToken(a.DB, r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	err = checkDeveloper(a.DB, id)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	spawnID, err := strconv.ParseUint(mux.Vars(r)["spawn_id"], 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Spawn not found")
+		return
+	}
+
+	a.removeSpawnIDs(w, r, []uint32{uint32(spawnID)})
+}
+
+/* Remove the spawns and respond, removing none of them unless every spawn
+** exists */
+func (a *App) removeSpawnIDs(w http.ResponseWriter, r *http.Request,
+	spawnIDs []uint32) {
+	tx, err := a.DB.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	count, err := removeSpawns(tx, spawnIDs)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if count != int64(len(spawnIDs)) {
+		respondWithError(w, http.StatusNotFound, "Spawn not found")
+		return
 	}
-	// Remove the trailing space and comma, and add closing parenthesis
-	stmt = strings.TrimSuffix(stmt, ", ")
-	stmt += ")"
 
-	_, err = a.DB.Exec(stmt, values...)
+	err = idempotency.Commit(tx, r)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -392,3 +609,169 @@ func (a *App) removeResources(w http.ResponseWriter, r *http.Request) {
 
 	respondWithEmptyJSON(w, http.StatusOK)
 }
+
+/* Remove every spawn matching one in the list by item ID, location and
+** quantity, as the deprecated spawn list body of DELETE /resources did */
+func (a *App) removeMatchingSpawns(w http.ResponseWriter,
+	resReq ResourcesResReq) {
+	w.Header().Set("Deprecation", "true")
+	err := checkValidResources(resReq)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	_, err = removeSpawnsAt(a.DB, resReq.Spawns)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithEmptyJSON(w, http.StatusOK)
+}
+
+/* Validate auth token and collect from a spawn within the collect radius of
+** the player, taking the collected quantity from the spawn and adding it to
+** their inventory in a single transaction. Only as much as fits in the
+** inventory is collected, and the rest is left in the spawn */
+func (a *App) collectResource(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromToken(a.DB, r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	spawnID, err := strconv.ParseUint(mux.Vars(r)["spawn_id"], 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Spawn not found")
+		return
+	}
+
+	// Decode json body into collect request
+	decoder := json.NewDecoder(r.Body)
+	var collectReq CollectRequest
+	err = decoder.Decode(&collectReq)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid collect request")
+		return
+	}
+	err = checkValidLatLong(collectReq.Location.Latitude,
+		collectReq.Location.Longitude)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Query database
+	tx, err := a.DB.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	if !stock.CheckIfMatch(w, r, tx, id) {
+		return
+	}
+
+	spawn := Spawn{SpawnID: uint32(spawnID)}
+	err = spawn.LockSpawn(tx)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Spawn not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// Expired spawns are left for the maintenance job to remove
+	if spawn.ResourceExpire < time.Now().UnixNano() {
+		respondWithError(w, http.StatusGone, "Spawn has expired")
+		return
+	}
+
+	distance := spawn.Distance(collectReq.Location.Latitude,
+		collectReq.Location.Longitude) * 1000
+	if distance > a.CollectRadius {
+		respondWithError(w, http.StatusForbidden, fmt.Sprintf(
+			"Spawn is %.0f metres away, must be within %.0f metres", distance,
+			a.CollectRadius))
+		return
+	}
+
+	// Collect the whole spawn unless a smaller quantity is given
+	quantity := spawn.Quantity
+	if collectReq.Quantity > 0 && collectReq.Quantity < quantity {
+		quantity = collectReq.Quantity
+	}
+	inv := stock.Inventory{Items: []stock.Item{
+		{UserID: id, ItemID: spawn.ItemID, Quantity: quantity},
+	}}
+	accepted, rejections, err := inv.FitInventory(tx, itemCatalog)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(accepted.Items) == 0 {
+		respondWithJSON(w, http.StatusConflict, RejectionResponse{
+			Error:    "Inventory limits exceeded",
+			Rejected: rejections,
+		})
+		return
+	}
+
+	collected := accepted.Items[0].Quantity
+	err = spawn.Collect(tx, collected)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = accepted.AddInventory(tx)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = accepted.LogAdded(tx, stock.LEDGER_COLLECTED, spawn.Source())
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	version, err := stock.GetVersion(tx, id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = idempotency.Commit(tx, r)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("ETag", stock.FormatETag(version))
+
+	respondWithJSON(w, http.StatusOK, CollectResponse{
+		SpawnID:   spawn.SpawnID,
+		ItemID:    spawn.ItemID,
+		Collected: collected,
+		Remaining: spawn.Quantity,
+		Rejected:  rejections,
+	})
+}
+
+/* Validate auth token, check user is developer and return maintenance job
+** metrics */
+func (a *App) getMaintenance(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromToken(a.DB, r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	err = checkDeveloper(a.DB, id)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, a.Maintenance.Metrics())
+}
@@ -11,6 +11,15 @@ type Configuration struct {
 	DBPassword string `json:"dbPassword"`
 	DBHost     string `json:"dbHost"`
 	DBName     string `json:"dbName"`
+	// Maintenance interval in seconds, zero disables the job
+	MaintenanceInterval  int `json:"maintenanceInterval"`
+	MaintenanceBatchSize int `json:"maintenanceBatchSize"`
+	// Time in seconds stored idempotency keys are kept for
+	IdempotencyTTL int `json:"idempotencyTTL"`
+	// Furthest in metres a player may be from a spawn to collect it
+	CollectRadius float64 `json:"collectRadius"`
+	// Largest radius in kilometres players may search for resources within
+	MaxResourceRadius float64 `json:"maxResourceRadius"`
 }
 
 func GetConfiguration(fileName string) (Configuration, error) {
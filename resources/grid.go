@@ -0,0 +1,139 @@
+package main
+
+import (
+	"math"
+	"strings"
+)
+
+/* Spawns are bucketed into a grid of cells, GRID_SIZE degrees a side, and
+** the cell of each spawn is stored in its indexed grid_cell column. Nearby
+** queries look up the cells covering a bounding box around the location
+** before checking the exact distance, rather than scanning every spawn */
+
+// Width of a grid cell in degrees, roughly 1.1km of latitude
+const GRID_SIZE float64 = 0.01
+
+// Number of cells in each row of the grid, around the full circle of longitude
+const GRID_COLUMNS int64 = 36000
+
+// Most cells looked up by a query, beyond which only the bounding box is used,
+// through the index on latitude and longitude. This covers a 5km radius up to
+// around 75 degrees latitude
+const MAX_GRID_CELLS int = 400
+
+// Kilometres in one degree of latitude
+const KM_PER_DEGREE float64 = math.Pi * EARTH_RADIUS / 180
+
+/* A latitude and longitude range around a location. Ranges crossing the
+** antimeridian have a minimum longitude greater than their maximum */
+type BoundingBox struct {
+	MinLat  float64
+	MaxLat  float64
+	MinLong float64
+	MaxLong float64
+}
+
+/* Get the grid cell containing a location */
+func gridCell(lat, long float64) int64 {
+	row, column := gridPosition(lat, long)
+	return row*GRID_COLUMNS + column
+}
+
+/* Get the row and column of the grid cell containing a location */
+func gridPosition(lat, long float64) (int64, int64) {
+	row := int64(math.Floor((lat + 90) / GRID_SIZE))
+	column := int64(math.Floor((long + 180) / GRID_SIZE))
+	return row, ((column % GRID_COLUMNS) + GRID_COLUMNS) % GRID_COLUMNS
+}
+
+/* Get the bounding box of every point within a radius in kilometres of a
+** location. Boxes reaching a pole cover every longitude */
+func boundingBox(lat, long, radius float64) BoundingBox {
+	dLat := radius / KM_PER_DEGREE
+	box := BoundingBox{
+		MinLat:  math.Max(lat-dLat, -90),
+		MaxLat:  math.Min(lat+dLat, 90),
+		MinLong: -180,
+		MaxLong: 180,
+	}
+	if box.MinLat == -90 || box.MaxLat == 90 {
+		return box
+	}
+
+	// Degrees of longitude shrink towards the poles
+	dLong := dLat / math.Cos(lat*math.Pi/180)
+	if dLong >= 180 {
+		return box
+	}
+	box.MinLong = long - dLong
+	box.MaxLong = long + dLong
+	if box.MinLong < -180 {
+		box.MinLong += 360
+	}
+	if box.MaxLong > 180 {
+		box.MaxLong -= 360
+	}
+	return box
+}
+
+/* Check whether the box crosses the antimeridian */
+func (box BoundingBox) wraps() bool {
+	return box.MinLong > box.MaxLong
+}
+
+/* Get the grid cells covering the box, or nil if there are more than
+** MAX_GRID_CELLS of them */
+func (box BoundingBox) cells() []int64 {
+	if box.MinLong == -180 && box.MaxLong == 180 {
+		return nil
+	}
+	minRow, minColumn := gridPosition(box.MinLat, box.MinLong)
+	maxRow, maxColumn := gridPosition(box.MaxLat, box.MaxLong)
+	columns := maxColumn - minColumn + 1
+	if box.wraps() {
+		columns += GRID_COLUMNS
+	}
+	if columns <= 0 || (maxRow-minRow+1)*columns > int64(MAX_GRID_CELLS) {
+		return nil
+	}
+
+	cells := make([]int64, 0)
+	for row := minRow; row <= maxRow; row++ {
+		for i := int64(0); i < columns; i++ {
+			column := (minColumn + i) % GRID_COLUMNS
+			cells = append(cells, row*GRID_COLUMNS+column)
+		}
+	}
+	return cells
+}
+
+/* Build the condition and parameters selecting spawns within the box, by
+** grid cell where possible and always by latitude and longitude */
+func (box BoundingBox) condition() (string, []interface{}) {
+	var conditions []string
+	var values []interface{}
+
+	cells := box.cells()
+	if len(cells) > 0 {
+		stmt := "grid_cell IN ("
+		for i := 0; i < len(cells); i++ {
+			stmt += "?, "
+			values = append(values, cells[i])
+		}
+		// Remove the trailing space and comma, and add closing parenthesis
+		stmt = strings.TrimSuffix(stmt, ", ")
+		stmt += ")"
+		conditions = append(conditions, stmt)
+	}
+
+	conditions = append(conditions, "gcs_lat BETWEEN ? AND ?")
+	values = append(values, box.MinLat, box.MaxLat)
+	if box.wraps() {
+		conditions = append(conditions, "(gcs_long >= ? OR gcs_long <= ?)")
+	} else {
+		conditions = append(conditions, "gcs_long BETWEEN ? AND ?")
+	}
+	values = append(values, box.MinLong, box.MaxLong)
+
+	return strings.Join(conditions, " AND "), values
+}
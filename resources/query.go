@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+/* Options for finding nearby resources, from the URL parameters:
+**   lat, long - the location to search around
+**   radius    - kilometres to search within, capped at the maximum radius
+**   limit     - most spawns to return, nearest first
+**   item_id   - only return spawns of the item */
+type ResourceQuery struct {
+	Lat    float64
+	Long   float64
+	Radius float64
+	Limit  int
+	ItemID *uint32
+}
+
+// Spawns returned by a query when no limit is given
+const RESOURCE_LIMIT int = 100
+
+// Most spawns returned by a query, whatever limit is given
+const MAX_RESOURCE_LIMIT int = 500
+
+/* Parse the optional parameters of a resources query around a location,
+** with the radius capped at maxRadius */
+func parseResourceQuery(r *http.Request, lat, long,
+	maxRadius float64) (ResourceQuery, error) {
+	query := ResourceQuery{
+		Lat:    lat,
+		Long:   long,
+		Radius: RESOURCE_RADIUS,
+		Limit:  RESOURCE_LIMIT,
+	}
+	params := r.URL.Query()
+
+	if param := params.Get("radius"); param != "" {
+		value, err := strconv.ParseFloat(param, 64)
+		if err != nil || !(value > 0) {
+			return query, errors.New("Invalid radius")
+		}
+		query.Radius = value
+	}
+	if query.Radius > maxRadius {
+		query.Radius = maxRadius
+	}
+
+	if param := params.Get("limit"); param != "" {
+		value, err := strconv.Atoi(param)
+		if err != nil || value <= 0 {
+			return query, errors.New("Invalid limit")
+		}
+		query.Limit = value
+		if query.Limit > MAX_RESOURCE_LIMIT {
+			query.Limit = MAX_RESOURCE_LIMIT
+		}
+	}
+
+	if param := params.Get("item_id"); param != "" {
+		value, err := strconv.ParseUint(param, 10, 32)
+		if err != nil || !itemCatalog.IsValid(uint32(value)) {
+			return query, errors.New("Invalid item ID")
+		}
+		itemID := uint32(value)
+		query.ItemID = &itemID
+	}
+	return query, nil
+}
@@ -6,10 +6,15 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
+
+	"github.com/jaylees14/Manhattan-Server/catalog"
+	"github.com/jaylees14/Manhattan-Server/maintenance"
 )
 
 const DEV_ACCESS_TOKEN string = "Bearer ydzvGQg2EcjTTHLSVHb7JTpkSRDdd0hQu2n5YPEM4CTfnqQIrqnufSIIOWchPNSZ"
@@ -62,13 +67,32 @@ func checkResourcesTableExistsEmpty() error {
 	return nil
 }
 
-func clearResourcesTable(t *testing.T) {
+func clearResourcesTable(t testing.TB) {
 	_, err := testA.DB.Exec("DELETE FROM resources")
 	if err != nil {
 		t.Errorf("Failed to clear resources table")
 	}
 }
 
+func clearInventoryTables(t *testing.T) {
+	_, err := testA.DB.Exec("DELETE FROM inventory")
+	if err != nil {
+		t.Errorf("Failed to clear inventory table")
+	}
+	_, err = testA.DB.Exec("DELETE FROM inventory_version")
+	if err != nil {
+		t.Errorf("Failed to clear inventory version table")
+	}
+	_, err = testA.DB.Exec("DELETE FROM ledger")
+	if err != nil {
+		t.Errorf("Failed to clear ledger table")
+	}
+	_, err = testA.DB.Exec("DELETE FROM event")
+	if err != nil {
+		t.Errorf("Failed to clear event table")
+	}
+}
+
 func executeRequest(req *http.Request) *httptest.ResponseRecorder {
 	rec := httptest.NewRecorder()
 	testA.Router.ServeHTTP(rec, req)
@@ -81,6 +105,20 @@ func checkResponseCode(t *testing.T, expected, actual int) {
 	}
 }
 
+/* Get the spawn IDs from a resources response */
+func getSpawnIDs(t *testing.T, res *httptest.ResponseRecorder) []uint32 {
+	var resources ResourcesResReq
+	err := json.NewDecoder(res.Body).Decode(&resources)
+	if err != nil {
+		t.Errorf("Failed to decode resources response")
+	}
+	spawnIDs := make([]uint32, 0)
+	for i := 0; i < len(resources.Spawns); i++ {
+		spawnIDs = append(spawnIDs, resources.Spawns[i].SpawnID)
+	}
+	return spawnIDs
+}
+
 /* Check omitting latitude and longitude parameters is not accepted */
 func TestGetMissingParameters(t *testing.T) {
 	clearResourcesTable(t)
@@ -255,6 +293,9 @@ func TestAddGetResourcesWithinRadius(t *testing.T) {
 		t.Errorf("Expected 1 resource. Actual number was %d",
 			len(resources.Spawns))
 	}
+	if resources.Spawns[0].SpawnID == 0 {
+		t.Errorf("Expected a spawn ID")
+	}
 	if resources.Spawns[0].ItemID != 5 {
 		t.Errorf("Expected item ID 5. Actual ID was %d",
 			resources.Spawns[0].ItemID)
@@ -387,8 +428,13 @@ func TestAddRemoveOnlyDeveloper(t *testing.T) {
 
 	res = executeRequest(req)
 	checkResponseCode(t, http.StatusOK, res.Code)
+	spawnIDs := getSpawnIDs(t, res)
+	if len(spawnIDs) != 1 {
+		t.Fatalf("Expected 1 spawn ID. Actual number was %d", len(spawnIDs))
+	}
+	payload = []byte(fmt.Sprintf(`{"spawn_ids":[%d]}`, spawnIDs[0]))
 
-	// Remove resource with normal account
+	// Remove resource with normal account, by list and by ID
 	req, err = http.NewRequest(http.MethodDelete, "/api/v1/resources",
 		bytes.NewBuffer(payload))
 	req.Header.Set("Authorization", NORMAL_ACCESS_TOKEN)
@@ -399,6 +445,16 @@ func TestAddRemoveOnlyDeveloper(t *testing.T) {
 	res = executeRequest(req)
 	checkResponseCode(t, http.StatusUnauthorized, res.Code)
 
+	req, err = http.NewRequest(http.MethodDelete,
+		fmt.Sprintf("/api/v1/resources/%d", spawnIDs[0]), nil)
+	req.Header.Set("Authorization", NORMAL_ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, res.Code)
+
 	// Remove resource with developer account
 	req, err = http.NewRequest(http.MethodDelete, "/api/v1/resources",
 		bytes.NewBuffer(payload))
@@ -411,7 +467,8 @@ func TestAddRemoveOnlyDeveloper(t *testing.T) {
 	checkResponseCode(t, http.StatusOK, res.Code)
 }
 
-/* Check empty spawn lists are not accepted for adding and removing */
+/* Check empty spawn and spawn ID lists are not accepted for adding and
+** removing */
 func TestAddRemoveEmptyResources(t *testing.T) {
 	clearResourcesTable(t)
 
@@ -429,6 +486,7 @@ func TestAddRemoveEmptyResources(t *testing.T) {
 	checkResponseCode(t, http.StatusBadRequest, res.Code)
 
 	// Remove
+	payload = []byte(`{"spawn_ids":[]}`)
 	req, err = http.NewRequest(http.MethodDelete, "/api/v1/resources",
 		bytes.NewBuffer(payload))
 	req.Header.Set("Authorization", DEV_ACCESS_TOKEN)
@@ -440,7 +498,7 @@ func TestAddRemoveEmptyResources(t *testing.T) {
 	checkResponseCode(t, http.StatusBadRequest, res.Code)
 }
 
-/* Check spawn lists with invalid item IDs are not accepting for adding and
+/* Check spawn lists with invalid item IDs are not accepted for adding and
 ** removing */
 func TestAddRemoveInvalidItemID(t *testing.T) {
 	clearResourcesTable(t)
@@ -471,6 +529,29 @@ func TestAddRemoveInvalidItemID(t *testing.T) {
 
 }
 
+/* Check only primary resources can be spawned, so steel (13) and electricity
+** (32) are not accepted */
+func TestAddNonPrimaryResource(t *testing.T) {
+	clearResourcesTable(t)
+
+	payloads := [][]byte{
+		[]byte(`{"spawns":[{"item_id":13,"location":{"latitude":51.456061,"longitude":-2.603104},"quantity":3}]}`),
+		[]byte(`{"spawns":[{"item_id":32,"location":{"latitude":51.456061,"longitude":-2.603104},"quantity":3}]}`),
+	}
+
+	for i := 0; i < len(payloads); i++ {
+		req, err := http.NewRequest(http.MethodPost, "/api/v1/resources",
+			bytes.NewBuffer(payloads[i]))
+		req.Header.Set("Authorization", DEV_ACCESS_TOKEN)
+		if err != nil {
+			t.Errorf("Failed to create request")
+		}
+
+		res := executeRequest(req)
+		checkResponseCode(t, http.StatusBadRequest, res.Code)
+	}
+}
+
 /* Check spawn lists with invalid latitudes or longitudes are not accepted for
 ** adding and removing */
 func TestAddRemoveInvalidLatLong(t *testing.T) {
@@ -558,13 +639,14 @@ func TestAddRemoveInvalidQuantity(t *testing.T) {
 
 }
 
-/* Check removing resource removes resource */
+/* Check removing resources by spawn ID removes only those spawns, and a
+** list with a missing spawn removes none of them */
 func TestRemoveResource(t *testing.T) {
 	clearResourcesTable(t)
 
-	payload := []byte(`{"spawns":[{"item_id":5,"location":{"latitude":51.456061,"longitude":-2.603104},"quantity":3}]}`)
+	// Add identical spawns
+	payload := []byte(`{"spawns":[{"item_id":5,"location":{"latitude":51.456061,"longitude":-2.603104},"quantity":3},{"item_id":5,"location":{"latitude":51.456061,"longitude":-2.603104},"quantity":3}]}`)
 
-	// Add
 	req, err := http.NewRequest(http.MethodPost, "/api/v1/resources",
 		bytes.NewBuffer(payload))
 	req.Header.Set("Authorization", DEV_ACCESS_TOKEN)
@@ -574,8 +656,58 @@ func TestRemoveResource(t *testing.T) {
 
 	res := executeRequest(req)
 	checkResponseCode(t, http.StatusOK, res.Code)
+	spawnIDs := getSpawnIDs(t, res)
+	if len(spawnIDs) != 2 {
+		t.Fatalf("Expected 2 spawn IDs. Actual number was %d", len(spawnIDs))
+	}
 
-	// Remove
+	// Remove the first by ID
+	req, err = http.NewRequest(http.MethodDelete,
+		fmt.Sprintf("/api/v1/resources/%d", spawnIDs[0]), nil)
+	req.Header.Set("Authorization", DEV_ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	// Removing it again is not found
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, res.Code)
+
+	// Check only the second remains
+	req, err = http.NewRequest(http.MethodGet,
+		"/api/v1/resources?lat=51.456061&long=-2.603104", nil)
+	req.Header.Set("Authorization", NORMAL_ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+	remaining := getSpawnIDs(t, res)
+	if len(remaining) != 1 || remaining[0] != spawnIDs[1] {
+		t.Errorf("Expected only spawn ID %d to remain. Actual was %v",
+			spawnIDs[1], remaining)
+	}
+
+	// A list including the removed spawn removes nothing
+	payload = []byte(fmt.Sprintf(`{"spawn_ids":[%d,%d]}`, spawnIDs[1],
+		spawnIDs[0]))
+	req, err = http.NewRequest(http.MethodDelete, "/api/v1/resources",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", DEV_ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, res.Code)
+
+	// Remove the second by list, repeated IDs are only removed once
+	payload = []byte(fmt.Sprintf(`{"spawn_ids":[%d,%d]}`, spawnIDs[1],
+		spawnIDs[1]))
 	req, err = http.NewRequest(http.MethodDelete, "/api/v1/resources",
 		bytes.NewBuffer(payload))
 	req.Header.Set("Authorization", DEV_ACCESS_TOKEN)
@@ -609,3 +741,621 @@ func TestRemoveResource(t *testing.T) {
 			len(resources.Spawns))
 	}
 }
+
+/* Check the deprecated spawn list body still removes spawns matching by item
+** ID, location and quantity, and is marked as deprecated */
+func TestRemoveResourceDeprecatedSpawns(t *testing.T) {
+	clearResourcesTable(t)
+
+	payload := []byte(`{"spawns":[{"item_id":5,"location":{"latitude":51.456061,"longitude":-2.603104},"quantity":3}]}`)
+
+	// Add
+	req, err := http.NewRequest(http.MethodPost, "/api/v1/resources",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", DEV_ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+	spawnIDs := getSpawnIDs(t, res)
+	if len(spawnIDs) != 1 {
+		t.Fatalf("Expected 1 spawn ID. Actual number was %d", len(spawnIDs))
+	}
+
+	// Spawn IDs and spawns cannot be sent together
+	both := []byte(fmt.Sprintf(`{"spawn_ids":[%d],"spawns":[{"item_id":5,"location":{"latitude":51.456061,"longitude":-2.603104},"quantity":3}]}`,
+		spawnIDs[0]))
+	req, err = http.NewRequest(http.MethodDelete, "/api/v1/resources",
+		bytes.NewBuffer(both))
+	req.Header.Set("Authorization", DEV_ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, res.Code)
+
+	// Remove by spawn list
+	req, err = http.NewRequest(http.MethodDelete, "/api/v1/resources",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", DEV_ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+	if res.Header().Get("Deprecation") != "true" {
+		t.Errorf("Expected the spawn list body to be marked as deprecated")
+	}
+
+	// Check the spawn was removed
+	req, err = http.NewRequest(http.MethodDelete,
+		fmt.Sprintf("/api/v1/resources/%d", spawnIDs[0]), nil)
+	req.Header.Set("Authorization", DEV_ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, res.Code)
+}
+
+/* Check expired spawns are not returned or collected */
+func TestGetCollectExpiredResources(t *testing.T) {
+	clearResourcesTable(t)
+	clearInventoryTables(t)
+
+	var resources Resources
+	resources.Spawns = []Spawn{
+		{SpawnID: 1, ItemID: 5, GCSLat: 51.456061, GCSLong: -2.603104,
+			Quantity: 3, ResourceExpire: 1},
+		{SpawnID: 2, ItemID: 6, GCSLat: 51.456061, GCSLong: -2.603104,
+			Quantity: 3, ResourceExpire: 9223372036854775807},
+	}
+	err := resources.AddResources(testA.DB)
+	if err != nil {
+		t.Errorf("Failed to add resources")
+	}
+
+	req, err := http.NewRequest(http.MethodGet,
+		"/api/v1/resources?lat=51.456061&long=-2.603104", nil)
+	req.Header.Set("Authorization", NORMAL_ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+	spawnIDs := getSpawnIDs(t, res)
+	if len(spawnIDs) != 1 || spawnIDs[0] != 2 {
+		t.Errorf("Expected only spawn ID 2. Actual was %v", spawnIDs)
+	}
+
+	payload := []byte(`{"location":{"latitude":51.456061,"longitude":-2.603104}}`)
+	req, err = http.NewRequest(http.MethodPost, "/api/v1/resources/1/collect",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", NORMAL_ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusGone, res.Code)
+}
+
+/* Check spawns can be added with an expiry duration or time, but not both
+** or a time in the past */
+func TestAddResourceExpiry(t *testing.T) {
+	clearResourcesTable(t)
+
+	now := time.Now()
+	expireAt := now.Add(2 * time.Hour).UnixNano()
+	payload := []byte(fmt.Sprintf(`{"spawns":[{"item_id":5,"location":{"latitude":51.456061,"longitude":-2.603104},"quantity":3,"expire_in":3600},{"item_id":5,"location":{"latitude":51.456061,"longitude":-2.603104},"quantity":3,"expire_at":%d}]}`,
+		expireAt))
+	req, err := http.NewRequest(http.MethodPost, "/api/v1/resources",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", DEV_ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var resources ResourcesResReq
+	err = json.NewDecoder(res.Body).Decode(&resources)
+	if err != nil || len(resources.Spawns) != 2 {
+		t.Fatalf("Failed to decode resources response")
+	}
+	expireIn := resources.Spawns[0].ExpireAt - now.UnixNano()
+	if expireIn < int64(time.Hour) || expireIn > int64(time.Hour+time.Minute) {
+		t.Errorf("Expected the first spawn to expire in an hour. Actual was %d",
+			expireIn)
+	}
+	if resources.Spawns[1].ExpireAt != expireAt {
+		t.Errorf("Expected the second spawn to expire at %d. Actual was %d",
+			expireAt, resources.Spawns[1].ExpireAt)
+	}
+
+	var resourceExpire int64
+	err = testA.DB.QueryRow("SELECT resource_expire FROM resources WHERE spawn_id=?",
+		resources.Spawns[1].SpawnID).Scan(&resourceExpire)
+	if err != nil || resourceExpire != expireAt {
+		t.Errorf("Expected the stored expiry to be %d. Actual was %d",
+			expireAt, resourceExpire)
+	}
+
+	// Both a duration and a time
+	payload = []byte(fmt.Sprintf(`{"spawns":[{"item_id":5,"location":{"latitude":51.456061,"longitude":-2.603104},"quantity":3,"expire_in":3600,"expire_at":%d}]}`,
+		expireAt))
+	req, err = http.NewRequest(http.MethodPost, "/api/v1/resources",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", DEV_ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, res.Code)
+
+	// A time in the past
+	payload = []byte(fmt.Sprintf(`{"spawns":[{"item_id":5,"location":{"latitude":51.456061,"longitude":-2.603104},"quantity":3,"expire_at":%d}]}`,
+		now.Add(-time.Hour).UnixNano()))
+	req, err = http.NewRequest(http.MethodPost, "/api/v1/resources",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", DEV_ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, res.Code)
+}
+
+/* Check collecting a spawn requires the player to be nearby, takes the
+** collected quantity from the spawn and adds it to their inventory */
+func TestCollectResource(t *testing.T) {
+	clearResourcesTable(t)
+	clearInventoryTables(t)
+
+	var resources Resources
+	resources.Spawns = []Spawn{
+		{SpawnID: 1, ItemID: 5, GCSLat: 51.456061, GCSLong: -2.603104,
+			Quantity: 5, ResourceExpire: 9223372036854775807},
+	}
+	err := resources.AddResources(testA.DB)
+	if err != nil {
+		t.Errorf("Failed to add resources")
+	}
+
+	// Collect from over a kilometre away
+	payload := []byte(`{"location":{"latitude":51.466061,"longitude":-2.603104},"quantity":2}`)
+	req, err := http.NewRequest(http.MethodPost, "/api/v1/resources/1/collect",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", NORMAL_ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusForbidden, res.Code)
+
+	// Collect part of the spawn from nearby
+	payload = []byte(`{"location":{"latitude":51.456100,"longitude":-2.603150},"quantity":2}`)
+	req, err = http.NewRequest(http.MethodPost, "/api/v1/resources/1/collect",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", NORMAL_ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+	if res.Header().Get("ETag") == "" {
+		t.Errorf("Expected an ETag header")
+	}
+
+	var collectRes CollectResponse
+	err = json.NewDecoder(res.Body).Decode(&collectRes)
+	if err != nil {
+		t.Errorf("Failed to decode collect response")
+	}
+	if collectRes.Collected != 2 || collectRes.Remaining != 3 {
+		t.Errorf("Expected 2 collected and 3 remaining. Actual was %d and %d",
+			collectRes.Collected, collectRes.Remaining)
+	}
+
+	// Collect the rest, removing the spawn
+	payload = []byte(`{"location":{"latitude":51.456100,"longitude":-2.603150}}`)
+	req, err = http.NewRequest(http.MethodPost, "/api/v1/resources/1/collect",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", NORMAL_ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var count Count
+	err = testA.DB.QueryRow("SELECT COUNT(*) FROM resources").Scan(&count.Value)
+	if err != nil || count.Value != 0 {
+		t.Errorf("Expected the spawn to be removed")
+	}
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, res.Code)
+
+	// Check the inventory and ledger
+	var quantity uint32
+	err = testA.DB.QueryRow(
+		"SELECT quantity FROM inventory WHERE user_id=2121631167 AND item_id=5").Scan(
+		&quantity)
+	if err != nil || quantity != 5 {
+		t.Errorf("Expected 5 of item 5 in inventory. Actual was %d", quantity)
+	}
+	err = testA.DB.QueryRow(
+		"SELECT COUNT(*) FROM ledger WHERE user_id=2121631167 AND reason='collected' AND source='spawn:1'").Scan(
+		&count.Value)
+	if err != nil || count.Value != 2 {
+		t.Errorf("Expected 2 collected ledger entries. Actual was %d",
+			count.Value)
+	}
+}
+
+/* Check collecting is limited by the max stack of the item and the free
+** inventory slots, leaving the rest in the spawn */
+func TestCollectResourceLimits(t *testing.T) {
+	clearResourcesTable(t)
+	clearInventoryTables(t)
+
+	var resources Resources
+	resources.Spawns = []Spawn{
+		{SpawnID: 1, ItemID: 5, GCSLat: 51.456061, GCSLong: -2.603104,
+			Quantity: 5, ResourceExpire: 9223372036854775807},
+		{SpawnID: 2, ItemID: 6, GCSLat: 51.456061, GCSLong: -2.603104,
+			Quantity: 5, ResourceExpire: 9223372036854775807},
+	}
+	err := resources.AddResources(testA.DB)
+	if err != nil {
+		t.Errorf("Failed to add resources")
+	}
+
+	// Only 2 more of item 5 fit in the stack
+	_, err = testA.DB.Exec("INSERT INTO inventory VALUES (2121631167, 5, ?)",
+		itemCatalog.MaxStack(5)-2)
+	if err != nil {
+		t.Errorf("Failed to add inventory")
+	}
+
+	payload := []byte(`{"location":{"latitude":51.456100,"longitude":-2.603150}}`)
+	req, err := http.NewRequest(http.MethodPost, "/api/v1/resources/1/collect",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", NORMAL_ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var collectRes CollectResponse
+	err = json.NewDecoder(res.Body).Decode(&collectRes)
+	if err != nil {
+		t.Errorf("Failed to decode collect response")
+	}
+	if collectRes.Collected != 2 || collectRes.Remaining != 3 {
+		t.Errorf("Expected 2 collected and 3 remaining. Actual was %d and %d",
+			collectRes.Collected, collectRes.Remaining)
+	}
+	if len(collectRes.Rejected) != 1 ||
+		collectRes.Rejected[0].Reason != catalog.REASON_STACK_LIMIT {
+		t.Errorf("Expected the rest of the spawn to be rejected by the stack limit")
+	}
+
+	// Fill every other slot, leaving no slot for item 6
+	held := 1
+	for i := 0; i < len(itemCatalog.Schema.Items) &&
+		uint32(held) < itemCatalog.SlotCapacity(); i++ {
+		itemID := itemCatalog.Schema.Items[i].ItemID
+		if itemID == 5 || itemID == 6 || !itemCatalog.IsStorable(itemID) {
+			continue
+		}
+		_, err = testA.DB.Exec("INSERT INTO inventory VALUES (2121631167, ?, 1)",
+			itemID)
+		if err != nil {
+			t.Errorf("Failed to add inventory")
+		}
+		held++
+	}
+	if uint32(held) < itemCatalog.SlotCapacity() {
+		t.Skip("Item schema has no more items than inventory slots")
+	}
+
+	req, err = http.NewRequest(http.MethodPost, "/api/v1/resources/2/collect",
+		bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", NORMAL_ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusConflict, res.Code)
+
+	var rejectionRes RejectionResponse
+	err = json.NewDecoder(res.Body).Decode(&rejectionRes)
+	if err != nil {
+		t.Errorf("Failed to decode rejection response")
+	}
+	if len(rejectionRes.Rejected) != 1 ||
+		rejectionRes.Rejected[0].Reason != catalog.REASON_NO_SLOT {
+		t.Errorf("Expected the spawn to be rejected for a free slot")
+	}
+
+	var count Count
+	err = testA.DB.QueryRow(
+		"SELECT COUNT(*) FROM inventory WHERE user_id=2121631167 AND item_id=6").Scan(
+		&count.Value)
+	if err != nil || count.Value != 0 {
+		t.Errorf("Expected no item 6 in inventory")
+	}
+	var quantity uint32
+	err = testA.DB.QueryRow("SELECT quantity FROM resources WHERE spawn_id=2").Scan(
+		&quantity)
+	if err != nil || quantity != 5 {
+		t.Errorf("Expected 5 left in spawn 2. Actual was %d", quantity)
+	}
+}
+
+/* Check nearby spawns are found across grid cell edges and the
+** antimeridian, and spawns just outside the radius are not */
+func TestGetResourcesAcrossGridCells(t *testing.T) {
+	clearResourcesTable(t)
+
+	var resources Resources
+	resources.Spawns = []Spawn{
+		{SpawnID: 1, ItemID: 5, GCSLat: 51.50001, GCSLong: -2.60001,
+			Quantity: 3, ResourceExpire: 9223372036854775807},
+		{SpawnID: 2, ItemID: 5, GCSLat: 51.49999, GCSLong: -2.59999,
+			Quantity: 3, ResourceExpire: 9223372036854775807},
+		{SpawnID: 3, ItemID: 5, GCSLat: 51.51, GCSLong: -2.6,
+			Quantity: 3, ResourceExpire: 9223372036854775807},
+		{SpawnID: 4, ItemID: 5, GCSLat: 0.001, GCSLong: 179.999,
+			Quantity: 3, ResourceExpire: 9223372036854775807},
+	}
+	err := resources.AddResources(testA.DB)
+	if err != nil {
+		t.Errorf("Failed to add resources")
+	}
+
+	// Spawns 1 and 2 are in different cells, and 3 is over a kilometre away
+	spawns, err := getNearbySpawns(testA.DB, ResourceQuery{
+		Lat: 51.5, Long: -2.6, Radius: 1, Limit: 10,
+	})
+	if err != nil {
+		t.Errorf("Failed to get nearby spawns: %s", err)
+	}
+	if len(spawns) != 2 {
+		t.Errorf("Expected 2 spawns. Actual number was %d", len(spawns))
+	}
+
+	spawns, err = getNearbySpawns(testA.DB, ResourceQuery{
+		Lat: 0, Long: -179.999, Radius: 1, Limit: 10,
+	})
+	if err != nil {
+		t.Errorf("Failed to get nearby spawns: %s", err)
+	}
+	if len(spawns) != 1 || spawns[0].SpawnID != 4 {
+		t.Errorf("Expected spawn 4 across the antimeridian")
+	}
+}
+
+/* Check the radius, limit and item ID parameters, and that each spawn's
+** distance is returned nearest first */
+func TestGetResourcesQuery(t *testing.T) {
+	clearResourcesTable(t)
+
+	// Spawns at the location, around 0.5km north and around 3km north
+	var resources Resources
+	resources.Spawns = []Spawn{
+		{SpawnID: 1, ItemID: 5, GCSLat: 51.456061, GCSLong: -2.603104,
+			Quantity: 3, ResourceExpire: 9223372036854775807},
+		{SpawnID: 2, ItemID: 6, GCSLat: 51.460561, GCSLong: -2.603104,
+			Quantity: 3, ResourceExpire: 9223372036854775807},
+		{SpawnID: 3, ItemID: 5, GCSLat: 51.483061, GCSLong: -2.603104,
+			Quantity: 3, ResourceExpire: 9223372036854775807},
+	}
+	err := resources.AddResources(testA.DB)
+	if err != nil {
+		t.Errorf("Failed to add resources")
+	}
+
+	tests := []struct {
+		params    string
+		code      int
+		spawnIDs  []uint32
+		limit     int
+		truncated bool
+	}{
+		{"", http.StatusOK, []uint32{1, 2}, RESOURCE_LIMIT, false},
+		{"&radius=4", http.StatusOK, []uint32{1, 2, 3}, RESOURCE_LIMIT, false},
+		{"&radius=1000", http.StatusOK, []uint32{1, 2, 3}, RESOURCE_LIMIT, false},
+		{"&radius=4&limit=2", http.StatusOK, []uint32{1, 2}, 2, true},
+		{"&radius=4&limit=1000", http.StatusOK, []uint32{1, 2, 3},
+			MAX_RESOURCE_LIMIT, false},
+		{"&radius=4&item_id=5", http.StatusOK, []uint32{1, 3}, RESOURCE_LIMIT,
+			false},
+		{"&radius=0", http.StatusBadRequest, nil, 0, false},
+		{"&radius=one", http.StatusBadRequest, nil, 0, false},
+		{"&limit=0", http.StatusBadRequest, nil, 0, false},
+		{"&item_id=999", http.StatusBadRequest, nil, 0, false},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(http.MethodGet,
+			"/api/v1/resources?lat=51.456061&long=-2.603104"+test.params, nil)
+		req.Header.Set("Authorization", NORMAL_ACCESS_TOKEN)
+		if err != nil {
+			t.Errorf("Failed to create request")
+		}
+
+		res := executeRequest(req)
+		checkResponseCode(t, test.code, res.Code)
+		if test.code != http.StatusOK {
+			continue
+		}
+
+		var resources NearbyResourcesResponse
+		err = json.NewDecoder(res.Body).Decode(&resources)
+		if err != nil {
+			t.Errorf("Failed to decode resources response")
+		}
+		if resources.Limit != test.limit {
+			t.Errorf("Expected limit %d for %q. Actual limit was %d",
+				test.limit, test.params, resources.Limit)
+		}
+		if resources.Truncated != test.truncated {
+			t.Errorf("Expected truncated %t for %q. Actual was %t",
+				test.truncated, test.params, resources.Truncated)
+		}
+		if len(resources.Spawns) != len(test.spawnIDs) {
+			t.Errorf("Expected %d spawns for %q. Actual number was %d",
+				len(test.spawnIDs), test.params, len(resources.Spawns))
+			continue
+		}
+		for i := 0; i < len(resources.Spawns); i++ {
+			if resources.Spawns[i].SpawnID != test.spawnIDs[i] {
+				t.Errorf("Expected spawn ID %d for %q. Actual ID was %d",
+					test.spawnIDs[i], test.params, resources.Spawns[i].SpawnID)
+			}
+			if resources.Spawns[i].Distance == nil {
+				t.Errorf("Expected a distance for spawn ID %d",
+					resources.Spawns[i].SpawnID)
+			}
+		}
+		if resources.Spawns[0].Distance != nil &&
+			*resources.Spawns[0].Distance > 0.001 {
+			t.Errorf("Expected spawn ID 1 at the location. Actual distance was %f",
+				*resources.Spawns[0].Distance)
+		}
+	}
+}
+
+/* Check the maintenance job purges expired resources and keeps valid ones */
+func TestMaintenancePurgeResources(t *testing.T) {
+	clearResourcesTable(t)
+
+	var resources Resources
+	resources.Spawns = []Spawn{
+		{SpawnID: 1, ItemID: 5, GCSLat: 51.456061, GCSLong: -2.603104,
+			Quantity: 3, ResourceExpire: 1},
+		{SpawnID: 2, ItemID: 6, GCSLat: 51.456061, GCSLong: -2.603104,
+			Quantity: 3, ResourceExpire: 9223372036854775807},
+	}
+	err := resources.AddResources(testA.DB)
+	if err != nil {
+		t.Errorf("Failed to add resources")
+	}
+
+	err = testA.Maintenance.Run()
+	if err != nil {
+		t.Errorf("Maintenance run failed: %s", err)
+	}
+
+	// Check only the valid spawn remains
+	var spawnID ID
+	err = testA.DB.QueryRow("SELECT spawn_id FROM resources").Scan(&spawnID.Value)
+	if err != nil {
+		t.Errorf("Expected exactly one spawn to remain")
+	}
+	if spawnID.Value != 2 {
+		t.Errorf("Expected spawn ID 2 to remain. Actual ID was %d", spawnID.Value)
+	}
+}
+
+/* Check only developers can view maintenance metrics */
+func TestGetMaintenanceOnlyDeveloper(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "/api/v1/resources/maintenance",
+		nil)
+	req.Header.Set("Authorization", NORMAL_ACCESS_TOKEN)
+	if err != nil {
+		t.Errorf("Failed to create request")
+	}
+
+	res := executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, res.Code)
+
+	req.Header.Set("Authorization", DEV_ACCESS_TOKEN)
+
+	res = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, res.Code)
+
+	var metrics maintenance.Metrics
+	err = json.NewDecoder(res.Body).Decode(&metrics)
+	if err != nil {
+		t.Errorf("Failed to decode maintenance metrics")
+	}
+}
+
+// Spawns seeded for benchmarks, spread over Great Britain
+const BENCHMARK_SPAWNS int = 1000000
+const BENCHMARK_BATCH_SIZE int = 1000
+
+// Nearby query scanning every spawn, as before the grid was added
+const FULL_SCAN_STMT string = "SELECT spawn_id, item_id, gcs_lat, gcs_long, quantity, resource_expire FROM (SELECT spawn_id, item_id, gcs_lat, gcs_long, quantity, resource_expire, (6371 * ACOS(COS(RADIANS(?)) * COS(RADIANS(gcs_lat)) * COS(RADIANS(gcs_long) - RADIANS(?)) + SIN(RADIANS(?)) * SIN(RADIANS(gcs_lat)))) AS distance FROM resources WHERE resource_expire >= ? HAVING distance < 1 ORDER BY distance ASC) AS with_distance"
+
+/* Add spawns at random locations in Great Britain, in batches */
+func seedBenchmarkSpawns(b *testing.B, count int) {
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < count; i += BENCHMARK_BATCH_SIZE {
+		var resources Resources
+		for j := i; j < i+BENCHMARK_BATCH_SIZE && j < count; j++ {
+			resources.Spawns = append(resources.Spawns, Spawn{
+				SpawnID:        uint32(j + 1),
+				ItemID:         5,
+				GCSLat:         49.9 + random.Float64()*8.8,
+				GCSLong:        -8 + random.Float64()*9.8,
+				Quantity:       3,
+				ResourceExpire: 9223372036854775807,
+			})
+		}
+		err := resources.AddResources(testA.DB)
+		if err != nil {
+			b.Fatalf("Failed to add resources: %s", err)
+		}
+	}
+}
+
+/* Compare nearby queries using the grid with scanning every spawn, at 1M
+** spawns. Run with go test -run NONE -bench GetResources -benchtime 20x */
+func BenchmarkGetResources(b *testing.B) {
+	clearResourcesTable(b)
+	defer clearResourcesTable(b)
+	seedBenchmarkSpawns(b, BENCHMARK_SPAWNS)
+
+	b.Run("Grid", func(b *testing.B) {
+		query := ResourceQuery{Lat: 51.456061, Long: -2.603104, Radius: 1,
+			Limit: MAX_RESOURCE_LIMIT}
+		for i := 0; i < b.N; i++ {
+			_, err := getNearbySpawns(testA.DB, query)
+			if err != nil {
+				b.Fatalf("Failed to get nearby spawns: %s", err)
+			}
+		}
+	})
+
+	b.Run("FullScan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			rows, err := testA.DB.Query(FULL_SCAN_STMT, 51.456061, -2.603104,
+				51.456061, time.Now().UnixNano())
+			if err != nil {
+				b.Fatalf("Failed to scan spawns: %s", err)
+			}
+			for rows.Next() {
+			}
+			rows.Close()
+		}
+	})
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
+	"math"
 	"strings"
 )
 
@@ -9,6 +11,9 @@ type Resources struct {
 	Spawns []Spawn `json:"spawns"`
 }
 
+// Radius of Earth in kilometres, for the Haversine formula
+const EARTH_RADIUS float64 = 6371
+
 type Spawn struct {
 	SpawnID        uint32  `json:"spawn_id"`
 	ItemID         uint32  `json:"item_id"`
@@ -18,15 +23,17 @@ type Spawn struct {
 	ResourceExpire int64   `json:"resource_expire"`
 }
 
-/* Add a variable number of resources */
+/* Add a variable number of resources, each in the grid cell of its
+** location */
 func (res *Resources) AddResources(db *sql.DB) error {
 	stmt := "INSERT INTO resources VALUES"
 	values := []interface{}{}
 	for i := 0; i < len(res.Spawns); i++ {
-		stmt += " (?, ?, ?, ?, ?, ?),"
+		stmt += " (?, ?, ?, ?, ?, ?, ?),"
 		values = append(values, res.Spawns[i].SpawnID, res.Spawns[i].ItemID,
-			res.Spawns[i].GCSLat, res.Spawns[i].GCSLong, res.Spawns[i].Quantity,
-			res.Spawns[i].ResourceExpire)
+			res.Spawns[i].GCSLat, res.Spawns[i].GCSLong,
+			gridCell(res.Spawns[i].GCSLat, res.Spawns[i].GCSLong),
+			res.Spawns[i].Quantity, res.Spawns[i].ResourceExpire)
 	}
 	// Remove the trailing comma
 	stmt = strings.TrimSuffix(stmt, ",")
@@ -35,3 +42,87 @@ func (res *Resources) AddResources(db *sql.DB) error {
 
 	return err
 }
+
+/* Get a spawn, locking it until the transaction ends so it can only be
+** collected once */
+func (spawn *Spawn) LockSpawn(tx *sql.Tx) error {
+	stmt := "SELECT item_id, gcs_lat, gcs_long, quantity, resource_expire FROM resources WHERE spawn_id=? FOR UPDATE"
+	return tx.QueryRow(stmt, spawn.SpawnID).Scan(&spawn.ItemID, &spawn.GCSLat,
+		&spawn.GCSLong, &spawn.Quantity, &spawn.ResourceExpire)
+}
+
+/* Take a quantity from a locked spawn, removing it once none is left */
+func (spawn *Spawn) Collect(tx *sql.Tx, quantity uint32) error {
+	if quantity >= spawn.Quantity {
+		_, err := tx.Exec("DELETE FROM resources WHERE spawn_id=?",
+			spawn.SpawnID)
+		if err == nil {
+			spawn.Quantity = 0
+		}
+		return err
+	}
+	stmt := "UPDATE resources SET quantity = quantity - ? WHERE spawn_id=?"
+	_, err := tx.Exec(stmt, quantity, spawn.SpawnID)
+	if err == nil {
+		spawn.Quantity -= quantity
+	}
+	return err
+}
+
+/* The ledger source of inventory changes made by collecting the spawn */
+func (spawn *Spawn) Source() string {
+	return fmt.Sprintf("spawn:%d", spawn.SpawnID)
+}
+
+/* Distance from the spawn to a location in kilometres, using the Haversine
+** formula */
+func (spawn *Spawn) Distance(lat, long float64) float64 {
+	lat1 := spawn.GCSLat * math.Pi / 180
+	lat2 := lat * math.Pi / 180
+	dLat := lat2 - lat1
+	dLong := (long - spawn.GCSLong) * math.Pi / 180
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLong/2)*math.Sin(dLong/2)
+	return 2 * EARTH_RADIUS * math.Asin(math.Sqrt(a))
+}
+
+/* Remove spawns by ID within a transaction, returning the number removed */
+func removeSpawns(tx *sql.Tx, spawnIDs []uint32) (int64, error) {
+	stmt := "DELETE FROM resources WHERE spawn_id IN ("
+	values := []interface{}{}
+	for i := 0; i < len(spawnIDs); i++ {
+		stmt += "?, "
+		values = append(values, spawnIDs[i])
+	}
+	// Remove the trailing space and comma, and add closing parenthesis
+	stmt = strings.TrimSuffix(stmt, ", ")
+	stmt += ")"
+
+	res, err := tx.Exec(stmt, values...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+/* Remove spawns matching any in the list by item ID, location and quantity,
+** returning the number removed */
+func removeSpawnsAt(db *sql.DB, spawns []SpawnResReq) (int64, error) {
+	stmt := "DELETE FROM resources WHERE (item_id, gcs_lat, gcs_long, quantity) IN ("
+	values := []interface{}{}
+	for i := 0; i < len(spawns); i++ {
+		stmt += "(?, ?, ?, ?), "
+		values = append(values, spawns[i].ItemID,
+			spawns[i].Location.Latitude, spawns[i].Location.Longitude,
+			spawns[i].Quantity)
+	}
+	// Remove the trailing space and comma, and add closing parenthesis
+	stmt = strings.TrimSuffix(stmt, ", ")
+	stmt += ")"
+
+	res, err := db.Exec(stmt, values...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
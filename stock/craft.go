@@ -0,0 +1,88 @@
+package stock
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/jaylees14/Manhattan-Server/catalog"
+)
+
+/* A count of an item crafted on a machine, with the recipe inputs scaled by
+** the count. The caller checks the user has built the machine */
+type Craft struct {
+	ItemID    uint32
+	MachineID uint32
+	Count     uint32
+	Inputs    Inventory
+	Output    Inventory
+}
+
+/* Plan crafting a count of an item for a user, checking the item is crafted
+** on a machine and the scaled recipe fits in a quantity */
+func NewCraft(cat *catalog.Catalog, userID, itemID, count uint32) (Craft,
+	error) {
+	var craft Craft
+	if count <= 0 {
+		return craft, errors.New("Invalid craft count")
+	}
+	item, ok := cat.Item(itemID)
+	if !ok {
+		return craft, errors.New("Invalid item ID")
+	}
+	if !cat.IsCraftable(item.ItemID) {
+		return craft, errors.New("Item is not crafted on a machine")
+	}
+
+	craft = Craft{ItemID: item.ItemID, MachineID: item.MachineID, Count: count}
+	for i := 0; i < len(item.Recipe); i++ {
+		quantity := uint64(item.Recipe[i].Quantity) * uint64(count)
+		if quantity > math.MaxUint32 {
+			return craft, errors.New("Invalid craft count")
+		}
+		craft.Inputs.Items = append(craft.Inputs.Items, Item{
+			UserID:   userID,
+			ItemID:   item.Recipe[i].ItemID,
+			Quantity: uint32(quantity),
+		})
+	}
+	craft.Output.Items = []Item{
+		{UserID: userID, ItemID: item.ItemID, Quantity: count},
+	}
+	return craft, nil
+}
+
+/* Reference to the craft recorded in the ledger */
+func (craft *Craft) Source() string {
+	return fmt.Sprintf("craft:%d", craft.ItemID)
+}
+
+/* Apply a craft within a transaction, removing the inputs from user
+** inventory and adding the output, which must fit once the inputs have been
+** removed. If the inputs fall short or the output does not fit, the
+** shortfalls or rejections are returned and the transaction must be rolled
+** back */
+func (craft *Craft) Apply(tx *sql.Tx, cat *catalog.Catalog) ([]Shortfall,
+	[]catalog.Rejection, error) {
+	shortfalls, err := craft.Inputs.RemoveInventory(tx)
+	if err != nil || len(shortfalls) > 0 {
+		return shortfalls, nil, err
+	}
+	err = craft.Inputs.LogRemoved(tx, LEDGER_CRAFTED, craft.Source())
+	if err != nil {
+		return shortfalls, nil, err
+	}
+
+	_, rejections, err := craft.Output.FitInventory(tx, cat)
+	if err != nil || len(rejections) > 0 {
+		return shortfalls, rejections, err
+	}
+
+	err = craft.Output.AddInventory(tx)
+	if err != nil {
+		return shortfalls, rejections, err
+	}
+	err = craft.Output.LogAdded(tx, LEDGER_CRAFTED, craft.Source())
+	return shortfalls, rejections, err
+}
@@ -0,0 +1,44 @@
+package stock
+
+import (
+	"encoding/json"
+	"time"
+)
+
+/* Inventory changes are recorded as events for the user's connected devices,
+** which are streamed from the progress service. Events are written in the
+** transaction making the change, so they are only sent once it commits */
+
+/* A change to the quantity of an item */
+type ItemDelta struct {
+	ItemID uint32 `json:"item_id"`
+	Delta  int64  `json:"delta"`
+}
+
+/* Inventory changes made together, with their ledger reason and source */
+type InventoryEvent struct {
+	Items  []ItemDelta `json:"items"`
+	Reason string      `json:"reason"`
+	Source string      `json:"source"`
+}
+
+// Type of the events recorded for inventory changes
+const EVENT_INVENTORY string = "inventory"
+
+// Events are kept for clients resuming a dropped stream
+const EVENT_TTL time.Duration = 24 * time.Hour
+
+/* Record an event for a user, with their inventory version once the change
+** has been applied */
+func AddEvent(db Executor, userID uint32, eventType string,
+	payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	stmt := "INSERT INTO event (user_id, event_type, payload, version, event_time, event_expire) SELECT ?, ?, ?, COALESCE(MAX(version), 0), ?, ? FROM inventory_version WHERE user_id=?"
+	_, err = db.Exec(stmt, userID, eventType, string(body), now.UnixNano(),
+		now.Add(EVENT_TTL).UnixNano(), userID)
+	return err
+}
@@ -0,0 +1,118 @@
+package stock
+
+import (
+	"database/sql"
+	"math"
+	"time"
+
+	"github.com/jaylees14/Manhattan-Server/catalog"
+)
+
+// Where a flagged gain was reported
+const (
+	FLAG_INVENTORY = "inventory"
+	FLAG_SYNC      = "sync"
+)
+
+/* Limit gains reported by clients within a transaction. Items gained by
+** crafting, building and trading cannot be reported, and primary resources
+** are capped at their max gain in each gain period of the catalog limits.
+** Returns the inventory within the caps, with repeated item IDs combined, and
+** the items which were not fully accepted */
+func (inv *Inventory) CapGains(tx *sql.Tx,
+	cat *catalog.Catalog) (Inventory, []catalog.Rejection, error) {
+	var accepted Inventory
+	rejections := make([]catalog.Rejection, 0)
+	if len(inv.Items) == 0 {
+		return accepted, rejections, nil
+	}
+
+	// Combine repeated item IDs, keeping the order they were sent in
+	requested := make(map[uint32]uint64)
+	order := make([]Item, 0)
+	for i := 0; i < len(inv.Items); i++ {
+		if _, ok := requested[inv.Items[i].ItemID]; !ok {
+			order = append(order, inv.Items[i])
+		}
+		requested[inv.Items[i].ItemID] += uint64(inv.Items[i].Quantity)
+	}
+
+	// Lock the inventory version so concurrent gains are counted in turn
+	userID := order[0].UserID
+	_, err := LockVersion(tx, userID)
+	if err != nil {
+		return accepted, rejections, err
+	}
+
+	since := time.Now().Add(-cat.GainPeriod()).UnixNano()
+	for i := 0; i < len(order); i++ {
+		itemID := order[i].ItemID
+		allowed := requested[itemID]
+		reason := ""
+		if !cat.IsSpawnable(itemID) {
+			allowed = 0
+			reason = catalog.REASON_UNTRUSTED
+		} else if maxGain := cat.MaxGain(itemID); maxGain > 0 {
+			gained, err := getGained(tx, userID, itemID, since)
+			if err != nil {
+				return accepted, rejections, err
+			}
+			remaining := uint64(0)
+			if gained < uint64(maxGain) {
+				remaining = uint64(maxGain) - gained
+			}
+			if allowed > remaining {
+				allowed = remaining
+				reason = catalog.REASON_GAIN_LIMIT
+			}
+		}
+		if allowed > math.MaxUint32 {
+			allowed = math.MaxUint32
+		}
+
+		if allowed > 0 {
+			accepted.Items = append(accepted.Items, Item{
+				UserID:   userID,
+				ItemID:   itemID,
+				Quantity: uint32(allowed),
+			})
+		}
+		if allowed < requested[itemID] {
+			rejections = append(rejections, catalog.Rejection{
+				ItemID:    itemID,
+				Requested: requested[itemID],
+				Accepted:  uint32(allowed),
+				Reason:    reason,
+			})
+		}
+	}
+	return accepted, rejections, nil
+}
+
+/* Get the quantity of an item a user has reported as gained since the given
+** time, from the ledger */
+func getGained(tx *sql.Tx, userID, itemID uint32, since int64) (uint64,
+	error) {
+	var gained uint64
+	stmt := "SELECT COALESCE(SUM(delta), 0) FROM ledger WHERE user_id=? AND item_id=? AND entry_time >= ? AND reason=? AND delta > 0"
+	err := tx.QueryRow(stmt, userID, itemID, since, LEDGER_CLIENT_SYNC).Scan(
+		&gained)
+	return gained, err
+}
+
+/* Record rejected gains for review. Flags are written outside the request
+** transaction, so they are kept when the request is rolled back */
+func FlagRejections(db Executor, userID uint32,
+	rejections []catalog.Rejection, source string) error {
+	stmt := "INSERT INTO flag (user_id, item_id, requested, accepted, reason, source, flag_time) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	now := time.Now().UnixNano()
+	for i := 0; i < len(rejections); i++ {
+		_, err := db.Exec(stmt, userID, rejections[i].ItemID,
+			rejections[i].Requested, rejections[i].Accepted,
+			rejections[i].Reason, source, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package stock
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/jaylees14/Manhattan-Server/catalog"
+)
+
+type Inventory struct {
+	Items []Item `json:"items"`
+}
+
+type Item struct {
+	UserID   uint32 `json:"user_id"`
+	ItemID   uint32 `json:"item_id"`
+	Quantity uint32 `json:"quantity"`
+}
+
+/* Satisfied by both *sql.DB and *sql.Tx, so inventory changes can be part of
+** a larger transaction */
+type Executor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+/* Add a variable number of items to user inventory, checking if an entry
+** exists for the given user ID, item ID pair. If one does exist, the
+** quantity is added to the existing entry, otherwise a new entry is added
+ */
+func (inv *Inventory) AddInventory(db Executor) error {
+	stmt := "INSERT INTO inventory VALUES"
+	values := []interface{}{}
+	for i := 0; i < len(inv.Items); i++ {
+		stmt += " (?, ?, ?),"
+		values = append(values, inv.Items[i].UserID, inv.Items[i].ItemID,
+			inv.Items[i].Quantity)
+	}
+	// Remove the trailing comma
+	stmt = strings.TrimSuffix(stmt, ",")
+	stmt += " ON DUPLICATE KEY UPDATE quantity = quantity + VALUES (quantity)"
+
+	_, err := db.Exec(stmt, values...)
+	if err != nil {
+		return err
+	}
+
+	return inv.bumpVersions(db)
+}
+
+type Shortfall struct {
+	ItemID    uint32 `json:"item_id"`
+	Required  uint64 `json:"required"`
+	Available uint32 `json:"available"`
+}
+
+/* Remove a variable number of items from user inventory within a transaction.
+** If any item would go below zero nothing is removed and the shortfalls are
+** returned instead. Entries reaching zero are deleted
+ */
+func (inv *Inventory) RemoveInventory(tx *sql.Tx) ([]Shortfall, error) {
+	shortfalls := make([]Shortfall, 0)
+
+	// Combine repeated item IDs, keeping the order they were sent in
+	required := make(map[uint32]uint64)
+	order := make([]Item, 0)
+	for i := 0; i < len(inv.Items); i++ {
+		if _, ok := required[inv.Items[i].ItemID]; !ok {
+			order = append(order, inv.Items[i])
+		}
+		required[inv.Items[i].ItemID] += uint64(inv.Items[i].Quantity)
+	}
+
+	// Lock each entry and check there is enough of it
+	stmt := "SELECT quantity FROM inventory WHERE user_id=? AND item_id=? FOR UPDATE"
+	for i := 0; i < len(order); i++ {
+		var available uint32
+		err := tx.QueryRow(stmt, order[i].UserID, order[i].ItemID).Scan(
+			&available)
+		if err != nil && err != sql.ErrNoRows {
+			return shortfalls, err
+		}
+		if uint64(available) < required[order[i].ItemID] {
+			shortfalls = append(shortfalls, Shortfall{
+				ItemID:    order[i].ItemID,
+				Required:  required[order[i].ItemID],
+				Available: available,
+			})
+		}
+	}
+	if len(shortfalls) > 0 {
+		return shortfalls, nil
+	}
+
+	// Remove the quantities, deleting entries which have run out
+	updateStmt := "UPDATE inventory SET quantity = quantity - ? WHERE user_id=? AND item_id=?"
+	deleteStmt := "DELETE FROM inventory WHERE user_id=? AND item_id=? AND quantity=0"
+	for i := 0; i < len(order); i++ {
+		_, err := tx.Exec(updateStmt, required[order[i].ItemID],
+			order[i].UserID, order[i].ItemID)
+		if err != nil {
+			return shortfalls, err
+		}
+		_, err = tx.Exec(deleteStmt, order[i].UserID, order[i].ItemID)
+		if err != nil {
+			return shortfalls, err
+		}
+	}
+	return shortfalls, inv.bumpVersions(tx)
+}
+
+/* Fit items into user inventory within a transaction, limiting each item by
+** its max stack in the catalog and the inventory slot capacity. Returns the inventory that
+** fits, with repeated item IDs combined, and the items which did not fully fit
+ */
+func (inv *Inventory) FitInventory(tx *sql.Tx,
+	cat *catalog.Catalog) (Inventory, []catalog.Rejection, error) {
+	var accepted Inventory
+	rejections := make([]catalog.Rejection, 0)
+	if len(inv.Items) == 0 {
+		return accepted, rejections, nil
+	}
+
+	// Combine repeated item IDs, keeping the order they were sent in
+	requested := make(map[uint32]uint64)
+	order := make([]Item, 0)
+	for i := 0; i < len(inv.Items); i++ {
+		if _, ok := requested[inv.Items[i].ItemID]; !ok {
+			order = append(order, inv.Items[i])
+		}
+		requested[inv.Items[i].ItemID] += uint64(inv.Items[i].Quantity)
+	}
+
+	// Lock the user's entries so the limits hold until the transaction ends
+	stmt := "SELECT item_id, quantity FROM inventory WHERE user_id=? FOR UPDATE"
+	rows, err := tx.Query(stmt, order[0].UserID)
+	if err != nil {
+		return accepted, rejections, err
+	}
+	defer rows.Close()
+	held := make(map[uint32]uint32)
+	for rows.Next() {
+		var item Item
+		err = rows.Scan(&item.ItemID, &item.Quantity)
+		if err != nil {
+			return accepted, rejections, err
+		}
+		held[item.ItemID] = item.Quantity
+	}
+	err = rows.Err()
+	if err != nil {
+		return accepted, rejections, err
+	}
+
+	for i := 0; i < len(order); i++ {
+		itemID := order[i].ItemID
+		quantity, reason := cat.Fit(held, itemID, requested[itemID])
+		if quantity > 0 {
+			accepted.Items = append(accepted.Items, Item{
+				UserID:   order[i].UserID,
+				ItemID:   itemID,
+				Quantity: quantity,
+			})
+		}
+		if uint64(quantity) < requested[itemID] {
+			rejections = append(rejections, catalog.Rejection{
+				ItemID:    itemID,
+				Requested: requested[itemID],
+				Accepted:  quantity,
+				Reason:    reason,
+			})
+		}
+	}
+	return accepted, rejections, nil
+}
+
+/* Copy an inventory, assigning every item to the given user */
+func (inv *Inventory) ForUser(userID uint32) Inventory {
+	var moved Inventory
+	for i := 0; i < len(inv.Items); i++ {
+		moved.Items = append(moved.Items, Item{
+			UserID:   userID,
+			ItemID:   inv.Items[i].ItemID,
+			Quantity: inv.Items[i].Quantity,
+		})
+	}
+	return moved
+}
+
+/* Increment the inventory version of each user with items in the list */
+func (inv *Inventory) bumpVersions(db Executor) error {
+	bumped := make(map[uint32]bool)
+	for i := 0; i < len(inv.Items); i++ {
+		if bumped[inv.Items[i].UserID] {
+			continue
+		}
+		err := BumpVersion(db, inv.Items[i].UserID)
+		if err != nil {
+			return err
+		}
+		bumped[inv.Items[i].UserID] = true
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package stock
+
+import (
+	"time"
+)
+
+// Reasons for changes to user inventory, recorded in the ledger
+const (
+	LEDGER_COLLECTED   = "collected"
+	LEDGER_CRAFTED     = "crafted"
+	LEDGER_BUILT       = "built"
+	LEDGER_TRADED      = "traded"
+	LEDGER_ADMIN       = "admin"
+	LEDGER_EXCHANGED   = "exchanged"
+	LEDGER_GIFTED      = "gifted"
+	LEDGER_CLIENT_SYNC = "client-sync"
+)
+
+/* Record items added to user inventory, with the reason and a reference to
+** what caused the change, such as a trade ID */
+func (inv *Inventory) LogAdded(db Executor, reason, source string) error {
+	return inv.logChange(db, 1, reason, source)
+}
+
+/* Record items removed from user inventory */
+func (inv *Inventory) LogRemoved(db Executor, reason, source string) error {
+	return inv.logChange(db, -1, reason, source)
+}
+
+func (inv *Inventory) logChange(db Executor, sign int64, reason,
+	source string) error {
+	stmt := "INSERT INTO ledger (user_id, item_id, delta, reason, source, entry_time) VALUES (?, ?, ?, ?, ?, ?)"
+	now := time.Now().UnixNano()
+	events := make(map[uint32]*InventoryEvent)
+	var users []uint32
+	for i := 0; i < len(inv.Items); i++ {
+		delta := sign * int64(inv.Items[i].Quantity)
+		_, err := db.Exec(stmt, inv.Items[i].UserID, inv.Items[i].ItemID,
+			delta, reason, source, now)
+		if err != nil {
+			return err
+		}
+
+		event, ok := events[inv.Items[i].UserID]
+		if !ok {
+			event = &InventoryEvent{Reason: reason, Source: source}
+			events[inv.Items[i].UserID] = event
+			users = append(users, inv.Items[i].UserID)
+		}
+		event.Items = append(event.Items, ItemDelta{
+			ItemID: inv.Items[i].ItemID,
+			Delta:  delta,
+		})
+	}
+
+	// Each user's other devices are told of their own changes
+	for i := 0; i < len(users); i++ {
+		err := AddEvent(db, users[i], EVENT_INVENTORY, events[users[i]])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
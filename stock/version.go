@@ -0,0 +1,96 @@
+package stock
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+/* Every change to a user's inventory increments its version, which is sent
+** to clients as an ETag. Mutations sent with an If-Match header are refused
+** if the inventory has changed since the client last read it */
+
+/* Increment the inventory version of a user */
+func BumpVersion(db Executor, userID uint32) error {
+	stmt := "INSERT INTO inventory_version VALUES (?, 1) ON DUPLICATE KEY UPDATE version = version + 1"
+	_, err := db.Exec(stmt, userID)
+	return err
+}
+
+/* Get the inventory version of a user, zero if it has never changed */
+func GetVersion(tx *sql.Tx, userID uint32) (uint64, error) {
+	var version uint64
+	stmt := "SELECT version FROM inventory_version WHERE user_id=?"
+	err := tx.QueryRow(stmt, userID).Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return version, err
+}
+
+/* Get the inventory version of a user, locking it until the transaction ends
+** so it cannot change before the request is applied */
+func LockVersion(tx *sql.Tx, userID uint32) (uint64, error) {
+	var version uint64
+	stmt := "SELECT version FROM inventory_version WHERE user_id=? FOR UPDATE"
+	err := tx.QueryRow(stmt, userID).Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return version, err
+}
+
+/* Format an inventory version as an ETag */
+func FormatETag(version uint64) string {
+	return fmt.Sprintf("\"%d\"", version)
+}
+
+/* Check the If-Match header of a request against an inventory version.
+** Requests without the header always match, and weak tags never do */
+func MatchesETag(r *http.Request, version uint64) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+	etag := FormatETag(version)
+	tags := strings.Split(header, ",")
+	for i := 0; i < len(tags); i++ {
+		tag := strings.TrimSpace(tags[i])
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+/* Check the If-Match header of a mutation against the user's inventory
+** version within a transaction, responding with a 412 and the current ETag
+** if the inventory has changed. Returns false if a response was written */
+func CheckIfMatch(w http.ResponseWriter, r *http.Request, tx *sql.Tx,
+	userID uint32) bool {
+	if r.Header.Get("If-Match") == "" {
+		return true
+	}
+	version, err := LockVersion(tx, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return false
+	}
+	if !MatchesETag(r, version) {
+		w.Header().Set("ETag", FormatETag(version))
+		respondWithError(w, http.StatusPreconditionFailed,
+			"Inventory has changed")
+		return false
+	}
+	return true
+}
+
+/* Respond with an error JSON, as the services do */
+func respondWithError(w http.ResponseWriter, code int, message string) {
+	response, _ := json.Marshal(map[string]string{"error": message})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}